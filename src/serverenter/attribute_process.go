@@ -0,0 +1,165 @@
+/*
+* 自定义属性定义的管理
+* 1. 查询全部属性定义，监听路径为 GET /attribute-definitions
+* 2. 增加属性定义，监听路径为 POST /attribute-definitions               请求体为 {"name", "type", "rules"}
+* 3. 查询单个属性定义，监听路径为 GET /attribute-definitions/:name
+* 4. 修改属性定义的规则，监听路径为 PUT /attribute-definitions/:name     类型不能修改，已经保存的值不会重新校验
+* 5. 删除属性定义，监听路径为 DELETE /attribute-definitions/:name         同时删除全部用户的该属性值
+* 类型有 string, int, bool, date, enum，规则见 USER.AttributeRules
+ */
+package main
+
+import (
+	"net/http"
+	"serverenter/user"
+	"third/gin"
+)
+
+//查询参数中自定义属性的前缀，attr.<属性名>=<值>
+const ATTRIBUTE_PARAM_PREFIX = "attr."
+
+func (u_mgr *UserManager) registerAttributeOperation() {
+	if u_mgr.canWork() {
+		u_mgr.http.GET("/attribute-definitions", func(c *gin.Context) {
+			u_mgr.queryDefinitions(c)
+		})
+		u_mgr.http.POST("/attribute-definitions", func(c *gin.Context) {
+			u_mgr.addDefinition(c)
+		})
+		u_mgr.http.GET("/attribute-definitions/:name", func(c *gin.Context) {
+			u_mgr.queryDefinition(c)
+		})
+		u_mgr.http.PUT("/attribute-definitions/:name", func(c *gin.Context) {
+			u_mgr.updateDefinition(c)
+		})
+		u_mgr.http.DELETE("/attribute-definitions/:name", func(c *gin.Context) {
+			u_mgr.deleteDefinition(c)
+		})
+	}
+}
+
+func (u_mgr *UserManager) queryDefinitions(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	defs, err := u_mgr.store.FetchDefinitions()
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": defs})
+}
+
+func (u_mgr *UserManager) queryDefinition(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	defs, err := u_mgr.store.FetchDefinitions()
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	def := defs.Find(c.Param("name"))
+	if def == nil {
+		c.JSON(404, gin.H{"error": USER.ErrAttributeNotFound.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": def})
+}
+
+func (u_mgr *UserManager) addDefinition(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	def := &USER.AttributeDefinition{}
+	if !c.Bind(def) {
+		c.JSON(400, gin.H{"error": "请求体格式错误", "detail": c.LastError().Error()})
+		return
+	}
+	def.ID = 0
+	if err := def.Check(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if renderDefinitionError(c, u_mgr.store.AddDefinition(def)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": def})
+}
+
+func (u_mgr *UserManager) updateDefinition(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	def := &USER.AttributeDefinition{}
+	if !c.Bind(def) {
+		c.JSON(400, gin.H{"error": "请求体格式错误", "detail": c.LastError().Error()})
+		return
+	}
+	//名字取自路径，没有指定类型时使用原来的类型
+	def.Name = c.Param("name")
+	if def.Type == "" {
+		defs, err := u_mgr.store.FetchDefinitions()
+		if err != nil {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+			return
+		}
+		if old := defs.Find(def.Name); old != nil {
+			def.Type = old.Type
+		}
+	}
+	if err := def.Check(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if renderDefinitionError(c, u_mgr.store.UpdateDefinition(def)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": def})
+}
+
+func (u_mgr *UserManager) deleteDefinition(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	name := c.Param("name")
+	if renderDefinitionError(c, u_mgr.store.DeleteDefinition(name)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": gin.H{"name": name}})
+}
+
+/*
+ *  Description:   输出操作属性定义的错误
+ *  Return        :   true 有错误并且已经输出， false 没有错误
+ */
+func renderDefinitionError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case USER.ErrAttributeNotFound:
+		c.JSON(404, gin.H{"error": err.Error()})
+	case USER.ErrAttributeExists:
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+	}
+	return true
+}
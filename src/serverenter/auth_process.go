@@ -0,0 +1,218 @@
+/*
+* 用户的密码和登录，密码哈希的算法和存储见 USER.Credential
+* 1. 设置或修改密码，监听路径为 POST /user/:id/password    请求体为 {"password", "old_password"}
+*    已经有密码时必须带正确的 old_password, 否则返回 401
+*    没有密码时任何人都可以设置，所以设置首次密码必须带请求头 X-Setup-Token, 与配置的 PasswordSetupToken 相同
+*    没有配置 PasswordSetupToken 时不能通过接口设置首次密码，令牌不对或没有配置都返回 403
+* 2. 登录，监听路径为 POST /auth/login                       请求体为 {"id" 或 "email" 或 "phone", "password"}
+*    成功时返回用户，用户不存在，没有密码，密码错误都返回相同的 401, 响应时间相同
+*    密码的算法或参数落后时，登录成功后按当前的算法重新计算哈希
+* 响应和日志中不包括密码和哈希，不生成会话或令牌
+ */
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"serverenter/user"
+	"third/gin"
+)
+
+//设置密码的请求体
+type passwordRequest struct {
+	Password    string `form:"password" json:"password"`
+	OldPassword string `form:"old_password" json:"old_password"`
+}
+
+//登录的请求体，id, email, phone 只能有一个
+type loginRequest struct {
+	ID       int    `form:"id" json:"id"`
+	Email    string `form:"email" json:"email"`
+	Phone    string `form:"phone" json:"phone"`
+	Password string `form:"password" json:"password"`
+}
+
+const LOGIN_FAILED = "用户名或密码错误"
+
+//设置首次密码时带令牌的请求头
+const SETUP_TOKEN_HEADER = "X-Setup-Token"
+
+func (u_mgr *UserManager) registerAuthOperation() {
+	if u_mgr.canWork() {
+		u_mgr.http.POST("/user/:id/password", func(c *gin.Context) {
+			u_mgr.setPassword(c)
+		})
+		u_mgr.http.POST("/auth/login", func(c *gin.Context) {
+			u_mgr.login(c)
+		})
+	}
+}
+
+func (u_mgr *UserManager) setPassword(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	req := &passwordRequest{}
+	if !c.Bind(req) {
+		c.JSON(400, gin.H{"error": "请求体格式错误"})
+		return
+	}
+	if err := USER.CheckPassword(req.Password); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	//已经有密码时检查旧密码，保存时原子地检查哈希没有被其他请求修改
+	current := ""
+	old, err := u_mgr.store.FetchCredential(id)
+	switch err {
+	case nil:
+		if !verifyPassword(old, req.OldPassword) {
+			c.JSON(401, gin.H{"error": "旧密码错误"})
+			return
+		}
+		current = old.Hash
+	case USER.ErrNoCredential:
+		if !u_mgr.checkSetupToken(c.Request.Header.Get(SETUP_TOKEN_HEADER)) {
+			c.JSON(403, gin.H{"error": "设置首次密码需要正确的 " + SETUP_TOKEN_HEADER})
+			return
+		}
+	default:
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+
+	cred, err := USER.NewCredential(id, req.Password)
+	if err != nil {
+		c.JSON(405, gin.H{"status": "计算密码哈希时发生错误"})
+		return
+	}
+	switch err := u_mgr.store.SetCredential(cred, current); err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"object": cred})
+	case USER.ErrUserNotFound:
+		c.JSON(404, gin.H{"error": err.Error()})
+	case USER.ErrCredentialChanged:
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+	}
+}
+
+/*
+ *  Description:    检查设置首次密码的令牌，没有配置令牌时总是失败，按固定时间比较
+ */
+func (u_mgr *UserManager) checkSetupToken(token string) bool {
+	if u_mgr.setup_token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(u_mgr.setup_token)) == 1
+}
+
+func (u_mgr *UserManager) login(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	req := &loginRequest{}
+	if !c.Bind(req) {
+		c.JSON(400, gin.H{"error": "请求体格式错误"})
+		return
+	}
+	u_pack := &USER.UserQueryPack{Offset: -1, Limit: -1, IDRange: USER.Range{Low: -1, High: -1}}
+	given := 0
+	if req.ID > 0 {
+		u_pack.Usr.ID = req.ID
+		given++
+	}
+	if req.Email != "" {
+		email, err := USER.NormalizeEmail(req.Email)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		u_pack.Usr.Email = email
+		given++
+	}
+	if req.Phone != "" {
+		phone, err := USER.NormalizePhone(req.Phone, u_mgr.country_code)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		u_pack.Usr.Phone = phone
+		given++
+	}
+	if given != 1 {
+		c.JSON(400, gin.H{"error": "id, email, phone 必须并且只能有一个"})
+		return
+	}
+
+	usr_list := USER.UserList{}
+	if err := usr_list.Fetch(u_mgr.store, u_pack); err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	var cred *USER.Credential
+	if len(usr_list) == 1 {
+		var err error
+		cred, err = u_mgr.store.FetchCredential(usr_list[0].ID)
+		if err != nil && err != USER.ErrNoCredential {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+			return
+		}
+	}
+	//用户不存在或没有密码时同样计算一次哈希，不从响应时间区分失败的原因
+	if cred == nil {
+		USER.VerifyNothing(req.Password)
+		c.JSON(401, gin.H{"error": LOGIN_FAILED})
+		return
+	}
+	if !verifyPassword(cred, req.Password) {
+		c.JSON(401, gin.H{"error": LOGIN_FAILED})
+		return
+	}
+
+	usr := usr_list[0]
+	if cred.Outdated() {
+		u_mgr.rehashPassword(cred, req.Password)
+	}
+	usr.GenderLabel = u_mgr.genders.Label(usr.Gender, u_mgr.gender_lang)
+	c.JSON(http.StatusOK, gin.H{"object": usr})
+}
+
+/*
+ *  Description:   检查密码，哈希无法解析时按密码错误处理，日志中只有用户ID和算法
+ */
+func verifyPassword(cred *USER.Credential, password string) bool {
+	ok, err := cred.Verify(password)
+	if err != nil {
+		log.Printf("检查用户 %d 的密码失败(%s): %v", cred.UserID, cred.Algorithm, err)
+		return false
+	}
+	return ok
+}
+
+/*
+ *  Description:   按当前的算法重新计算登录成功的用户的密码哈希，失败时只记录日志，不影响登录
+ */
+func (u_mgr *UserManager) rehashPassword(old *USER.Credential, password string) {
+	cred, err := USER.NewCredential(old.UserID, password)
+	if err == nil {
+		err = u_mgr.store.SetCredential(cred, old.Hash)
+	}
+	//同时修改了密码时保留新的密码
+	if err != nil && err != USER.ErrCredentialChanged {
+		log.Printf("更新用户 %d 的密码哈希(%s -> %s)失败: %v", old.UserID, old.Algorithm, USER.DEFAULT_PASSWORD_ALGORITHM, err)
+	}
+}
@@ -0,0 +1,379 @@
+/*
+* 批量操作, POST /batch
+* 1. 请求体为 {"operations": [...]}，按顺序执行 add, update, delete, query 操作，每个操作返回一个结果
+*    add    {"op":"add", "ref":"a", "user":{...}}                   ref 给新增的用户命名
+*    update {"op":"update", "id":1, "version":2, "user":{...}}       只更新非空字段，version 不为0时检查版本
+*    delete {"op":"delete", "id":"$a", "version":0}                  软删除
+*    query  {"op":"query", "id":1} 或 {"op":"query", "filter":"...", "sort":"-name", "limit":20}
+*    id 可以是 "$<ref>"，引用同一批中前面新增的用户的ID
+* 2. mode=atomic(默认) 所有操作在一个事务中，任何一个失败时全部回滚，后面的操作不执行，响应码为失败的操作的响应码
+*    mode=best_effort 每个操作单独执行，失败的操作不影响其他操作，响应码为 200
+* 3. 每个结果的 status 与单独调用对应接口时的响应码相同，例如 404 用户不存在，409 唯一字段重复，412 版本不一致
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"serverenter/user"
+	"strings"
+	"third/gin"
+)
+
+//批量操作的模式
+const (
+	BATCH_MODE_ATOMIC      = "atomic"      //全部成功或全部回滚
+	BATCH_MODE_BEST_EFFORT = "best_effort" //每个操作单独执行
+)
+
+const (
+	MAX_BATCH_OPERATIONS = 100  //一批最多的操作数
+	DEFAULT_BATCH_LIMIT  = 20   //query 默认返回的用户数
+	MAX_BATCH_LIMIT      = 1000 //query 最多返回的用户数
+)
+
+//没有执行的操作的状态，前面的操作失败
+const BATCH_STATUS_SKIPPED = http.StatusFailedDependency
+
+//批量操作的请求体
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+//一个操作
+type batchOperation struct {
+	Op      string          `json:"op"`      //add, update, delete, query
+	Ref     string          `json:"ref"`     //add: 新增的用户的名字，后面的操作用 "$<ref>" 引用它的ID
+	ID      json.RawMessage `json:"id"`      //用户ID 或 "$<ref>"
+	Version int             `json:"version"` //update, delete: 期望的版本号，0 表示不检查
+	User    *USER.User      `json:"user"`    //add, update: 用户字段
+	Filter  string          `json:"filter"`  //query: 没有 id 时的过滤表达式
+	Sort    string          `json:"sort"`    //query: 排序
+	Limit   int             `json:"limit"`   //query: 最多返回的用户数
+}
+
+//一个操作的结果
+type batchResult struct {
+	Index     int                  `json:"index"`
+	Op        string               `json:"op"`
+	Status    int                  `json:"status"`
+	Object    interface{}          `json:"object,omitempty"`
+	Error     string               `json:"error,omitempty"`
+	Allowed   []string             `json:"allowed,omitempty"`
+	Attribute *USER.AttributeError `json:"attribute,omitempty"`
+	Conflict  *USER.ConflictError  `json:"conflict,omitempty"`
+	Filter    *USER.FilterError    `json:"filter,omitempty"`
+	Sort      *USER.SortError      `json:"sort,omitempty"`
+}
+
+//操作的参数错误，对应单独调用接口时的响应码
+type batchError struct {
+	status int
+	err    error
+}
+
+func (batch_err *batchError) Error() string {
+	return batch_err.err.Error()
+}
+
+/*
+ *  Description:   参数错误，响应码 400
+ */
+func badOperation(err error) error {
+	return &batchError{status: 400, err: err}
+}
+
+/*
+ *  Description:   记录操作失败的原因和响应码
+ */
+func (result *batchResult) fail(err error) {
+	result.Status = 405
+	if batch_err, ok := err.(*batchError); ok {
+		result.Status, err = batch_err.status, batch_err.err
+	}
+	switch err {
+	case USER.ErrUserNotFound:
+		result.Status = 404
+	case USER.ErrVersionMismatch:
+		result.Status = 412
+	case USER.ErrTxConflict:
+		result.Status = http.StatusConflict
+	}
+
+	switch detail := err.(type) {
+	case *USER.ConflictError:
+		result.Status, result.Conflict = http.StatusConflict, detail
+	case *USER.GenderError:
+		result.Allowed = detail.Allowed
+	case *USER.AttributeError:
+		result.Attribute = detail
+	case *USER.FilterError:
+		result.Filter = detail
+	case *USER.SortError:
+		result.Sort = detail
+	}
+
+	result.Error = err.Error()
+	if result.Status == 405 {
+		result.Error = "操作数据库时发生错误"
+	}
+}
+
+func (u_mgr *UserManager) registerBatchOperation() {
+	if u_mgr.canWork() {
+		u_mgr.http.POST("/batch", func(c *gin.Context) {
+			u_mgr.runBatch(c)
+		})
+	}
+}
+
+func (u_mgr *UserManager) runBatch(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	mode := c.DefaultQuery("mode", BATCH_MODE_ATOMIC)
+	if mode != BATCH_MODE_ATOMIC && mode != BATCH_MODE_BEST_EFFORT {
+		c.JSON(400, gin.H{"error": "mode 只能是 atomic 或 best_effort"})
+		return
+	}
+	req := batchRequest{}
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		c.JSON(400, gin.H{"error": "请求体格式错误", "detail": err.Error()})
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > MAX_BATCH_OPERATIONS {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("operations 应有 1 到 %d 个操作", MAX_BATCH_OPERATIONS)})
+		return
+	}
+
+	//属性定义在整批操作中不变，事务开始前读取一次
+	defs, err := u_mgr.store.FetchDefinitions()
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+
+	run := &batchRun{u_mgr: u_mgr, c: c, defs: defs, refs: make(map[string]int)}
+	var tx USER.UserTx
+	if mode == BATCH_MODE_ATOMIC {
+		tx, err = u_mgr.store.BeginTx()
+		if err != nil {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+			return
+		}
+		//提交后回滚返回 ErrTxDone, 不影响结果
+		defer tx.Rollback()
+		run.store = USER.Audited(tx, getOperator(c))
+	} else {
+		run.store = u_mgr.auditedStore(c)
+	}
+
+	results := make([]batchResult, len(req.Operations))
+	failed := -1
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		if failed != -1 {
+			results[i] = batchResult{Index: i, Op: op.Op, Status: BATCH_STATUS_SKIPPED, Error: "前面的操作失败，没有执行"}
+			continue
+		}
+		results[i] = run.run(i, op)
+		if tx != nil && results[i].Status != http.StatusOK {
+			failed = i
+		}
+	}
+
+	if tx == nil {
+		c.JSON(http.StatusOK, gin.H{"committed": true, "results": results})
+		return
+	}
+	if failed != -1 {
+		if err := tx.Rollback(); err != nil {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误", "results": results})
+			return
+		}
+		c.JSON(results[failed].Status, gin.H{"committed": false, "failed": failed, "results": results})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		if err == USER.ErrTxConflict {
+			c.JSON(http.StatusConflict, gin.H{"committed": false, "error": err.Error(), "results": results})
+			return
+		}
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误", "results": results})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"committed": true, "results": results})
+}
+
+//一批操作的执行状态
+type batchRun struct {
+	u_mgr *UserManager
+	c     *gin.Context
+	store USER.UserStore            //atomic 时为事务中的存储
+	defs  USER.AttributeDefinitions //属性定义
+	refs  map[string]int            //ref -> 新增的用户ID
+}
+
+/*
+ *  Description:   执行一个操作
+ *  Param         :  index 操作的序号, op 操作
+ */
+func (run *batchRun) run(index int, op *batchOperation) batchResult {
+	result := batchResult{Index: index, Op: op.Op, Status: http.StatusOK}
+	var err error
+	switch op.Op {
+	case "add":
+		result.Object, err = run.add(op)
+	case "update":
+		result.Object, err = run.update(op)
+	case "delete":
+		err = run.delete(op)
+	case "query":
+		result.Object, err = run.query(op)
+	default:
+		err = badOperation(errors.New("op 只能是 add, update, delete 或 query"))
+	}
+	if err != nil {
+		result.fail(err)
+	}
+	return result
+}
+
+/*
+ *  Description:   获取操作的用户ID
+ *  Param         :  raw 整数或 "$<ref>", required 是否必须有ID
+ *  Return        :   int 用户ID，没有时为0， error 参数错误
+ */
+func (run *batchRun) resolveID(raw json.RawMessage, required bool) (int, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		if required {
+			return 0, badOperation(errors.New("缺少 id"))
+		}
+		return 0, nil
+	}
+
+	id := 0
+	if err := json.Unmarshal(raw, &id); err == nil {
+		if id <= 0 {
+			return 0, badOperation(errors.New("id 应为正整数"))
+		}
+		return id, nil
+	}
+	ref := ""
+	if err := json.Unmarshal(raw, &ref); err != nil || !strings.HasPrefix(ref, "$") {
+		return 0, badOperation(errors.New(`id 应为正整数或 "$<ref>"`))
+	}
+	id, ok := run.refs[ref[1:]]
+	if !ok {
+		return 0, badOperation(fmt.Errorf("%s 不是前面新增成功的用户", ref))
+	}
+	return id, nil
+}
+
+/*
+ *  Description:   校验操作中的用户字段
+ */
+func (run *batchRun) user(op *batchOperation) (USER.User, error) {
+	if op.User == nil {
+		return USER.User{}, badOperation(errors.New("缺少 user"))
+	}
+	usr := *op.User
+	if err := run.u_mgr.normalizeRecord(&usr, run.defs); err != nil {
+		return usr, badOperation(err)
+	}
+	return usr, nil
+}
+
+func (run *batchRun) add(op *batchOperation) (interface{}, error) {
+	if _, ok := run.refs[op.Ref]; ok && op.Ref != "" {
+		return nil, badOperation(fmt.Errorf("ref %q 重复", op.Ref))
+	}
+	usr, err := run.user(op)
+	if err != nil {
+		return nil, err
+	}
+	if err := usr.Add(run.store); err != nil {
+		return nil, err
+	}
+	if op.Ref != "" {
+		run.refs[op.Ref] = usr.ID
+	}
+	return usr, nil
+}
+
+func (run *batchRun) update(op *batchOperation) (interface{}, error) {
+	id, err := run.resolveID(op.ID, true)
+	if err != nil {
+		return nil, err
+	}
+	usr, err := run.user(op)
+	if err != nil {
+		return nil, err
+	}
+	usr.ID = id
+	if err := usr.UpdateOne(run.store, op.Version); err != nil {
+		return nil, err
+	}
+	return usr, nil
+}
+
+func (run *batchRun) delete(op *batchOperation) error {
+	id, err := run.resolveID(op.ID, true)
+	if err != nil {
+		return err
+	}
+	usr := &USER.User{ID: id}
+	return usr.DeleteOne(run.store, op.Version)
+}
+
+/*
+ *  Description:   按ID查询单个用户，或按 filter 和 sort 查询用户列表
+ */
+func (run *batchRun) query(op *batchOperation) (interface{}, error) {
+	id, err := run.resolveID(op.ID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	usr_pack := &USER.UserQueryPack{Usr: USER.User{ID: id}, Offset: -1, Limit: -1, IDRange: USER.Range{Low: -1, High: -1}}
+	if id == 0 {
+		usr_pack.Limit = DEFAULT_BATCH_LIMIT
+		if op.Limit < 0 || op.Limit > MAX_BATCH_LIMIT {
+			return nil, badOperation(fmt.Errorf("limit 应为 1 到 %d 之间的整数", MAX_BATCH_LIMIT))
+		} else if op.Limit != 0 {
+			usr_pack.Limit = op.Limit
+		}
+		usr_pack.Sort = USER.OrderSort(1)
+		if op.Sort != "" {
+			if usr_pack.Sort, err = USER.ParseSort(op.Sort); err != nil {
+				return nil, badOperation(err)
+			}
+		}
+		if op.Filter != "" {
+			opts := &USER.FilterOptions{Genders: run.u_mgr.genders, CountryCode: run.u_mgr.country_code, Definitions: run.defs}
+			if usr_pack.Filter, err = USER.ParseFilter(op.Filter, opts); err != nil {
+				return nil, badOperation(err)
+			}
+		}
+	}
+
+	usr_list := USER.UserList{}
+	if err := usr_list.Fetch(run.store, usr_pack); err != nil {
+		return nil, err
+	}
+	run.u_mgr.labelGenders(run.c, usr_list)
+	if id == 0 {
+		return usr_list, nil
+	}
+	if len(usr_list) == 0 {
+		return nil, USER.ErrUserNotFound
+	}
+	return usr_list[0], nil
+}
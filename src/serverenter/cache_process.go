@@ -0,0 +1,42 @@
+/*
+* 用户查询的 memcache 缓存，配置 CacheServers 后启用，见 USER.CachedStore
+* 1. GET /user/:id 先读缓存，没有命中时读存储并写入缓存；通过 USER 包的增加，删除，修改都会删除受影响的缓存
+* 2. 请求头 X-Cache-Bypass: true 时不读缓存，直接读存储(并刷新缓存)
+* 3. GET /cache/stats 查询命中，没有命中，跳过，出错和删除的次数
+* gender normalize 等离线命令直接修改数据库，不会删除缓存，执行后修改 CacheKeyVersion 或等待缓存过期
+ */
+package main
+
+import (
+	"serverenter/user"
+	"strconv"
+	"third/gin"
+)
+
+const CACHE_BYPASS_HEADER = "X-Cache-Bypass"
+
+/*
+ *  Description:   获取查询使用的用户存储，请求头 X-Cache-Bypass 为 true 时跳过缓存
+ */
+func (u_mgr *UserManager) readStore(c *gin.Context) USER.UserStore {
+	if u_mgr.cache == nil {
+		return u_mgr.store
+	}
+	if bypass, _ := strconv.ParseBool(c.Request.Header.Get(CACHE_BYPASS_HEADER)); bypass {
+		return u_mgr.cache.Bypass()
+	}
+	return u_mgr.cache
+}
+
+/*
+ *  Description:   注册缓存计数查询, GET /cache/stats
+ */
+func (u_mgr *UserManager) registerCacheStats() {
+	u_mgr.http.GET("/cache/stats", func(c *gin.Context) {
+		if u_mgr.cache == nil {
+			c.JSON(200, gin.H{"enabled": false})
+			return
+		}
+		c.JSON(200, gin.H{"enabled": true, "stats": u_mgr.cache.Stats()})
+	})
+}
@@ -8,14 +8,34 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"serverenter/user"
 )
 
 var DEFAULT_CONF_FILE string = "./user_manager.conf.default"
 
 type GlobalConfig struct {
 	ListenAddr           string
+	StoreType            string //存储类型 mysql(默认) 或 memory
 	MysqlConn            string
 	MysqlConnectPoolSize int
+	MaxAffectedRows      int    //批量更新和删除允许影响的最大行数，0 使用默认值
+	ShutdownTimeout      int    //退出时等待请求完成的最长时间(秒)，0 使用默认值
+	ShutdownGrace        int    //退出时状态查询返回 draining 后到关闭监听之间等待的秒数，用于负载均衡摘除，0 不等待
+	Timezone             string //计算年龄使用的时区，空使用默认值 Asia/Shanghai, 应与 MysqlConn 中的 loc 一致
+
+	Genders    []USER.GenderValue //性别词表，空使用 USER.DefaultGenders
+	GenderLang string             //输出性别本地化名称的默认语言，空表示不输出，请求可以用 lang 参数指定
+
+	DefaultCountryCode string //手机号没有国家码时使用的国家码，空使用默认值 86
+
+	TotalCountThreshold int //列表总数精确统计的最大行数，超过时返回估计值，0 使用默认值，小于0 总是精确统计
+
+	CacheServers    []string //memcache 服务器 host:port，空表示不使用缓存
+	CacheTTL        int      //缓存的秒数，0 使用默认值
+	CacheKeyPrefix  string   //缓存 key 的前缀，多个服务共用 memcache 时区分，空使用默认值
+	CacheKeyVersion int      //缓存 key 的版本，修改后旧的缓存全部失效(例如离线修改了数据库)
+
+	PasswordSetupToken string //设置首次密码需要的令牌，请求头 X-Setup-Token 必须相同，空表示不能通过接口设置首次密码
 }
 
 var g_config *GlobalConfig
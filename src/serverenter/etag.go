@@ -0,0 +1,176 @@
+/*
+* 用户资源的 ETag, 基于用户的版本号实现乐观并发控制
+* 1. GET /user/:id 返回 ETag, 带 If-None-Match 且一致时返回 304
+* 2. PUT/PATCH/DELETE /user/:id 带 If-Match 时，版本不一致返回 412, 版本检查在存储层原子地完成
+*    If-Match 使用强比较(RFC 7232 3.1)，弱 ETag 不匹配任何版本，可以是逗号分隔的多个 ETag
+ */
+package main
+
+import (
+	"errors"
+	"serverenter/user"
+	"strconv"
+	"strings"
+	"third/gin"
+)
+
+var (
+	errBadETag          = errors.New("ETag 格式错误")
+	errIfMatchNotSingle = errors.New("If-Match 只能用于按id操作单个用户")
+)
+
+/*
+ *  Description:   根据用户版本生成 ETag
+ */
+func userETag(usr *USER.User) string {
+	return `"` + strconv.Itoa(usr.Version) + `"`
+}
+
+/*
+ *  Description:   解析 If-Match 请求头，按强比较选出期望的版本号
+ *  Param         :  current 读取用户当前的版本号，If-Match 中有多个可能匹配的 ETag 时用来选出其中一个
+ *  Return        :   version 期望的版本号，0 表示没有 If-Match 或为 *(只要求用户存在)
+ *                    error 格式错误为 errBadETag, 没有任何 ETag 可能匹配时为 USER.ErrVersionMismatch
+ */
+func ifMatchVersion(c *gin.Context, current func() (int, error)) (int, error) {
+	value := strings.TrimSpace(c.Request.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+
+	tags, versions := 0, []int{}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		tags++
+		weak := strings.HasPrefix(tag, "W/")
+		version, err := parseETag(strings.TrimPrefix(tag, "W/"))
+		if err != nil {
+			return 0, err
+		}
+		//弱 ETag 和不是本服务生成的 ETag 不匹配任何版本
+		if !weak && version != 0 {
+			versions = append(versions, version)
+		}
+	}
+	if tags == 0 {
+		return 0, errBadETag
+	}
+
+	switch len(versions) {
+	case 0:
+		return 0, USER.ErrVersionMismatch
+	case 1:
+		return versions[0], nil
+	}
+	//多个版本时选出与当前版本一致的一个，存储层仍然原子地检查该版本
+	version, err := current()
+	if err != nil {
+		return 0, err
+	}
+	for _, expected := range versions {
+		if expected == version {
+			return version, nil
+		}
+	}
+	return 0, USER.ErrVersionMismatch
+}
+
+/*
+ *  Description:   读取用户当前的版本号
+ *   Returns      :   用户不存在时返回 USER.ErrUserNotFound
+ */
+func (u_mgr *UserManager) currentVersion(id int) (int, error) {
+	u_pack := &USER.UserQueryPack{Usr: USER.User{ID: id}, Offset: -1, Limit: -1, IDRange: USER.Range{Low: -1, High: -1}}
+	usr_list := USER.UserList{}
+	if err := usr_list.Fetch(u_mgr.store, u_pack); err != nil {
+		return 0, err
+	}
+	if len(usr_list) == 0 {
+		return 0, USER.ErrUserNotFound
+	}
+	return usr_list[0].Version, nil
+}
+
+/*
+ *  Description:   输出 If-Match 的错误，格式错误返回 400, 不可能匹配返回 412
+ */
+func renderIfMatchError(c *gin.Context, err error) {
+	if err == errBadETag || err == errIfMatchNotSingle {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	renderSingleUserError(c, err)
+}
+
+/*
+ *  Description:   判断 If-None-Match 请求头是否与用户当前的版本一致
+ *  Return        :   true 一致，应该返回 304
+ */
+func ifNoneMatch(c *gin.Context, usr *USER.User) bool {
+	value := strings.TrimSpace(c.Request.Header.Get("If-None-Match"))
+	if value == "" {
+		return false
+	}
+	if value == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(value, ",") {
+		//If-None-Match 使用弱比较
+		if version, err := parseETag(strings.TrimPrefix(strings.TrimSpace(tag), "W/")); err == nil && version == usr.Version {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  Description:   解析单个强 ETag, 本服务生成的格式为 "<version>"
+ *  Return        :   version 版本号，格式合法但不是本服务生成的 ETag(例如 "abc")时为 0， error 不是合法的 ETag
+ */
+func parseETag(tag string) (int, error) {
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, errBadETag
+	}
+	opaque := tag[1 : len(tag)-1]
+	for i := 0; i < len(opaque); i++ {
+		if ch := opaque[i]; ch == '"' || ch <= ' ' || ch == 0x7f {
+			return 0, errBadETag
+		}
+	}
+	version, err := strconv.Atoi(opaque)
+	if err != nil || version <= 0 {
+		return 0, nil
+	}
+	return version, nil
+}
+
+/*
+ *  Description:   输出按ID操作单个用户的错误
+ *  Return        :   true 有错误并且已经输出， false 没有错误
+ */
+func renderSingleUserError(c *gin.Context, err error) bool {
+	if gender_err, ok := err.(*USER.GenderError); ok {
+		c.JSON(400, gin.H{"error": gender_err.Error(), "allowed": gender_err.Allowed})
+		return true
+	}
+	if renderConflict(c, err) {
+		return true
+	}
+
+	switch err {
+	case nil:
+		return false
+	case USER.ErrUserNotFound:
+		c.JSON(404, gin.H{"error": "用户不存在"})
+	case USER.ErrVersionMismatch:
+		c.JSON(412, gin.H{"error": "If-Match 与用户当前版本不一致"})
+	case USER.ErrBadDate:
+		c.JSON(400, gin.H{"error": err.Error()})
+	default:
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+	}
+	return true
+}
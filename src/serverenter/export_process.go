@@ -0,0 +1,205 @@
+/*
+* 导出用户, GET /user/export
+* 1. format=csv|ndjson(默认 ndjson)，过滤条件，排序，offset, limit 和 fields 与 GET /user 相同，不能使用游标
+* 2. 从存储逐行读取直接写到响应中，不把全部用户加载到内存，每 EXPORT_FLUSH_ROWS 行刷新一次
+* 3. 请求带 Accept-Encoding: gzip 时压缩传输，响应带 Content-Encoding: gzip
+* 4. 开始输出后发生错误时中断连接，客户端不会把不完整的文件当成正常结束
+ */
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"serverenter/user"
+	"strings"
+	"third/gin"
+)
+
+//导出时每写多少行刷新一次输出
+const EXPORT_FLUSH_ROWS = 500
+
+/*
+ *  Description:   导出用户, GET /user/export，由 queryUser 分发(与 /user/:id 冲突)
+ */
+func (u_mgr *UserManager) exportUsers(c *gin.Context) {
+	usr_pack, err := u_mgr.getUserPack(c)
+	if err == nil {
+		usr_pack.Fields, err = u_mgr.getFields(c)
+	}
+	if err != nil {
+		c.JSON(400, paramError("status", err))
+		return
+	}
+	if usr_pack.Cursor != nil {
+		c.JSON(400, gin.H{"error": "导出不能使用游标，使用 offset 和 limit"})
+		return
+	}
+	format := c.DefaultQuery("format", FORMAT_NDJSON)
+	if format != FORMAT_CSV && format != FORMAT_NDJSON {
+		c.JSON(400, gin.H{"error": "format 只能是 csv 或 ndjson"})
+		return
+	}
+
+	lang := c.DefaultQuery("lang", u_mgr.gender_lang)
+	exporter := &userExporter{c: c, format: format, fields: usr_pack.Fields, gzip: acceptsGzip(c)}
+	if format == FORMAT_CSV {
+		defs, err := u_mgr.store.FetchDefinitions()
+		if err != nil {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+			return
+		}
+		exporter.columns = usr_pack.Fields.CSVColumns(defs, lang != "")
+	}
+
+	err = u_mgr.store.ExportUsers(usr_pack, func(usr *USER.User) error {
+		if lang != "" && usr.Gender != "" {
+			usr.GenderLabel = u_mgr.genders.Label(usr.Gender, lang)
+		}
+		return exporter.write(usr)
+	})
+	if err == nil {
+		err = exporter.close()
+	}
+	if err == nil {
+		return
+	}
+	if !exporter.started {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	//已经输出了部分数据，只能中断连接
+	log.Printf("导出用户中断: %v", err)
+	panic(http.ErrAbortHandler)
+}
+
+/*
+ *  Description:   请求的 Accept-Encoding 是否接受 gzip
+ */
+func acceptsGzip(c *gin.Context) bool {
+	for _, part := range strings.Split(c.Request.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.Replace(param, " ", "", -1); q == "q=0" || q == "q=0.0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+//把用户逐个写到响应中，第一个用户写入前才输出响应头
+type userExporter struct {
+	c       *gin.Context
+	format  string
+	fields  *USER.FieldSet //选择的字段，nil 表示全部字段
+	columns []string       //CSV 的列名
+	gzip    bool
+
+	started bool //已经输出了响应头
+	out     io.Writer
+	zw      *gzip.Writer
+	cw      *csv.Writer
+	rows    int
+}
+
+/*
+ *  Description:   输出响应头，CSV 同时输出列名
+ */
+func (exporter *userExporter) begin() error {
+	exporter.started = true
+	header := exporter.c.Writer.Header()
+	if exporter.format == FORMAT_CSV {
+		header.Set("Content-Type", "text/csv; charset=utf-8")
+		header.Set("Content-Disposition", `attachment; filename="users.csv"`)
+	} else {
+		header.Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		header.Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+	}
+	header.Add("Vary", "Accept-Encoding")
+
+	exporter.out = exporter.c.Writer
+	if exporter.gzip {
+		header.Set("Content-Encoding", "gzip")
+		exporter.zw = gzip.NewWriter(exporter.c.Writer)
+		exporter.out = exporter.zw
+	}
+	exporter.c.Writer.WriteHeader(http.StatusOK)
+
+	if exporter.format == FORMAT_CSV {
+		exporter.cw = csv.NewWriter(exporter.out)
+		return exporter.cw.Write(exporter.columns)
+	}
+	return nil
+}
+
+func (exporter *userExporter) write(usr *USER.User) error {
+	if !exporter.started {
+		if err := exporter.begin(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	switch {
+	case exporter.cw != nil:
+		err = exporter.cw.Write(USER.CSVRecord(usr, exporter.columns))
+	case exporter.fields != nil:
+		err = json.NewEncoder(exporter.out).Encode(exporter.fields.Project(usr))
+	default:
+		err = json.NewEncoder(exporter.out).Encode(usr)
+	}
+	if err != nil {
+		return err
+	}
+
+	exporter.rows++
+	if exporter.rows%EXPORT_FLUSH_ROWS != 0 {
+		return nil
+	}
+	return exporter.flush()
+}
+
+/*
+ *  Description:   把缓冲的数据发送给客户端
+ */
+func (exporter *userExporter) flush() error {
+	if exporter.cw != nil {
+		exporter.cw.Flush()
+		if err := exporter.cw.Error(); err != nil {
+			return err
+		}
+	}
+	if exporter.zw != nil {
+		if err := exporter.zw.Flush(); err != nil {
+			return err
+		}
+	}
+	exporter.c.Writer.Flush()
+	return nil
+}
+
+/*
+ *  Description:   结束输出，没有用户时也输出响应头(和 CSV 的列名)
+ */
+func (exporter *userExporter) close() error {
+	if !exporter.started {
+		if err := exporter.begin(); err != nil {
+			return err
+		}
+	}
+	if err := exporter.flush(); err != nil {
+		return err
+	}
+	if exporter.zw != nil {
+		return exporter.zw.Close()
+	}
+	return nil
+}
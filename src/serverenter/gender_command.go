@@ -0,0 +1,73 @@
+/*
+* 性别规范化子命令，一次性把数据库中已有的性别改写成配置的词表中的规范值
+* user_manager normalize-gender [--dry-run]   --dry-run 只统计不修改
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"serverenter/user"
+)
+
+const NORMALIZE_GENDER_USAGE = "用法: normalize-gender [--dry-run]"
+
+/*
+ *  Description:   执行性别规范化子命令
+ *  Params       :   args normalize-gender 后面的参数
+ *   Returns      :   进程的退出码，有无法映射的性别时返回1
+ */
+func RunNormalizeGender(args []string) int {
+	dry_run := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "--dry-run":
+		dry_run = true
+	default:
+		fmt.Fprintln(os.Stderr, NORMALIZE_GENDER_USAGE)
+		return 2
+	}
+
+	config, err := GetGlobalConfig()
+	if err == nil {
+		err = config.Init(DEFAULT_CONF_FILE)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "读取配置失败:", err)
+		return 1
+	}
+	if config.StoreType == USER.STORE_TYPE_MEMORY {
+		fmt.Println("内存存储不需要规范化")
+		return 0
+	}
+	genders, err := USER.NewGenderVocabulary(config.Genders)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "性别词表错误:", err)
+		return 1
+	}
+
+	db, err := USER.OpenDB(config.MysqlConn, 1)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "连接数据库失败:", err)
+		return 1
+	}
+	defer db.Close()
+
+	report, err := db.NormalizeGenders(genders, dry_run)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "规范化失败:", err)
+		return 1
+	}
+	for _, miss := range report.Unmapped {
+		fmt.Printf("无法映射  id=%d  gender=%q\n", miss.ID, miss.Gender)
+	}
+	action := "已修改"
+	if dry_run {
+		action = "需要修改"
+	}
+	fmt.Printf("检查 %d 个用户，%s %d 个，无法映射 %d 个\n", report.Total, action, report.Changed, len(report.Unmapped))
+	if len(report.Unmapped) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,240 @@
+/*
+* 用户组的管理
+* 1. 查询全部用户组，监听路径为 GET /group
+* 2. 增加用户组，监听路径为 POST /group                              请求体为 {"name", "description"}，组名唯一
+* 3. 查询，修改，删除单个用户组，监听路径为 GET/PUT/DELETE /group/:id    删除时同时删除组关系
+* 4. 把用户加入组和移出组，监听路径为 POST/DELETE /group/:id/members/:user_id
+* 5. 查询用户所在的组，监听路径为 GET /user/:id/groups
+* 组的成员通过 GET /user?group=<组ID> 查询，可以和其他条件，排序，分页一起使用
+ */
+package main
+
+import (
+	"net/http"
+	"serverenter/user"
+	"strconv"
+	"third/gin"
+)
+
+func (u_mgr *UserManager) registerGroupOperation() {
+	if u_mgr.canWork() {
+		u_mgr.http.GET("/group", func(c *gin.Context) {
+			u_mgr.queryGroups(c)
+		})
+		u_mgr.http.POST("/group", func(c *gin.Context) {
+			u_mgr.addGroup(c)
+		})
+		u_mgr.http.GET("/group/:id", func(c *gin.Context) {
+			u_mgr.queryGroup(c)
+		})
+		u_mgr.http.PUT("/group/:id", func(c *gin.Context) {
+			u_mgr.updateGroup(c)
+		})
+		u_mgr.http.DELETE("/group/:id", func(c *gin.Context) {
+			u_mgr.deleteGroup(c)
+		})
+		u_mgr.http.POST("/group/:id/members/:user_id", func(c *gin.Context) {
+			u_mgr.addMember(c)
+		})
+		u_mgr.http.DELETE("/group/:id/members/:user_id", func(c *gin.Context) {
+			u_mgr.removeMember(c)
+		})
+		u_mgr.http.GET("/user/:id/groups", func(c *gin.Context) {
+			u_mgr.queryUserGroups(c)
+		})
+	}
+}
+
+func (u_mgr *UserManager) queryGroups(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	groups, err := u_mgr.store.FetchGroups()
+	if renderGroupError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": groups})
+}
+
+func (u_mgr *UserManager) queryGroup(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	group, err := u_mgr.store.FetchGroup(id)
+	if renderGroupError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": group})
+}
+
+func (u_mgr *UserManager) addGroup(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	group := &USER.Group{}
+	if !c.Bind(group) {
+		c.JSON(400, gin.H{"error": "请求体格式错误", "detail": c.LastError().Error()})
+		return
+	}
+	group.ID = 0
+	if err := group.Check(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if renderGroupError(c, u_mgr.store.AddGroup(group)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": group})
+}
+
+func (u_mgr *UserManager) updateGroup(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	group := &USER.Group{}
+	if !c.Bind(group) {
+		c.JSON(400, gin.H{"error": "请求体格式错误", "detail": c.LastError().Error()})
+		return
+	}
+	//ID取自路径，组名和描述整体替换
+	group.ID = id
+	if err := group.Check(); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if renderGroupError(c, u_mgr.store.UpdateGroup(group)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": group})
+}
+
+func (u_mgr *UserManager) deleteGroup(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	if renderGroupError(c, u_mgr.store.DeleteGroup(id)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": gin.H{"id": id}})
+}
+
+func (u_mgr *UserManager) addMember(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	group_id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	user_id, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	if renderGroupError(c, u_mgr.store.AddMember(group_id, user_id)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": gin.H{"group_id": group_id, "user_id": user_id}})
+}
+
+func (u_mgr *UserManager) removeMember(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	group_id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	user_id, ok := pathID(c, "user_id")
+	if !ok {
+		return
+	}
+	if renderGroupError(c, u_mgr.store.RemoveMember(group_id, user_id)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": gin.H{"group_id": group_id, "user_id": user_id}})
+}
+
+func (u_mgr *UserManager) queryUserGroups(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, ok := pathID(c, "id")
+	if !ok {
+		return
+	}
+	//软删除的用户保留组关系，但和不存在的用户一样返回 404
+	groups, err := u_mgr.store.FetchUserGroups(id)
+	if renderGroupError(c, err) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": groups})
+}
+
+/*
+ *  Description:   获取路径中的正整数ID，无效时输出 400
+ *  Return        :   int ID， bool false 表示无效并且已经输出
+ */
+func pathID(c *gin.Context, name string) (int, bool) {
+	id, err := strconv.Atoi(c.Param(name))
+	if err != nil || id <= 0 {
+		c.JSON(400, gin.H{"error": "转换" + name + "参数错误......"})
+		return 0, false
+	}
+	return id, true
+}
+
+/*
+ *  Description:   输出操作用户组的错误
+ *  Return        :   true 有错误并且已经输出， false 没有错误
+ */
+func renderGroupError(c *gin.Context, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case USER.ErrGroupNotFound, USER.ErrUserNotFound, USER.ErrNotMember:
+		c.JSON(404, gin.H{"error": err.Error()})
+	case USER.ErrGroupExists:
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+/*
+* 用户修改历史
+* 1. 查询修改历史，监听路径为 GET /user/:id/history           可以带参数 offset, limit(默认20)
+* 2. 恢复到历史版本，监听路径为 POST /user/:id/revert         必须带参数 version, 支持 If-Match
+* 操作人取自请求头 X-Operator, 没有时为 anonymous
+ */
+package main
+
+import (
+	"net/http"
+	"serverenter/user"
+	"strconv"
+	"third/gin"
+)
+
+const (
+	OPERATOR_HEADER       = "X-Operator"
+	ANONYMOUS_OPERATOR    = "anonymous"
+	DEFAULT_HISTORY_LIMIT = 20
+)
+
+/*
+ *  Description:   获取记录修改历史的用户存储，操作人为当前请求的操作人
+ */
+func (u_mgr *UserManager) auditedStore(c *gin.Context) USER.UserStore {
+	return USER.Audited(u_mgr.store, getOperator(c))
+}
+
+/*
+ *  Description:   获取当前请求的操作人
+ */
+func getOperator(c *gin.Context) USER.Operator {
+	operator := c.Request.Header.Get(OPERATOR_HEADER)
+	if operator == "" {
+		operator = ANONYMOUS_OPERATOR
+	}
+	return USER.Operator{Name: operator, ClientIP: c.ClientIP()}
+}
+
+func (u_mgr *UserManager) registerHistoryOperation() {
+	if u_mgr.canWork() {
+		u_mgr.http.GET("/user/:id/history", func(c *gin.Context) {
+			u_mgr.queryHistory(c)
+		})
+		u_mgr.http.POST("/user/:id/revert", func(c *gin.Context) {
+			u_mgr.revertUser(c)
+		})
+	}
+}
+
+func (u_mgr *UserManager) queryHistory(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "转换id参数错误......"})
+		return
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(400, gin.H{"error": "offset 参数错误"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DEFAULT_HISTORY_LIMIT)))
+	if err != nil || limit < 0 {
+		c.JSON(400, gin.H{"error": "limit 参数错误"})
+		return
+	}
+
+	entries, total, err := u_mgr.store.FetchHistory(id, offset, limit)
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": entries, "total": total, "offset": offset, "limit": limit})
+}
+
+func (u_mgr *UserManager) revertUser(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "转换id参数错误......"})
+		return
+	}
+	to_version, err := strconv.Atoi(c.Query("version"))
+	if err != nil || to_version <= 0 {
+		c.JSON(400, gin.H{"error": "version 参数错误"})
+		return
+	}
+	version, err := ifMatchVersion(c, func() (int, error) {
+		return u_mgr.currentVersion(id)
+	})
+	if err != nil {
+		renderIfMatchError(c, err)
+		return
+	}
+
+	usr := &USER.User{ID: id}
+	if renderSingleUserError(c, usr.Revert(u_mgr.auditedStore(c), to_version, version, u_mgr.genders)) {
+		return
+	}
+	c.Writer.Header().Set("ETag", userETag(usr))
+	c.JSON(http.StatusOK, gin.H{"object": usr})
+}
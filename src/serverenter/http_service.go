@@ -4,14 +4,47 @@
 package main
 
 import (
+	"context"
+	"net/http"
 	"third/gin"
 )
 
 type HttpServer struct {
 	*gin.Engine //http网络通信
+
+	server *http.Server
 }
 
 func CreateHTTPServer() (*HttpServer, error) {
 	roter := gin.New()
-	return &HttpServer{roter}, nil
+	return &HttpServer{Engine: roter}, nil
+}
+
+/*
+ *  Description:   在后台开始监听服务
+ *  Params       :   addr 监听地址
+ *   Returns      :   服务异常退出时，错误会写入返回的通道，正常关闭时通道被关闭
+ */
+func (srv *HttpServer) Start(addr string) <-chan error {
+	srv.server = &http.Server{Addr: addr, Handler: srv.Engine}
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		if err := srv.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errs <- err
+		}
+	}()
+	return errs
+}
+
+/*
+ *  Description:   关闭监听，等待正在处理的请求完成
+ *  Params       :   ctx 控制最长等待时间
+ *   Returns      :   全部请求完成返回nil, 超时返回ctx的错误
+ */
+func (srv *HttpServer) Shutdown(ctx context.Context) error {
+	if srv.server == nil {
+		return nil
+	}
+	return srv.server.Shutdown(ctx)
 }
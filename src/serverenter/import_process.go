@@ -0,0 +1,470 @@
+/*
+* 批量导入用户, POST /user/import
+* 1. 请求体为 CSV(第一行为列名) 或 NDJSON(每行一个 json 用户)，format=csv|ndjson，默认按 Content-Type 判断
+*    CSV 的列名默认与字段同名: name, gender, birthday, email, phone, attr.<属性名>
+*    map.<列名>=<字段> 把列映射到字段，字段为 - 时忽略该列
+* 2. 边读取边校验，每 batch_size 行写入一批，校验规则与增加用户相同
+* 3. mode=atomic(默认) 任何一行无效或写入失败时全部回滚，返回 422; mode=skip 跳过失败的行，写入其他行
+* 4. upsert=email|phone 按该字段更新已有用户(只更新非空字段)，找不到时新增，不带时只新增
+* 5. 响应为导入报告：总行数，新增，更新，失败的行数，是否提交，失败的行的行号和原因
+*    CSV 的行号为文件中的行号(列名为第1行)，NDJSON 的行号为文件中的行号
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"serverenter/user"
+	"strconv"
+	"strings"
+	"third/gin"
+)
+
+//导入和导出的格式
+const (
+	FORMAT_CSV    = "csv"
+	FORMAT_NDJSON = "ndjson"
+)
+
+//导入模式
+const (
+	IMPORT_MODE_ATOMIC = "atomic" //全部成功或全部回滚
+	IMPORT_MODE_SKIP   = "skip"   //跳过失败的行
+)
+
+const (
+	DEFAULT_IMPORT_BATCH_SIZE = 500     //默认每批写入的行数
+	MAX_IMPORT_BATCH_SIZE     = 5000    //每批写入的最大行数
+	MAX_IMPORT_ERRORS         = 1000    //报告中最多列出的失败行数
+	MAX_NDJSON_LINE           = 1 << 20 //NDJSON 单行的最大长度
+)
+
+//CSV 列名映射的参数前缀
+const IMPORT_MAP_PARAM_PREFIX = "map."
+
+//CSV 的列可以映射的用户字段，另外可以是 attr.<属性名>
+var import_fields = []string{"name", "gender", "birthday", "email", "phone"}
+
+//导入失败的一行
+type importError struct {
+	Row       int                  `json:"row"`
+	Error     string               `json:"error"`
+	Allowed   []string             `json:"allowed,omitempty"`
+	Attribute *USER.AttributeError `json:"attribute,omitempty"`
+	Conflict  *USER.ConflictError  `json:"conflict,omitempty"`
+}
+
+//导入报告
+type importReport struct {
+	Total     int           `json:"total"`     //读取的行数
+	Created   int           `json:"created"`   //新增的用户数
+	Updated   int           `json:"updated"`   //更新的用户数
+	Failed    int           `json:"failed"`    //失败的行数
+	Committed bool          `json:"committed"` //写入的行是否已经保存
+	Truncated bool          `json:"truncated"` //errors 只列出了部分失败的行
+	Errors    []importError `json:"errors"`
+}
+
+/*
+ *  Description:   记录失败的行，超过 MAX_IMPORT_ERRORS 时只计数
+ */
+func (report *importReport) fail(row int, err error) {
+	report.Failed++
+	if len(report.Errors) >= MAX_IMPORT_ERRORS {
+		report.Truncated = true
+		return
+	}
+
+	item := importError{Row: row, Error: err.Error()}
+	switch detail := err.(type) {
+	case *USER.GenderError:
+		item.Allowed = detail.Allowed
+	case *USER.AttributeError:
+		item.Attribute = detail
+	case *USER.ConflictError:
+		item.Conflict = detail
+	}
+	report.Errors = append(report.Errors, item)
+}
+
+//导入的参数
+type importOptions struct {
+	format     string
+	atomic     bool
+	upsert     string
+	batch_size int
+}
+
+//读取的一行无效，可以继续读取下一行
+type importRowError struct {
+	err error
+}
+
+func (row_err *importRowError) Error() string {
+	return row_err.err.Error()
+}
+
+//逐行读取导入的用户
+type importReader interface {
+	//读取下一行到 usr, 返回行号，没有更多的行时返回 io.EOF, 行无效时返回 *importRowError
+	next(usr *USER.User) (int, error)
+}
+
+/*
+ *  Description:   批量导入用户, POST /user/import，由 addUser 分发(与 /user/:id 冲突)
+ */
+func (u_mgr *UserManager) importUsers(c *gin.Context) {
+	options, err := getImportOptions(c)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if options.format == "" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "不支持的导入格式，Content-Type 应为 text/csv 或 application/x-ndjson, 或者带 format=csv|ndjson"})
+		return
+	}
+
+	defs, err := u_mgr.store.FetchDefinitions()
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+
+	var reader importReader
+	if options.format == FORMAT_CSV {
+		reader, err = newCSVImportReader(c, defs)
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error(), "allowed": append(import_fields, "attr.<属性名>", "-")})
+			return
+		}
+	} else {
+		reader = newNDJSONImportReader(c)
+	}
+
+	importer, err := u_mgr.auditedStore(c).BeginImport(options.upsert, options.atomic)
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+
+	report := &importReport{Errors: []importError{}}
+	batch := USER.UserList{}
+	rows := []int{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		results, err := importer.Write(batch)
+		if err != nil {
+			return err
+		}
+		for i, result := range results {
+			switch {
+			case result.Err != nil:
+				report.fail(rows[i], result.Err)
+			case result.Before == nil:
+				report.Created++
+			default:
+				report.Updated++
+			}
+		}
+		batch, rows = batch[:0], rows[:0]
+		return nil
+	}
+
+	for {
+		usr := USER.User{}
+		row, err := reader.next(&usr)
+		if err == io.EOF {
+			break
+		}
+		if row_err, ok := err.(*importRowError); ok {
+			report.Total++
+			report.fail(row, row_err.err)
+			continue
+		}
+		if err != nil {
+			//请求体无法继续读取，已经提交的批次不能撤销
+			importer.Rollback()
+			report.Committed = !options.atomic && report.Created+report.Updated != 0
+			c.JSON(400, gin.H{"error": err.Error(), "report": report})
+			return
+		}
+
+		report.Total++
+		if err := u_mgr.normalizeRecord(&usr, defs); err != nil {
+			report.fail(row, err)
+			continue
+		}
+		//atomic 时已经有失败的行，剩下的行只校验不写入
+		if options.atomic && report.Failed != 0 {
+			continue
+		}
+
+		batch = append(batch, usr)
+		rows = append(rows, row)
+		if len(batch) < options.batch_size {
+			continue
+		}
+		if err := flush(); err != nil {
+			importer.Rollback()
+			report.Committed = !options.atomic && report.Created+report.Updated != 0
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误", "report": report})
+			return
+		}
+	}
+	if !options.atomic || report.Failed == 0 {
+		err = flush()
+	}
+	if err != nil {
+		importer.Rollback()
+		report.Committed = !options.atomic && report.Created+report.Updated != 0
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误", "report": report})
+		return
+	}
+
+	if options.atomic && report.Failed != 0 {
+		if err := importer.Rollback(); err != nil {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误", "report": report})
+			return
+		}
+		report.Created, report.Updated = 0, 0
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "有无效的行，没有导入任何用户", "report": report})
+		return
+	}
+	if err := importer.Commit(); err != nil {
+		if err == USER.ErrTxConflict {
+			report.Created, report.Updated = 0, 0
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "report": report})
+			return
+		}
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误", "report": report})
+		return
+	}
+	report.Committed = true
+	c.JSON(http.StatusOK, gin.H{"report": report})
+}
+
+/*
+ *  Description:   获取导入的参数 format, mode, upsert, batch_size
+ *  Return        :   importOptions 导入的参数，format 为空表示不支持的格式， error 参数错误
+ */
+func getImportOptions(c *gin.Context) (importOptions, error) {
+	options := importOptions{batch_size: DEFAULT_IMPORT_BATCH_SIZE}
+
+	format := c.Query("format")
+	if format == "" {
+		content_type := strings.TrimSpace(strings.SplitN(c.Request.Header.Get("Content-Type"), ";", 2)[0])
+		switch strings.ToLower(content_type) {
+		case "text/csv", "application/csv":
+			format = FORMAT_CSV
+		case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+			format = FORMAT_NDJSON
+		}
+	}
+	switch format {
+	case "", FORMAT_CSV, FORMAT_NDJSON:
+		options.format = format
+	default:
+		return options, errors.New("format 只能是 csv 或 ndjson")
+	}
+
+	switch c.DefaultQuery("mode", IMPORT_MODE_ATOMIC) {
+	case IMPORT_MODE_ATOMIC:
+		options.atomic = true
+	case IMPORT_MODE_SKIP:
+	default:
+		return options, errors.New("mode 只能是 atomic 或 skip")
+	}
+
+	switch upsert := c.Query("upsert"); upsert {
+	case "", USER.UPSERT_EMAIL, USER.UPSERT_PHONE:
+		options.upsert = upsert
+	default:
+		return options, errors.New("upsert 只能是 email 或 phone")
+	}
+
+	if size := c.Query("batch_size"); size != "" {
+		var err error
+		options.batch_size, err = strconv.Atoi(size)
+		if err != nil || options.batch_size <= 0 || options.batch_size > MAX_IMPORT_BATCH_SIZE {
+			return options, fmt.Errorf("batch_size 应为 1 到 %d 之间的整数", MAX_IMPORT_BATCH_SIZE)
+		}
+	}
+	return options, nil
+}
+
+/*
+ *  Description:   校验请求体中的一个用户(导入的一行或批量操作中的用户)并规范化字段，规则与增加用户相同
+ *                 ID 由存储分配或由调用方设置
+ */
+func (u_mgr *UserManager) normalizeRecord(usr *USER.User, defs USER.AttributeDefinitions) error {
+	usr.ID = 0
+	if len(usr.Attributes) == 0 {
+		usr.Attributes = nil
+	} else {
+		attrs, err := defs.Normalize(usr.Attributes)
+		if err != nil {
+			return err
+		}
+		usr.Attributes = attrs
+	}
+	return u_mgr.normalizeUser(usr)
+}
+
+//按列名映射读取 CSV
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns []string //每一列对应的字段，- 表示忽略
+}
+
+/*
+ *  Description:   读取 CSV 的列名，按 map.<列名>=<字段> 映射到字段
+ *  Param         :  c *gin.Context http服务, defs 属性定义，用于校验 attr.<属性名>
+ *  Return        :   *csvImportReader 读取器， error 列名无效或没有对应的字段
+ */
+func newCSVImportReader(c *gin.Context, defs USER.AttributeDefinitions) (*csvImportReader, error) {
+	reader := csv.NewReader(c.Request.Body)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV 没有列名")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make(map[string]string)
+	for key, values := range c.Request.URL.Query() {
+		if strings.HasPrefix(key, IMPORT_MAP_PARAM_PREFIX) && len(values) != 0 {
+			mapping[strings.TrimPrefix(key, IMPORT_MAP_PARAM_PREFIX)] = strings.TrimSpace(values[0])
+		}
+	}
+
+	columns := make([]string, len(header))
+	mapped := make(map[string]string)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff")
+		}
+		field, ok := mapping[name]
+		if ok {
+			delete(mapping, name)
+		} else {
+			field = strings.ToLower(name)
+		}
+
+		if field != "-" && !isImportField(field, defs) {
+			return nil, fmt.Errorf("列 %q 没有对应的字段 %q，使用 map.<列名>=<字段> 映射或者 map.<列名>=- 忽略", name, field)
+		}
+		if column, ok := mapped[field]; ok && field != "-" {
+			return nil, fmt.Errorf("列 %q 和 %q 映射到同一个字段 %q", column, name, field)
+		}
+		mapped[field] = name
+		columns[i] = field
+	}
+	for name := range mapping {
+		return nil, fmt.Errorf("映射的列 %q 不在 CSV 的列名中", name)
+	}
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+/*
+ *  Description:   判断 CSV 的列是否可以映射到字段
+ */
+func isImportField(field string, defs USER.AttributeDefinitions) bool {
+	if strings.HasPrefix(field, ATTRIBUTE_PARAM_PREFIX) {
+		return defs.Find(strings.TrimPrefix(field, ATTRIBUTE_PARAM_PREFIX)) != nil
+	}
+	for _, name := range import_fields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (reader *csvImportReader) next(usr *USER.User) (int, error) {
+	record, err := reader.reader.Read()
+	if parse_err, ok := err.(*csv.ParseError); ok {
+		return parse_err.StartLine, &importRowError{err: parse_err}
+	}
+	if err != nil {
+		return 0, err
+	}
+	row, _ := reader.reader.FieldPos(0)
+
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		switch field := reader.columns[i]; field {
+		case "-":
+		case "name":
+			usr.Name = value
+		case "gender":
+			usr.Gender = value
+		case "birthday":
+			usr.Birthday = USER.Date(value)
+		case "email":
+			usr.Email = USER.NullString(value)
+		case "phone":
+			usr.Phone = USER.NullString(value)
+		default:
+			if usr.Attributes == nil {
+				usr.Attributes = USER.Attributes{}
+			}
+			usr.Attributes[strings.TrimPrefix(field, ATTRIBUTE_PARAM_PREFIX)] = value
+		}
+	}
+	return row, nil
+}
+
+//逐行读取 NDJSON，空行忽略
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONImportReader(c *gin.Context) *ndjsonImportReader {
+	scanner := bufio.NewScanner(c.Request.Body)
+	scanner.Buffer(make([]byte, 64*1024), MAX_NDJSON_LINE)
+	return &ndjsonImportReader{scanner: scanner}
+}
+
+func (reader *ndjsonImportReader) next(usr *USER.User) (int, error) {
+	for reader.scanner.Scan() {
+		reader.line++
+		line := strings.TrimSpace(reader.scanner.Text())
+		if reader.line == 1 {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" {
+			continue
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(usr); err != nil {
+			return reader.line, &importRowError{err: fmt.Errorf("json 无效: %v", err)}
+		}
+		if decoder.More() {
+			return reader.line, &importRowError{err: errors.New("一行只能有一个 json 对象")}
+		}
+		return reader.line, nil
+	}
+
+	if err := reader.scanner.Err(); err == bufio.ErrTooLong {
+		return reader.line + 1, fmt.Errorf("第 %d 行超过 %d 字节", reader.line+1, MAX_NDJSON_LINE)
+	} else if err != nil {
+		return reader.line, err
+	}
+	return reader.line, io.EOF
+}
@@ -1,53 +1,110 @@
 /*
 * Description 逻辑处理对象，提供服务器的主要逻辑
-* 1. 增加用户，监听路径为 POST /user 和 POST /user/:id          可以带参数 id,name, gender, birthday
-* 2. 删除用户，监听路径为 DELETE /user 和 DELETE /user/:id   可以带参数 id, name, gender, birthday, low, high
-* 3. 更新用户，监听路径为 PUT /user 和 PUT /user/:id               可以带参数 id, name, gender, birthday, low, high
-* 4. 查询用户， 监听路径为 GET /user 和 GET /user/:id              可以带参数 id, limit, low, high, name, gender, birthday, offset, order
+* 1. 增加用户，监听路径为 POST /user 和 POST /user/:id          可以带参数 id,name, gender, birthday, email, phone
+* 2. 删除用户，监听路径为 DELETE /user 和 DELETE /user/:id   可以带参数 id, name, gender, birthday, email, phone, low, high
+* 3. 更新用户，监听路径为 PUT /user 和 PUT /user/:id               可以带参数 id, name, gender, birthday, email, phone, low, high
+* 4. 查询用户， 监听路径为 GET /user 和 GET /user/:id              可以带参数 id, limit, low, high, name, gender, birthday, email, phone, offset, order, sort
+*    sort=-birthday,name 按多个字段排序，- 表示降序，最后自动按 id 排序，见 USER.ParseSort; order=1/-1 等同于 sort=id/-id
+*    fields=id,name 只返回部分字段(包括 attr.<属性名>)，见 USER.ParseFields
+*    其中 PATCH /user 和 PATCH /user/:id 与 PUT 相同
+*    不是按id操作单个用户的删除和更新属于批量操作，必须带 confirm=<预期影响行数>，见 USER.BulkGuard
+*    删除和更新带 dry_run=true 时只返回会影响的行和字段修改前后的值，不做任何修改
+* 5. 删除为软删除，GET /user/trash 查询回收站，POST /user/:id/restore 恢复，DELETE /user/:id?purge=true 彻底删除
+* 6. 按id操作单个用户支持 ETag/If-Match/If-None-Match，见 etag.go
+* 7. 所有的增加，删除，更新都会记录修改历史，见 history_process.go
+* 8. birthday 统一为 YYYY-MM-DD(兼容 1990/1/2, 90-01-02 等写法)，不能晚于今天
+*    查询可以带 born_after, born_before(不包括当天), min_age, max_age, 年龄按配置的 Timezone 计算
+* 9. gender 的别名映射成配置的词表中的规范值，无效时返回 400 和允许的值
+*    查询带 lang=<语言> 时输出 GenderLabel(性别的本地化名称)，默认语言为配置的 GenderLang
+* 10. email 统一为小写，phone 统一为 E.164 格式(没有国家码时使用配置的 DefaultCountryCode)
+*     两者在全部用户中唯一，重复时返回 409 和已有用户的ID，批量更新不能修改 email 和 phone
+* 11. 自定义属性通过请求体的 Attributes 或查询参数 attr.<属性名> 设置，查询时作为过滤条件，见 attribute_process.go
+* 12. 查询可以带 filter=<表达式>，例如 name ~ "张%" and (gender = "F" or birthday >= 1990-01-01)
+*     语法见 USER.ParseFilter，语法错误时返回 400 和出错的位置
+* 13. 查询带 limit 时可以按游标翻页：响应中的 next_cursor, prev_cursor 分别作为 after=<游标>, before=<游标> 获取下一页和上一页
+*     游标与排序绑定，不能和 offset 一起使用；带 offset 时仍按偏移分页，不返回游标
+*     列表响应带总数和翻页链接，count=exact/false 精确统计/不统计总数，见 page_process.go
+* 14. POST /user/import 批量导入 CSV 或 NDJSON，支持 atomic/skip 模式和按 email/phone upsert，返回逐行的错误报告，见 import_process.go
+* 15. GET /user/export?format=csv|ndjson 按 GET /user 的条件流式导出，支持 gzip 传输，见 export_process.go
+* 16. POST /batch 按顺序执行一批增加，更新，删除，查询操作，可以在一个事务中全部成功或全部回滚，见 batch_process.go
+* 17. 配置了 CacheServers 时 GET /user/:id 先读 memcache，请求头 X-Cache-Bypass: true 跳过缓存，见 cache_process.go
+* 18. 用户组的增删查改和组成员的管理见 group_process.go，查询可以带 group=<组ID> 只返回该组的成员
+* 19. POST /user/:id/password 设置或修改密码，POST /auth/login 按 id, email 或 phone 和密码登录，见 auth_process.go
+*
+* 用户字段(id, name, gender, birthday, email, phone)的取值优先级：
+* 1. 路径中的 :id 优先级最高，覆盖请求体和查询参数中的id
+* 2. POST/PUT/PATCH 的请求体，按 Content-Type 绑定 json, xml, x-www-form-urlencoded, multipart/form-data
+* 3. 查询参数，只在请求体中没有该字段(空值)时作为后备
  */
 package main
 
 import (
+	"context"
 	"errors"
+	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"runtime"
 	"serverenter/user"
 	"strconv"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"third/gin"
-	"third/gorm"
+	"third/gomemcache/memcache"
+	"time"
 )
 
+//服务状态
+const (
+	SRV_STATE_SERVING  int32 = iota //正常服务
+	SRV_STATE_DRAINING              //退出中，状态查询返回 draining, 仍然处理请求，等待负载均衡摘除
+	SRV_STATE_STOPPING              //关闭中，不再接受新的请求，等待已有请求完成
+)
+
+//默认等待请求完成的最长时间(秒)
+const DEFAULT_SHUTDOWN_TIMEOUT = 30
+
+//默认计算年龄使用的时区
+const DEFAULT_TIMEZONE = "Asia/Shanghai"
+
 /*
- *  Description:    创建数据库连接池
- *   Returns      :   *DB 连接池指针，　error nil表示成功　非nil表示失败
+ *  Description:    根据全局配置创建用户存储
+ *   Returns      :   UserStore 用户存储，　error nil表示成功　非nil表示失败
  */
-func CreateDB() (*USER.DB, error) {
+func CreateStore() (USER.UserStore, error) {
 	config, err := GetGlobalConfig()
 	if err != nil {
 		return nil, err
 	}
-	db, err := gorm.Open("mysql", config.MysqlConn)
-	if err == nil {
-		//同步表结构
-		db.AutoMigrate(&USER.User{})
-		db.DB().SetMaxOpenConns(config.MysqlConnectPoolSize)
-		db.DB().SetMaxIdleConns(config.MysqlConnectPoolSize >> 1)
-		return &USER.DB{&db}, nil
-	}
-
-	return nil, err
+	return USER.CreateUserStore(config.StoreType, config.MysqlConn, config.MysqlConnectPoolSize)
 }
 
 type UserManager struct {
-	http *HttpServer
-	db   USER.DB
+	http  *HttpServer
+	store USER.UserStore
+	cache *USER.CachedStore //带缓存的存储，与 store 相同，没有配置缓存时为 nil
+	guard *USER.BulkGuard   //批量更新和删除的安全检查
+	loc   *time.Location    //计算年龄和校验生日使用的时区
+
+	genders      *USER.GenderVocabulary //性别词表
+	gender_lang  string                 //输出性别本地化名称的默认语言
+	country_code string                 //手机号的默认国家码
+
+	count_threshold int //列表总数精确统计的最大行数，0 表示总是精确统计
+
+	setup_token string //设置首次密码需要的令牌，空表示不允许
 
 	//用于退出服务时，使用的变量
-	srv_flag bool  //服务标识，true 表示正常服务， false 表示不进行服务
-	srv_num  int32 //标识服务器服务的数量 用于退出服务时使用
+	srv_state int32         //服务状态 SRV_STATE_SERVING, SRV_STATE_DRAINING 或 SRV_STATE_STOPPING, 原子访问
+	srv_errs  <-chan error  //http服务异常退出的错误
+	closers   []namedCloser //退出时需要释放的资源，按注册的逆序关闭
+}
+
+//退出时需要释放的资源
+type namedCloser struct {
+	name  string
+	close func() error
 }
 
 /*
@@ -71,14 +128,42 @@ func (u_mgr *UserManager) Init() error {
 		return err
 	}
 
-	//3. 初始化db操作
-	tmp_db, err := CreateDB()
+	//3. 初始化用户存储
+	u_mgr.store, err = CreateStore()
 	if err != nil {
 		return err
 	}
-	u_mgr.db = *tmp_db
-	u_mgr.srv_flag = true
-	u_mgr.srv_num = 0
+	u_mgr.addCloser("user store", u_mgr.store.Close)
+	if len(config.CacheServers) != 0 {
+		u_mgr.cache = USER.WithCache(u_mgr.store, memcache.New(config.CacheServers...), USER.CacheOptions{
+			TTL:     config.CacheTTL,
+			Prefix:  config.CacheKeyPrefix,
+			Version: config.CacheKeyVersion,
+		})
+		u_mgr.store = u_mgr.cache
+	}
+	u_mgr.guard = USER.NewBulkGuard(config.MaxAffectedRows)
+	if config.Timezone == "" {
+		config.Timezone = DEFAULT_TIMEZONE
+	}
+	u_mgr.loc, err = time.LoadLocation(config.Timezone)
+	if err != nil {
+		return err
+	}
+	u_mgr.genders, err = USER.NewGenderVocabulary(config.Genders)
+	if err != nil {
+		return err
+	}
+	u_mgr.gender_lang = config.GenderLang
+	u_mgr.country_code = config.DefaultCountryCode
+	u_mgr.setup_token = config.PasswordSetupToken
+	switch {
+	case config.TotalCountThreshold == 0:
+		u_mgr.count_threshold = DEFAULT_TOTAL_COUNT_THRESHOLD
+	case config.TotalCountThreshold > 0:
+		u_mgr.count_threshold = config.TotalCountThreshold
+	}
+	atomic.StoreInt32(&u_mgr.srv_state, SRV_STATE_SERVING)
 	return nil
 }
 
@@ -95,43 +180,126 @@ func (u_mgr *UserManager) Start() error {
 	u_mgr.registerUpdateUserOperation()
 	//注册查询用户的操作
 	u_mgr.registerQueryUserOperation()
+	//注册服务状态查询
+	u_mgr.registerReadiness()
+	//注册修改历史的操作
+	u_mgr.registerHistoryOperation()
+	//注册自定义属性定义的操作
+	u_mgr.registerAttributeOperation()
+	//注册批量操作
+	u_mgr.registerBatchOperation()
+	//注册用户组的操作
+	u_mgr.registerGroupOperation()
+	//注册密码和登录的操作
+	u_mgr.registerAuthOperation()
+	//注册缓存计数查询
+	u_mgr.registerCacheStats()
 	config, err := GetGlobalConfig()
 	if err != nil {
 		return err
 	}
-	go u_mgr.http.Run(config.ListenAddr)
+	u_mgr.srv_errs = u_mgr.http.Start(config.ListenAddr)
 	return nil
 }
 
 /*
  *  Description:   等待信号，实现服务器的优雅退出
+ *   Returns      :   进程的退出码，等待请求完成超时或服务异常退出时非0
  */
-func (u_mgr *UserManager) HandleSignals() {
+func (u_mgr *UserManager) HandleSignals() int {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
-	<-c
-	u_mgr.exitFunc()
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(c)
+
+	select {
+	case sig := <-c:
+		log.Printf("收到信号 %v, 开始退出", sig)
+	case err := <-u_mgr.srv_errs:
+		log.Printf("http服务异常退出: %v", err)
+		u_mgr.exitFunc(false)
+		return 1
+	}
+	return u_mgr.exitFunc(true)
 }
 
-func (u_mgr *UserManager) exitFunc() {
-	//服务器标识设置成false 终止服务
-	u_mgr.srv_flag = false
+/*
+ *  Description:   按顺序退出：标记为退出中 -> 等待负载均衡摘除 -> 关闭监听并等待请求完成 -> 逆序释放资源
+ *  Param         :  grace 是否等待 ShutdownGrace, http服务已经异常退出时不需要等待
+ *   Returns      :   进程的退出码，0 正常退出，1 等待请求完成超时或释放资源失败
+ */
+func (u_mgr *UserManager) exitFunc(grace bool) int {
+	//服务状态设置成退出中，状态查询返回 draining, 负载均衡发现后不再转发新的请求
+	atomic.StoreInt32(&u_mgr.srv_state, SRV_STATE_DRAINING)
 
-	//轮询是否还有服务
-	for {
-		if atomic.LoadInt32(&u_mgr.srv_num) == 0 {
-			//没有服务了 杀死本进程
-			os.Exit(0)
-		} else {
-			//还有服务没有完成， 让出时间片
-			runtime.Gosched()
+	timeout := DEFAULT_SHUTDOWN_TIMEOUT
+	config, err := GetGlobalConfig()
+	if err == nil && config.ShutdownTimeout > 0 {
+		timeout = config.ShutdownTimeout
+	}
+	if err == nil && grace && config.ShutdownGrace > 0 {
+		log.Printf("等待 %ds 后关闭监听", config.ShutdownGrace)
+		time.Sleep(time.Duration(config.ShutdownGrace) * time.Second)
+	}
+
+	//不再接受新的请求
+	atomic.StoreInt32(&u_mgr.srv_state, SRV_STATE_STOPPING)
+
+	code := 0
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	if err := u_mgr.http.Shutdown(ctx); err != nil {
+		log.Printf("等待请求完成超时(%ds): %v", timeout, err)
+		code = 1
+	}
+
+	for i := len(u_mgr.closers) - 1; i >= 0; i-- {
+		closer := u_mgr.closers[i]
+		if err := closer.close(); err != nil {
+			log.Printf("关闭 %s 失败: %v", closer.name, err)
+			code = 1
 		}
 	}
+	return code
+}
+
+/*
+ *  Description:   注册退出时需要释放的资源，退出时按注册的逆序关闭
+ */
+func (u_mgr *UserManager) addCloser(name string, close func() error) {
+	u_mgr.closers = append(u_mgr.closers, namedCloser{name: name, close: close})
+}
+
+/*
+ *  Description:   注册服务状态查询, GET /ready 正常服务返回200 ready, 退出中返回503 draining
+ */
+func (u_mgr *UserManager) registerReadiness() {
+	u_mgr.http.GET("/ready", func(c *gin.Context) {
+		if atomic.LoadInt32(&u_mgr.srv_state) != SRV_STATE_SERVING {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
 }
 
 func (u_mgr *UserManager) registerUpdateUserOperation() {
 	u_mgr.registerUpdateUserByID()
 	u_mgr.registerUpdateUser()
+	u_mgr.registerPatchUser()
+}
+
+/*
+ *  Description:   更新用户通过指定的用户ID, /user/:id 和 /user, PATCH 与 PUT 语义相同
+ */
+func (u_mgr *UserManager) registerPatchUser() {
+	if u_mgr.canWork() {
+		u_mgr.http.PATCH("/user/:id", func(c *gin.Context) {
+			u_mgr.updateUser(c)
+		})
+		u_mgr.http.PATCH("/user", func(c *gin.Context) {
+			u_mgr.updateUser(c)
+		})
+	}
 }
 
 func (u_mgr *UserManager) updateUser(c *gin.Context) {
@@ -140,18 +308,12 @@ func (u_mgr *UserManager) updateUser(c *gin.Context) {
 		c.JSON(406, gin.H{"status": "服务器关闭中......"})
 		return
 	}
-	//增加服务器的服务数量
-	atomic.AddInt32(&u_mgr.srv_num, int32(1))
-	defer func() {
-		atomic.AddInt32(&u_mgr.srv_num, int32(-1))
-	}()
-
 	id_str := c.Param("id")
 	var err error
 	var usr_pack *USER.UserQueryPack
 	if id_str != "" {
-		id, err := strconv.Atoi(c.Param("id"))
-		if err != nil {
+		id, conv_err := strconv.Atoi(c.Param("id"))
+		if conv_err != nil {
 			c.JSON(400, gin.H{"error": "转换id参数错误......"})
 			return
 		}
@@ -161,12 +323,53 @@ func (u_mgr *UserManager) updateUser(c *gin.Context) {
 	}
 
 	if err != nil {
-		c.JSON(400, gin.H{"error": "获取用户包时,参数错误"})
+		c.JSON(400, paramError("error", err))
+		return
+	}
+
+	//更新只支持ID和ID范围作为条件
+	if hasQueryOnlyConditions(usr_pack) {
+		c.JSON(400, gin.H{"error": "生日范围，filter，group 和游标只能用于查询"})
+		return
+	}
+
+	//唯一字段不能批量修改成同一个值
+	if !isSingleUser(usr_pack) && (usr_pack.Usr.Email != "" || usr_pack.Usr.Phone != "") {
+		c.JSON(400, gin.H{"error": "email 和 phone 只能按id修改单个用户"})
+		return
+	}
+
+	if isDryRun(c) {
+		result, err := (&usr_pack.Usr).PreviewUpdate(u_mgr.store, usr_pack.IDRange.Low, usr_pack.IDRange.High, u_mgr.guard.MaxAffectedRows)
+		u_mgr.renderDryRun(c, result, err, USER.User{ID: usr_pack.Usr.ID}, usr_pack.IDRange)
+		return
+	}
+
+	version, err := u_mgr.getIfMatch(c, usr_pack)
+	if err != nil {
+		renderIfMatchError(c, err)
+		return
+	}
+
+	//按ID更新单个用户，返回更新后的数据和新的 ETag
+	if isSingleUser(usr_pack) {
+		usr := usr_pack.Usr
+		if renderSingleUserError(c, usr.UpdateOne(u_mgr.auditedStore(c), version)) {
+			return
+		}
+		c.Writer.Header().Set("ETag", userETag(&usr))
+		c.JSON(http.StatusOK, gin.H{"object": usr})
 		return
 	}
 
-	if (&usr_pack.Usr).Update(u_mgr.db, usr_pack.IDRange.Low, usr_pack.IDRange.High) != nil {
-		c.JSON(405, gin.H{"error": "操作数据库时发生错误"})
+	if !u_mgr.checkBulk(c, USER.User{ID: usr_pack.Usr.ID}, usr_pack.IDRange) {
+		return
+	}
+
+	if err := (&usr_pack.Usr).Update(u_mgr.auditedStore(c), usr_pack.IDRange.Low, usr_pack.IDRange.High); err != nil {
+		if !renderConflict(c, err) {
+			c.JSON(405, gin.H{"error": "操作数据库时发生错误"})
+		}
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"object": usr_pack.Usr})
@@ -206,18 +409,12 @@ func (u_mgr *UserManager) deleteUser(c *gin.Context) {
 		return
 	}
 
-	//增加服务器的服务数量
-	atomic.AddInt32(&u_mgr.srv_num, int32(1))
-	defer func() {
-		atomic.AddInt32(&u_mgr.srv_num, int32(-1))
-	}()
-
 	var err error
 	var usr_pack *USER.UserQueryPack
 	id_str := c.Param("id")
 	if id_str != "" {
-		id, err := strconv.Atoi(c.Param("id"))
-		if err != nil {
+		id, conv_err := strconv.Atoi(c.Param("id"))
+		if conv_err != nil {
 			c.JSON(400, gin.H{"error": "转换id参数错误......"})
 			return
 		}
@@ -227,11 +424,75 @@ func (u_mgr *UserManager) deleteUser(c *gin.Context) {
 	}
 
 	if err != nil {
-		c.JSON(400, gin.H{"status": "获取用户包时,参数错误"})
+		c.JSON(400, paramError("status", err))
 		return
 	}
-	if (&usr_pack.Usr).Delete(u_mgr.db, usr_pack.IDRange.Low, usr_pack.IDRange.High) != nil {
-		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+	//删除只支持用户字段作为条件
+	if len(usr_pack.Usr.Attributes) != 0 || hasQueryOnlyConditions(usr_pack) {
+		c.JSON(400, gin.H{"error": "自定义属性，生日范围，filter，group 和游标只能用于查询"})
+		return
+	}
+	version, err := u_mgr.getIfMatch(c, usr_pack)
+	if err != nil {
+		renderIfMatchError(c, err)
+		return
+	}
+
+	//If-Match 和 purge 只按ID和版本删除，其他字段不能同时作为删除条件
+	has_fields := hasFieldConditions(&usr_pack.Usr)
+	purge, _ := strconv.ParseBool(c.Query("purge"))
+	if has_fields && (purge || c.Request.Header.Get("If-Match") != "") {
+		c.JSON(400, gin.H{"error": "If-Match 和 purge 只能按id删除，不能带有其他字段条件"})
+		return
+	}
+
+	if purge {
+		//彻底删除没有预览，不能让 dry_run 的请求真的删除数据
+		if isDryRun(c) {
+			c.JSON(400, gin.H{"error": "purge 不支持 dry_run"})
+			return
+		}
+		u_mgr.purgeUser(c, usr_pack, version)
+		return
+	}
+
+	if isDryRun(c) {
+		result, err := (&usr_pack.Usr).PreviewDelete(u_mgr.store, usr_pack.IDRange.Low, usr_pack.IDRange.High, u_mgr.guard.MaxAffectedRows)
+		u_mgr.renderDryRun(c, result, err, usr_pack.Usr, usr_pack.IDRange)
+		return
+	}
+
+	//按ID删除单个用户，带有其他字段条件时和批量删除一样按全部条件删除
+	if isSingleUser(usr_pack) && !has_fields {
+		if renderSingleUserError(c, (&usr_pack.Usr).DeleteOne(u_mgr.auditedStore(c), version)) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"object": usr_pack.Usr})
+		return
+	}
+
+	if !u_mgr.checkBulk(c, usr_pack.Usr, usr_pack.IDRange) {
+		return
+	}
+	if err := (&usr_pack.Usr).Delete(u_mgr.auditedStore(c), usr_pack.IDRange.Low, usr_pack.IDRange.High); err != nil {
+		if !renderConflict(c, err) {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": usr_pack.Usr})
+}
+
+/*
+ *  Description:   彻底删除用户, DELETE /user/:id?purge=true, 只能按id删除, 已经软删除的用户也可以彻底删除
+ */
+func (u_mgr *UserManager) purgeUser(c *gin.Context, usr_pack *USER.UserQueryPack, version int) {
+	if c.Param("id") == "" {
+		c.JSON(400, gin.H{"error": "purge 只能通过 /user/:id 彻底删除单个用户"})
+		return
+	}
+
+	if renderSingleUserError(c, (&usr_pack.Usr).Purge(u_mgr.auditedStore(c), version)) {
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"object": usr_pack.Usr})
@@ -262,27 +523,63 @@ func (u_mgr *UserManager) registerDelUser() {
 func (u_mgr *UserManager) registerAddUserOperation() {
 	u_mgr.registerAddUserByID()
 	u_mgr.registerAddUser()
+	u_mgr.registerRestoreUser()
 }
 
-func (u_mgr *UserManager) addUser(c *gin.Context) {
+/*
+ *  Description:   恢复软删除的用户, POST /user/:id/restore
+ */
+func (u_mgr *UserManager) registerRestoreUser() {
+	if u_mgr.canWork() {
+		u_mgr.http.POST("/user/:id/restore", func(c *gin.Context) {
+			u_mgr.restoreUser(c)
+		})
+	}
+}
+
+func (u_mgr *UserManager) restoreUser(c *gin.Context) {
 	if !u_mgr.canWork() {
 		//不能进行工作
 		c.JSON(406, gin.H{"status": "服务器关闭中......"})
 		return
 	}
 
-	//增加服务器的服务数量
-	atomic.AddInt32(&u_mgr.srv_num, int32(1))
-	defer func() {
-		atomic.AddInt32(&u_mgr.srv_num, int32(-1))
-	}()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(400, gin.H{"error": "转换id参数错误......"})
+		return
+	}
+
+	usr := &USER.User{ID: id}
+	err = usr.Restore(u_mgr.auditedStore(c))
+	if err == USER.ErrUserNotFound {
+		c.JSON(404, gin.H{"error": "回收站中没有该用户"})
+		return
+	} else if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": usr})
+}
+
+func (u_mgr *UserManager) addUser(c *gin.Context) {
+	if !u_mgr.canWork() {
+		//不能进行工作
+		c.JSON(406, gin.H{"status": "服务器关闭中......"})
+		return
+	}
 
 	var err error
 	id_str := c.Param("id")
+	//POST /user/import 与 /user/:id 冲突，在这里分发
+	if id_str == "import" {
+		u_mgr.importUsers(c)
+		return
+	}
 	var usr *USER.User
 	if id_str != "" {
-		id, err := strconv.Atoi(c.Param("id"))
-		if err != nil {
+		id, conv_err := strconv.Atoi(c.Param("id"))
+		if conv_err != nil {
 			c.JSON(400, gin.H{"error": "转换id参数错误......"})
 			return
 		}
@@ -292,11 +589,13 @@ func (u_mgr *UserManager) addUser(c *gin.Context) {
 	}
 
 	if err != nil {
-		c.JSON(400, gin.H{"status": "获取用户包时,参数错误"})
+		c.JSON(400, paramError("status", err))
 		return
 	}
-	if usr.Add(u_mgr.db) != nil {
-		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+	if err := usr.Add(u_mgr.auditedStore(c)); err != nil {
+		if !renderConflict(c, err) {
+			c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		}
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"object": usr})
@@ -336,19 +635,23 @@ func (u_mgr *UserManager) queryUser(c *gin.Context) {
 		return
 	}
 
-	//增加服务器的服务数量
-	atomic.AddInt32(&u_mgr.srv_num, int32(1))
-	defer func() {
-		atomic.AddInt32(&u_mgr.srv_num, int32(-1))
-	}()
-
 	var err error
 	var usr_pack *USER.UserQueryPack
 	id_str := c.Param("id")
 
+	//GET /user/trash, GET /user/export 与 /user/:id 共用路由
+	if id_str == "trash" {
+		u_mgr.queryTrash(c)
+		return
+	}
+	if id_str == "export" {
+		u_mgr.exportUsers(c)
+		return
+	}
+
 	if id_str != "" {
-		id, err := strconv.Atoi(c.Param("id"))
-		if err != nil {
+		id, conv_err := strconv.Atoi(c.Param("id"))
+		if conv_err != nil {
 			c.JSON(400, gin.H{"error": "转换id参数错误......"})
 			return
 		}
@@ -357,16 +660,85 @@ func (u_mgr *UserManager) queryUser(c *gin.Context) {
 		usr_pack, err = u_mgr.getUserPack(c)
 	}
 
+	if err == nil {
+		usr_pack.Fields, err = u_mgr.getFields(c)
+	}
+	if err != nil {
+		c.JSON(400, paramError("status", err))
+		return
+	}
+	counting, err := u_mgr.getCounting(c)
+	if err != nil {
+		c.JSON(400, paramError("status", err))
+		return
+	}
+	usr_list := &USER.UserList{}
+	page, err := u_mgr.listUsers(c, usr_pack, usr_list, counting, false)
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+
+	//按ID查询单个用户时返回 ETag
+	if id_str != "" && len(*usr_list) == 1 {
+		usr := &(*usr_list)[0]
+		c.Writer.Header().Set("ETag", userETag(usr))
+		if ifNoneMatch(c, usr) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
+	}
+	u_mgr.labelGenders(c, *usr_list)
+	if usr_pack.Fields != nil {
+		page["object"] = usr_pack.Fields.ProjectList(*usr_list)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+/*
+ *  Description:   查询回收站中已经软删除的用户, GET /user/trash, 参数与 GET /user 相同
+ */
+func (u_mgr *UserManager) queryTrash(c *gin.Context) {
+	usr_pack, err := u_mgr.getUserPack(c)
+	if err == nil {
+		usr_pack.Fields, err = u_mgr.getFields(c)
+	}
+	if err != nil {
+		c.JSON(400, paramError("status", err))
+		return
+	}
+	counting, err := u_mgr.getCounting(c)
 	if err != nil {
-		c.JSON(400, gin.H{"status": "获取用户包时,参数错误"})
+		c.JSON(400, paramError("status", err))
 		return
 	}
 	usr_list := &USER.UserList{}
-	if usr_list.Fetch(u_mgr.db, usr_pack) != nil {
+	page, err := u_mgr.listUsers(c, usr_pack, usr_list, counting, true)
+	if err != nil {
 		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"object": usr_list})
+	u_mgr.labelGenders(c, *usr_list)
+	if usr_pack.Fields != nil {
+		page["object"] = usr_pack.Fields.ProjectList(*usr_list)
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+/*
+ *  Description:   获取查询参数 fields 选择的字段，例如 fields=id,name,attr.level
+ *  Return        :   *USER.FieldSet 选择的字段，nil 表示全部字段
+ */
+func (u_mgr *UserManager) getFields(c *gin.Context) (*USER.FieldSet, error) {
+	source := c.Query("fields")
+	if source == "" {
+		return nil, nil
+	}
+	defs, err := u_mgr.store.FetchDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	return USER.ParseFields(source, defs)
 }
 
 /*
@@ -391,12 +763,158 @@ func (u_mgr *UserManager) registerQueryUser() {
 	}
 }
 
+/*
+ *  Description:   批量更新和删除前的安全检查，被拒绝时直接返回结构化的原因
+ *  Param         :  c *gin.Context http服务, cond 过滤条件, id_range ID范围
+ *  Return        :   true 可以执行， false 已经拒绝
+ */
+func (u_mgr *UserManager) checkBulk(c *gin.Context, cond USER.User, id_range USER.Range) bool {
+	_, err := u_mgr.guard.Check(u_mgr.store, cond, id_range.Low, id_range.High, c.Query("confirm"))
+	if err == nil {
+		return true
+	}
+
+	guard_err, ok := err.(*USER.GuardError)
+	if !ok {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return false
+	}
+
+	status := 400
+	switch guard_err.Code {
+	case USER.GUARD_TOO_MANY_ROWS:
+		status = 403
+	case USER.GUARD_CONFIRM_REQUIRED:
+		status = 428
+	case USER.GUARD_CONFIRM_MISMATCH:
+		status = 409
+	}
+	c.JSON(status, gin.H{"error": "批量操作被拒绝", "reason": guard_err})
+	return false
+}
+
+/*
+ *  Description:   获取用户包失败时返回的内容，性别无效时附带允许的值
+ *  Param         :  key 错误信息使用的字段名, err 获取用户包的错误
+ */
+func paramError(key string, err error) gin.H {
+	body := gin.H{key: "获取用户包时,参数错误", "detail": err.Error()}
+	if gender_err, ok := err.(*USER.GenderError); ok {
+		body["allowed"] = gender_err.Allowed
+	}
+	if attr_err, ok := err.(*USER.AttributeError); ok {
+		body["attribute"] = attr_err
+	}
+	if filter_err, ok := err.(*USER.FilterError); ok {
+		body["filter"] = filter_err
+	}
+	if sort_err, ok := err.(*USER.SortError); ok {
+		body["sort"] = sort_err
+	}
+	if fields_err, ok := err.(*USER.FieldsError); ok {
+		body["fields"] = fields_err
+	}
+	return body
+}
+
+/*
+ *  Description:   唯一字段与已有用户重复时返回 409 和已有用户的ID, 内存存储的事务与其他写入冲突时返回 409
+ *  Return        :   true 是冲突错误并且已经输出， false 不是冲突错误
+ */
+func renderConflict(c *gin.Context, err error) bool {
+	if err == USER.ErrTxConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return true
+	}
+	conflict, ok := err.(*USER.ConflictError)
+	if !ok {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{"error": conflict.Error(), "conflict": conflict})
+	return true
+}
+
+/*
+ *  Description:   按 lang 参数(默认为配置的 GenderLang)给输出的用户填上性别的本地化名称，没有语言时不处理
+ */
+func (u_mgr *UserManager) labelGenders(c *gin.Context, usr_list USER.UserList) {
+	if lang := c.DefaultQuery("lang", u_mgr.gender_lang); lang != "" {
+		u_mgr.genders.LabelUsers(usr_list, lang)
+	}
+}
+
+/*
+ *  Description:   判断查询包中是否有只能用于查询的条件(生日范围, filter 表达式, 用户组和游标)
+ */
+func hasQueryOnlyConditions(usr_pack *USER.UserQueryPack) bool {
+	return usr_pack.Birthday != (USER.DateRange{}) || usr_pack.Filter != nil || usr_pack.Cursor != nil || usr_pack.Group != 0
+}
+
+/*
+ *  Description:   判断查询包是否为按ID操作单个用户(有ID并且没有ID范围)
+ */
+func isSingleUser(usr_pack *USER.UserQueryPack) bool {
+	has_range := usr_pack.IDRange.Low != -1 && usr_pack.IDRange.High != -1
+	return usr_pack.Usr.ID != 0 && !has_range
+}
+
+/*
+ *  Description:   判断删除条件中除了ID之外是否还有用户字段
+ */
+func hasFieldConditions(usr *USER.User) bool {
+	return usr.Name != "" || usr.Gender != "" || usr.Birthday != "" || usr.Email != "" || usr.Phone != ""
+}
+
+/*
+ *  Description:   获取 If-Match 中的版本号，If-Match 只能用于按ID操作单个用户
+ *  Return        :   version 期望的版本号，0 表示不检查版本， error 见 renderIfMatchError
+ */
+func (u_mgr *UserManager) getIfMatch(c *gin.Context, usr_pack *USER.UserQueryPack) (int, error) {
+	if c.Request.Header.Get("If-Match") == "" {
+		return 0, nil
+	}
+	if !isSingleUser(usr_pack) {
+		return 0, errIfMatchNotSingle
+	}
+	return ifMatchVersion(c, func() (int, error) {
+		return u_mgr.currentVersion(usr_pack.Usr.ID)
+	})
+}
+
+/*
+ *  Description:   判断请求是否为预演(dry_run=true)
+ */
+func isDryRun(c *gin.Context) bool {
+	dry_run, err := strconv.ParseBool(c.Query("dry_run"))
+	return err == nil && dry_run
+}
+
+/*
+ *  Description:   输出预演结果，同时附带真正执行时安全检查的结论，预演本身不会被安全检查拒绝
+ *  Param         :  c *gin.Context http服务, result 预演结果, err 预演错误, cond 过滤条件, id_range ID范围
+ */
+func (u_mgr *UserManager) renderDryRun(c *gin.Context, result *USER.DryRunResult, err error, cond USER.User, id_range USER.Range) {
+	if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+
+	_, err = u_mgr.guard.Check(u_mgr.store, cond, id_range.Low, id_range.High, c.Query("confirm"))
+	if guard_err, ok := err.(*USER.GuardError); ok {
+		result.Guard = guard_err
+	} else if err != nil {
+		c.JSON(405, gin.H{"status": "操作数据库时发生错误"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dry_run": result})
+}
+
 /*
  *  Description:   判断该对象是否可以工作
  *  Return        :   true 正常工作， false 不能正常工作
  */
 func (u_mgr *UserManager) canWork() bool {
-	return u_mgr.http != nil && u_mgr.srv_flag
+	return u_mgr.http != nil && atomic.LoadInt32(&u_mgr.srv_state) != SRV_STATE_STOPPING
 }
 
 /*
@@ -420,6 +938,9 @@ func (u_mgr *UserManager) getUserPack(c *gin.Context, ids ...interface{}) (*USER
 		if err != nil {
 			return nil, err
 		}
+		if usr_pack.Limit < 1 {
+			return nil, errors.New("limit 必须大于0")
+		}
 	}
 
 	//获取排序
@@ -432,14 +953,52 @@ func (u_mgr *UserManager) getUserPack(c *gin.Context, ids ...interface{}) (*USER
 		}
 	}
 
+	//多字段排序，例如 sort=-birthday,name
+	sort_by := c.Query("sort")
+	if sort_by != "" {
+		if order != "" {
+			return nil, errors.New("sort 和 order 不能同时使用")
+		}
+		usr_pack.Sort, err = USER.ParseSort(sort_by)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	//获取偏移
-	offset := c.Query("order")
+	offset := c.Query("offset")
 	usr_pack.Offset = -1
 	if offset != "" {
-		usr_pack.Offset, err = strconv.Atoi(order)
+		usr_pack.Offset, err = strconv.Atoi(offset)
 		if err != nil {
 			return nil, err
 		}
+		if usr_pack.Offset < 0 {
+			return nil, errors.New("offset 不能小于0")
+		}
+	}
+
+	//获取游标，after 取游标之后的一页，before 取游标之前的一页
+	after, before := c.Query("after"), c.Query("before")
+	if after != "" || before != "" {
+		if after != "" && before != "" {
+			return nil, errors.New("after 和 before 不能同时使用")
+		}
+		if usr_pack.Offset != -1 {
+			return nil, errors.New("游标不能和 offset 一起使用")
+		}
+		usr_pack.Cursor, err = USER.ParseCursor(after+before, before != "")
+		if err != nil {
+			return nil, err
+		}
+		//没有指定排序时使用游标的排序
+		if (order != "" || sort_by != "") && usr_pack.Sorting().String() != usr_pack.Cursor.Sort.String() {
+			return nil, USER.ErrCursorOrder
+		}
+		usr_pack.Sort = usr_pack.Cursor.Sort
+	} else if usr_pack.Limit != -1 && usr_pack.Offset == -1 && len(usr_pack.Sorting()) == 0 {
+		//第一页也要有确定的顺序，才能生成稳定的游标，默认按ID升序
+		usr_pack.Order = 1
 	}
 
 	//获取ID范围
@@ -454,16 +1013,83 @@ func (u_mgr *UserManager) getUserPack(c *gin.Context, ids ...interface{}) (*USER
 
 	high := c.Query("high")
 	usr_pack.IDRange.High = -1
-	if low != "" {
+	if high != "" {
 		usr_pack.IDRange.High, err = strconv.Atoi(high)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	//获取生日范围
+	usr_pack.Birthday, err = u_mgr.getBirthdayRange(c)
+	if err != nil {
+		return nil, err
+	}
+
+	//获取 filter 表达式
+	if source := c.Query("filter"); source != "" {
+		defs, err := u_mgr.store.FetchDefinitions()
+		if err != nil {
+			return nil, err
+		}
+		opts := &USER.FilterOptions{Genders: u_mgr.genders, CountryCode: u_mgr.country_code, Definitions: defs}
+		if usr_pack.Filter, err = USER.ParseFilter(source, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	//只查询该组的成员
+	if group := c.Query("group"); group != "" {
+		usr_pack.Group, err = strconv.Atoi(group)
+		if err != nil || usr_pack.Group <= 0 {
+			return nil, errors.New("group 必须是用户组ID")
+		}
+	}
+
 	return &usr_pack, nil
 }
 
+/*
+ *  Description:   获取生日范围 born_after, born_before(不包括当天), min_age, max_age(按配置的时区计算)
+ *  Param         :  c *gin.Context http服务
+ *  Return        :   DateRange 各个条件的交集  error nil 没有错误， 否则发生错误
+ */
+func (u_mgr *UserManager) getBirthdayRange(c *gin.Context) (USER.DateRange, error) {
+	birthday := USER.DateRange{}
+	if born_after := c.Query("born_after"); born_after != "" {
+		date, err := USER.ParseDate(born_after)
+		if err != nil {
+			return birthday, errors.New("born_after " + err.Error())
+		}
+		birthday.From = date.AddDays(1)
+	}
+	if born_before := c.Query("born_before"); born_before != "" {
+		date, err := USER.ParseDate(born_before)
+		if err != nil {
+			return birthday, errors.New("born_before " + err.Error())
+		}
+		birthday.To = date.AddDays(-1)
+	}
+
+	ages := map[string]int{"min_age": -1, "max_age": -1}
+	for name := range ages {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		age, err := strconv.Atoi(value)
+		if err != nil || age < 0 {
+			return birthday, errors.New(name + " 必须是非负整数")
+		}
+		ages[name] = age
+	}
+	if ages["max_age"] != -1 && ages["min_age"] > ages["max_age"] {
+		return birthday, errors.New("min_age 不能大于 max_age")
+	}
+	age_range := USER.AgeRange(time.Now().In(u_mgr.loc), ages["min_age"], ages["max_age"])
+	return birthday.Intersect(age_range), nil
+}
+
 /*
  *  Description:   获取用户结构体
  *  Param         :  c *gin.Context http服务
@@ -471,11 +1097,16 @@ func (u_mgr *UserManager) getUserPack(c *gin.Context, ids ...interface{}) (*USER
  */
 func (u_mgr *UserManager) getUser(c *gin.Context, ids ...interface{}) (*USER.User, error) {
 	usr := USER.User{}
+	//请求体优先
+	if err := bindUserBody(c, &usr); err != nil {
+		return nil, err
+	}
+
 	//获取id
 	if len(ids) != 1 {
 		var err error
 		id := c.Query("id")
-		if id != "" {
+		if usr.ID == 0 && id != "" {
 			usr.ID, err = strconv.Atoi(id)
 			if err != nil {
 				return nil, err
@@ -489,9 +1120,120 @@ func (u_mgr *UserManager) getUser(c *gin.Context, ids ...interface{}) (*USER.Use
 		usr.ID = id
 	}
 
-	usr.Name = c.Query("name")
-	usr.Gender = c.Query("gender")
-	usr.Birthday = c.Query("birthday")
+	//请求体中没有的字段使用查询参数
+	if usr.Name == "" {
+		usr.Name = c.Query("name")
+	}
+	if usr.Gender == "" {
+		usr.Gender = c.Query("gender")
+	}
+
+	if usr.Email == "" {
+		usr.Email = USER.NullString(c.Query("email"))
+	}
+	if usr.Phone == "" {
+		usr.Phone = USER.NullString(c.Query("phone"))
+	}
+	if usr.Birthday == "" {
+		usr.Birthday = USER.Date(c.Query("birthday"))
+	}
 
+	//自定义属性按属性定义校验
+	if err := u_mgr.getAttributes(c, &usr); err != nil {
+		return nil, err
+	}
+	if err := u_mgr.normalizeUser(&usr); err != nil {
+		return nil, err
+	}
 	return &usr, nil
 }
+
+/*
+ *  Description:   规范化用户字段，并清空由存储维护的字段，增加用户和导入用户使用
+ *  Param         :  usr 请求中的用户，ID 不变
+ *  Return        :   error nil 没有错误， 否则为字段无效的错误
+ */
+func (u_mgr *UserManager) normalizeUser(usr *USER.User) error {
+	//性别的别名映射成规范值
+	gender, err := u_mgr.genders.Normalize(usr.Gender)
+	if err != nil {
+		return err
+	}
+	usr.Gender = gender
+
+	//邮箱转为小写，手机号转为 E.164 格式
+	if usr.Email, err = USER.NormalizeEmail(string(usr.Email)); err != nil {
+		return err
+	}
+	if usr.Phone, err = USER.NormalizePhone(string(usr.Phone), u_mgr.country_code); err != nil {
+		return err
+	}
+
+	//生日统一为 YYYY-MM-DD, 不能晚于今天
+	if usr.Birthday != "" {
+		birthday, err := USER.ParseBirthday(string(usr.Birthday), u_mgr.loc)
+		if err != nil {
+			return err
+		}
+		usr.Birthday = birthday
+	}
+
+	//版本号由存储维护，删除时间只能通过删除和恢复修改
+	usr.Version = 0
+	usr.DeletedAt = USER.DeletedTime{}
+	usr.GenderLabel = ""
+	return nil
+}
+
+/*
+ *  Description:   获取自定义属性，请求体中没有的属性使用查询参数 attr.<属性名>，并按属性定义校验和转换
+ *  Param         :  c *gin.Context http服务, usr 请求体绑定后的用户
+ *  Return        :   error nil 没有错误， 否则为 *USER.AttributeError 或存储错误
+ */
+func (u_mgr *UserManager) getAttributes(c *gin.Context, usr *USER.User) error {
+	for key, values := range c.Request.URL.Query() {
+		if !strings.HasPrefix(key, ATTRIBUTE_PARAM_PREFIX) || len(values) == 0 || values[0] == "" {
+			continue
+		}
+		if usr.Attributes == nil {
+			usr.Attributes = USER.Attributes{}
+		}
+		name := strings.TrimPrefix(key, ATTRIBUTE_PARAM_PREFIX)
+		if _, ok := usr.Attributes[name]; !ok {
+			usr.Attributes[name] = values[0]
+		}
+	}
+	if len(usr.Attributes) == 0 {
+		usr.Attributes = nil
+		return nil
+	}
+
+	defs, err := u_mgr.store.FetchDefinitions()
+	if err != nil {
+		return err
+	}
+	usr.Attributes, err = defs.Normalize(usr.Attributes)
+	return err
+}
+
+/*
+ *  Description:   将 POST/PUT/PATCH 的请求体绑定到用户结构体，其他方法或空请求体不做处理
+ *  Param         :  c *gin.Context http服务, usr 绑定的目标
+ *  Return        :   error nil 没有错误， 否则发生错误(包括不支持的 Content-Type)
+ */
+func bindUserBody(c *gin.Context, usr *USER.User) error {
+	switch c.Request.Method {
+	case "POST", "PUT", "PATCH":
+	default:
+		return nil
+	}
+	if c.Request.ContentLength == 0 {
+		return nil
+	}
+
+	//按 Content-Type 选择 json, xml, form, multipart 绑定
+	if !c.Bind(usr) {
+		return c.LastError()
+	}
+	return nil
+}
@@ -3,9 +3,28 @@
  */
 package main
 
+import (
+	"log"
+	"os"
+	_ "time/tzdata" //没有安装时区数据库的机器上也能加载配置的 Timezone
+)
+
 func main() {
+	//子命令: migrate up/down/status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(RunMigrate(os.Args[2:]))
+	}
+	//子命令: normalize-gender [--dry-run]
+	if len(os.Args) > 1 && os.Args[1] == "normalize-gender" {
+		os.Exit(RunNormalizeGender(os.Args[2:]))
+	}
+
 	usr_manager := new(UserManager)
-	usr_manager.Init()
-	usr_manager.Start()
-	usr_manager.HandleSignals()
+	if err := usr_manager.Init(); err != nil {
+		log.Fatalf("初始化失败: %v", err)
+	}
+	if err := usr_manager.Start(); err != nil {
+		log.Fatalf("启动失败: %v", err)
+	}
+	os.Exit(usr_manager.HandleSignals())
 }
@@ -0,0 +1,62 @@
+/*
+ 假 memcached 使用的时钟，测试中用 FakeClock 控制过期
+*/
+package MEMCACHED
+
+import (
+	"sync"
+	"time"
+)
+
+//时钟，判断缓存是否过期时使用
+type Clock interface {
+	Now() time.Time
+}
+
+//系统时钟
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+//手动控制的时钟，只有调用 Advance 或 Set 时才会变化
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+/*
+ *  Description:    创建手动控制的时钟
+ *  Params       :   now 初始时间，零值时使用当前时间
+ */
+func NewFakeClock(now time.Time) *FakeClock {
+	if now.IsZero() {
+		now = time.Now()
+	}
+	return &FakeClock{now: now}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+/*
+ *  Description:    时钟前进 d
+ */
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+/*
+ *  Description:    把时钟设置成 now
+ */
+func (clock *FakeClock) Set(now time.Time) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.now = now
+}
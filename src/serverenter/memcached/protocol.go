@@ -0,0 +1,364 @@
+/*
+ memcached 文本协议的命令处理
+ 每个连接按顺序读取命令并回复，命令格式和回复与 memcached 1.6 相同，见 memcached 的 doc/protocol.txt
+*/
+package MEMCACHED
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MAX_KEY_LENGTH  = 250     //key 的最大长度
+	MAX_VALUE_BYTES = 1 << 20 //值的最大长度
+	SERVER_VERSION  = "1.6.0-fake"
+)
+
+var (
+	reply_error         = []byte("ERROR\r\n")
+	reply_stored        = []byte("STORED\r\n")
+	reply_not_stored    = []byte("NOT_STORED\r\n")
+	reply_exists        = []byte("EXISTS\r\n")
+	reply_not_found     = []byte("NOT_FOUND\r\n")
+	reply_deleted       = []byte("DELETED\r\n")
+	reply_touched       = []byte("TOUCHED\r\n")
+	reply_ok            = []byte("OK\r\n")
+	reply_end           = []byte("END\r\n")
+	reply_bad_format    = []byte("CLIENT_ERROR bad command line format\r\n")
+	reply_bad_chunk     = []byte("CLIENT_ERROR bad data chunk\r\n")
+	reply_too_large     = []byte("SERVER_ERROR object too large for cache\r\n")
+	reply_non_numeric   = []byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	reply_invalid_delta = []byte("CLIENT_ERROR invalid numeric delta argument\r\n")
+)
+
+//一个命令，storage 命令带数据
+type command struct {
+	name    string
+	args    []string
+	data    []byte
+	noreply bool
+}
+
+/*
+ *  Description:    处理一个连接，连接断开，出错或收到 quit 时返回
+ */
+func (srv *Server) handle(conn net.Conn) {
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		cmd, reply, err := readCommand(rw.Reader)
+		if err != nil {
+			return
+		}
+		if cmd == nil {
+			//命令格式错误，不执行
+			if !srv.respond(rw, "", reply) {
+				return
+			}
+			continue
+		}
+		if cmd.name == "quit" {
+			return
+		}
+
+		srv.lock.Lock()
+		srv.commands[cmd.name]++
+		srv.lock.Unlock()
+
+		reply = srv.execute(cmd)
+		if cmd.noreply {
+			reply = nil
+		}
+		if !srv.respond(rw, cmd.name, reply) {
+			return
+		}
+	}
+}
+
+/*
+ *  Description:    按注入的故障发送回复
+ *   Returns      :   bool false 表示连接应当关闭
+ */
+func (srv *Server) respond(rw *bufio.ReadWriter, name string, reply []byte) bool {
+	if fault := srv.takeFault(name); fault != nil {
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-srv.done:
+				return false
+			}
+		}
+		if fault.Drop {
+			return false
+		}
+	}
+	if len(reply) == 0 {
+		return true
+	}
+	if _, err := rw.Write(reply); err != nil {
+		return false
+	}
+	return rw.Flush() == nil
+}
+
+/*
+ *  Description:    读取一个命令，storage 命令同时读取数据
+ *   Returns      :   *command 命令，格式错误时为 nil, []byte 格式错误时的回复, error 读取失败，连接应当关闭
+ */
+func readCommand(r *bufio.Reader) (*command, []byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) == 0 {
+		return nil, reply_error, nil
+	}
+
+	cmd := &command{name: fields[0], args: fields[1:]}
+	if len(cmd.args) > 0 && cmd.args[len(cmd.args)-1] == "noreply" {
+		cmd.noreply = true
+		cmd.args = cmd.args[:len(cmd.args)-1]
+	}
+
+	switch cmd.name {
+	case "set", "add", "replace", "cas":
+		want := 4
+		if cmd.name == "cas" {
+			want = 5
+		}
+		if len(cmd.args) != want {
+			return nil, reply_error, nil
+		}
+		size, err := strconv.Atoi(cmd.args[3])
+		if err != nil || size < 0 {
+			return nil, reply_bad_format, nil
+		}
+		cmd.data = make([]byte, size+2)
+		if _, err := io.ReadFull(r, cmd.data); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.HasSuffix(cmd.data, []byte("\r\n")) {
+			return nil, reply_bad_chunk, nil
+		}
+		cmd.data = cmd.data[:size]
+	}
+	return cmd, nil, nil
+}
+
+/*
+ *  Description:    执行命令
+ *   Returns      :   []byte 回复
+ */
+func (srv *Server) execute(cmd *command) []byte {
+	switch cmd.name {
+	case "get", "gets":
+		return srv.get(cmd.args, cmd.name == "gets")
+	case "set", "add", "replace", "cas":
+		return srv.update(cmd)
+	case "delete":
+		return srv.delete(cmd.args)
+	case "incr", "decr":
+		return srv.incrDecr(cmd.args, cmd.name == "incr")
+	case "touch":
+		return srv.touch(cmd.args)
+	case "flush_all":
+		return srv.flushAll(cmd.args)
+	case "version":
+		return []byte("VERSION " + SERVER_VERSION + "\r\n")
+	}
+	return reply_error
+}
+
+/*
+ *  Description:    key 是否合法：不超过 MAX_KEY_LENGTH, 不包括空白和控制字符
+ */
+func legalKey(key string) bool {
+	if len(key) == 0 || len(key) > MAX_KEY_LENGTH {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func (srv *Server) get(keys []string, with_cas bool) []byte {
+	if len(keys) == 0 {
+		return reply_error
+	}
+	for _, key := range keys {
+		if !legalKey(key) {
+			return reply_bad_format
+		}
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	buf := &bytes.Buffer{}
+	for _, key := range keys {
+		it := srv.lookup(key)
+		if it == nil {
+			continue
+		}
+		if with_cas {
+			fmt.Fprintf(buf, "VALUE %s %d %d %d\r\n", key, it.flags, len(it.value), it.cas)
+		} else {
+			fmt.Fprintf(buf, "VALUE %s %d %d\r\n", key, it.flags, len(it.value))
+		}
+		buf.Write(it.value)
+		buf.WriteString("\r\n")
+	}
+	buf.Write(reply_end)
+	return buf.Bytes()
+}
+
+/*
+ *  Description:    set, add, replace, cas: <命令> <key> <flags> <exptime> <bytes> [<cas>]
+ */
+func (srv *Server) update(cmd *command) []byte {
+	key := cmd.args[0]
+	flags, err1 := strconv.ParseUint(cmd.args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(cmd.args[2], 10, 64)
+	if !legalKey(key) || err1 != nil || err2 != nil {
+		return reply_bad_format
+	}
+	var cas uint64
+	if cmd.name == "cas" {
+		var err error
+		if cas, err = strconv.ParseUint(cmd.args[4], 10, 64); err != nil {
+			return reply_bad_format
+		}
+	}
+	if len(cmd.data) > MAX_VALUE_BYTES {
+		return reply_too_large
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	old := srv.lookup(key)
+	switch {
+	case cmd.name == "add" && old != nil:
+		return reply_not_stored
+	case cmd.name == "replace" && old == nil:
+		return reply_not_stored
+	case cmd.name == "cas" && old == nil:
+		return reply_not_found
+	case cmd.name == "cas" && old.cas != cas:
+		return reply_exists
+	}
+
+	value := append([]byte(nil), cmd.data...)
+	srv.store(key, &item{value: value, flags: uint32(flags), expire: srv.expireAt(exptime)})
+	return reply_stored
+}
+
+/*
+ *  Description:    delete <key>
+ */
+func (srv *Server) delete(args []string) []byte {
+	if len(args) != 1 || !legalKey(args[0]) {
+		return reply_bad_format
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.lookup(args[0]) == nil {
+		return reply_not_found
+	}
+	delete(srv.items, args[0])
+	return reply_deleted
+}
+
+/*
+ *  Description:    incr/decr <key> <delta>，incr 溢出时回绕，decr 最小为0，不改变过期时间
+ */
+func (srv *Server) incrDecr(args []string, incr bool) []byte {
+	if len(args) != 2 || !legalKey(args[0]) {
+		return reply_error
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return reply_invalid_delta
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	it := srv.lookup(args[0])
+	if it == nil {
+		return reply_not_found
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(it.value)), 10, 64)
+	if err != nil {
+		return reply_non_numeric
+	}
+	switch {
+	case incr:
+		value += delta
+	case delta > value:
+		value = 0
+	default:
+		value -= delta
+	}
+
+	srv.cas_seq++
+	it.cas = srv.cas_seq
+	it.value = []byte(strconv.FormatUint(value, 10))
+	return []byte(string(it.value) + "\r\n")
+}
+
+/*
+ *  Description:    touch <key> <exptime>
+ */
+func (srv *Server) touch(args []string) []byte {
+	if len(args) != 2 || !legalKey(args[0]) {
+		return reply_error
+	}
+	exptime, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return reply_bad_format
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	it := srv.lookup(args[0])
+	if it == nil {
+		return reply_not_found
+	}
+	it.expire = srv.expireAt(exptime)
+	return reply_touched
+}
+
+/*
+ *  Description:    flush_all [delay]，没有 delay 时立即清空，有 delay 时之前写入的数据在 delay 之后失效
+ */
+func (srv *Server) flushAll(args []string) []byte {
+	if len(args) > 1 {
+		return reply_error
+	}
+	var delay int64
+	if len(args) == 1 {
+		var err error
+		if delay, err = strconv.ParseInt(args[0], 10, 64); err != nil || delay < 0 {
+			return reply_bad_format
+		}
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if delay == 0 {
+		srv.items = make(map[string]*item)
+		srv.flush_at = time.Time{}
+		return reply_ok
+	}
+	srv.flush_at = srv.expireAt(delay)
+	return reply_ok
+}
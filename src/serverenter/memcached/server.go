@@ -0,0 +1,271 @@
+/*
+ 进程内的假 memcached 服务器，实现 third/gomemcache/memcache 使用的文本协议，用于在没有 memcached 的环境中测试缓存
+ 1. 支持 get, gets, set, add, replace, cas, delete, incr, decr, touch, flush_all, version, quit
+ 2. 过期时间按 Clock 计算，使用 FakeClock 时不需要等待真实的时间
+ 3. 可以注入故障：不回复直接断开连接，延迟回复(超过客户端的 Timeout 时客户端超时)，断开已有的连接
+ 4. 只监听 127.0.0.1 的随机端口，没有内存上限和淘汰
+ 用法：
+	srv, err := MEMCACHED.NewServer(clock)
+	client := memcache.New(srv.Addr())
+	defer srv.Close()
+*/
+package MEMCACHED
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//缓存的数据
+type item struct {
+	value   []byte
+	flags   uint32
+	expire  time.Time //零值表示不过期
+	cas     uint64
+	created time.Time //写入时间，延迟的 flush_all 使之前写入的数据失效
+}
+
+//注入的故障
+type Fault struct {
+	Command string        //只对该命令生效，空表示全部命令，get 同时匹配 gets(memcache.Client 的 Get 和 GetMulti 发送 gets)
+	Drop    bool          //不回复，直接关闭连接
+	Delay   time.Duration //回复前等待的时间
+	Times   int           //生效的次数，0 表示一直生效
+}
+
+//服务器的计数
+type Stats struct {
+	Connections int            //当前的连接数
+	Commands    map[string]int //每个命令收到的次数
+}
+
+type Server struct {
+	listener net.Listener
+	clock    Clock
+
+	lock     sync.Mutex
+	items    map[string]*item
+	cas_seq  uint64
+	flush_at time.Time //延迟的 flush_all 的时间，在这之前写入的数据在这之后失效
+	faults   []*Fault
+	conns    map[net.Conn]bool
+	commands map[string]int
+	closed   bool
+
+	done chan struct{} //关闭时 close，结束等待中的延迟回复
+	wg   sync.WaitGroup
+}
+
+/*
+ *  Description:    创建并启动服务器，监听 127.0.0.1 的随机端口
+ *  Params       :   clock 计算过期时间的时钟，nil 使用系统时钟
+ *   Returns      :   *Server 服务器，　error nil表示成功　非nil表示失败
+ */
+func NewServer(clock Clock) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	srv := &Server{
+		listener: listener,
+		clock:    clock,
+		items:    make(map[string]*item),
+		conns:    make(map[net.Conn]bool),
+		commands: make(map[string]int),
+		done:     make(chan struct{}),
+	}
+	srv.wg.Add(1)
+	go srv.serve()
+	return srv, nil
+}
+
+/*
+ *  Description:    服务器的地址 host:port, 作为 memcache.New 的参数
+ */
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+/*
+ *  Description:    关闭监听和全部连接，等待处理连接的 goroutine 退出
+ */
+func (srv *Server) Close() error {
+	srv.lock.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.done)
+	}
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.lock.Unlock()
+
+	err := srv.listener.Close()
+	srv.wg.Wait()
+	return err
+}
+
+func (srv *Server) serve() {
+	defer srv.wg.Done()
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.lock.Lock()
+		if srv.closed {
+			srv.lock.Unlock()
+			conn.Close()
+			return
+		}
+		srv.conns[conn] = true
+		srv.wg.Add(1)
+		srv.lock.Unlock()
+
+		go func() {
+			defer srv.wg.Done()
+			srv.handle(conn)
+
+			srv.lock.Lock()
+			delete(srv.conns, conn)
+			srv.lock.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+/*
+ *  Description:    注入故障，多个故障按注入的顺序匹配，每个命令只触发第一个匹配的故障
+ */
+func (srv *Server) InjectFault(fault Fault) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.faults = append(srv.faults, &fault)
+}
+
+/*
+ *  Description:    清除全部注入的故障
+ */
+func (srv *Server) ClearFaults() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.faults = nil
+}
+
+/*
+ *  Description:    断开当前全部的连接，之后的新连接正常处理
+ */
+func (srv *Server) DropConnections() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+}
+
+/*
+ *  Description:    取出命令匹配的故障，并减少剩余的次数
+ *   Returns      :   *Fault 匹配的故障，没有时为 nil
+ */
+func (srv *Server) takeFault(command string) *Fault {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for i, fault := range srv.faults {
+		if !fault.matches(command) {
+			continue
+		}
+		matched := *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				srv.faults = append(srv.faults[:i], srv.faults[i+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+/*
+ *  Description:    故障是否对命令生效
+ */
+func (fault *Fault) matches(command string) bool {
+	return fault.Command == "" || fault.Command == command || (fault.Command == "get" && command == "gets")
+}
+
+/*
+ *  Description:    当前的计数
+ */
+func (srv *Server) Stats() Stats {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	stats := Stats{Connections: len(srv.conns), Commands: make(map[string]int)}
+	for command, count := range srv.commands {
+		stats.Commands[command] = count
+	}
+	return stats
+}
+
+/*
+ *  Description:    直接读取缓存的值，不经过协议，用于测试中检查
+ *   Returns      :   []byte 值， bool 是否存在(已经过期的视为不存在)
+ */
+func (srv *Server) Value(key string) ([]byte, bool) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	it := srv.lookup(key)
+	if it == nil {
+		return nil, false
+	}
+	return append([]byte(nil), it.value...), true
+}
+
+/*
+ *  Description:    没有过期的数据，过期的数据在这里删除，调用时必须持有锁
+ */
+func (srv *Server) lookup(key string) *item {
+	it, ok := srv.items[key]
+	if !ok {
+		return nil
+	}
+	now := srv.clock.Now()
+	expired := !it.expire.IsZero() && !now.Before(it.expire)
+	flushed := !srv.flush_at.IsZero() && !now.Before(srv.flush_at) && it.created.Before(srv.flush_at)
+	if expired || flushed {
+		delete(srv.items, key)
+		return nil
+	}
+	return it
+}
+
+/*
+ *  Description:    按 memcached 的规则计算过期时间，调用时必须持有锁
+ *  Params       :   exptime 0 不过期，不超过30天为相对的秒数，超过30天为 unix 时间戳，负数立即过期
+ */
+func (srv *Server) expireAt(exptime int64) time.Time {
+	const max_relative = 60 * 60 * 24 * 30
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return srv.clock.Now()
+	case exptime <= max_relative:
+		return srv.clock.Now().Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+/*
+ *  Description:    写入数据并分配新的 cas，调用时必须持有锁
+ */
+func (srv *Server) store(key string, it *item) {
+	srv.cas_seq++
+	it.cas = srv.cas_seq
+	it.created = srv.clock.Now()
+	srv.items[key] = it
+}
@@ -0,0 +1,241 @@
+package MEMCACHED
+
+import (
+	"testing"
+	"third/gomemcache/memcache"
+	"time"
+)
+
+//测试开始的时间，使用固定的时间使过期时间可以预测
+var test_start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestServer(t *testing.T) (*Server, *FakeClock, *memcache.Client) {
+	clock := NewFakeClock(test_start)
+	srv, err := NewServer(clock)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	client := memcache.New(srv.Addr())
+	client.Timeout = time.Second
+	return srv, clock, client
+}
+
+func mustGet(t *testing.T, client *memcache.Client, key, want string) *memcache.Item {
+	t.Helper()
+	item, err := client.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	if string(item.Value) != want {
+		t.Fatalf("Get(%q) = %q, want %q", key, item.Value, want)
+	}
+	return item
+}
+
+func mustMiss(t *testing.T, client *memcache.Client, key string) {
+	t.Helper()
+	if item, err := client.Get(key); err != memcache.ErrCacheMiss {
+		t.Fatalf("Get(%q) = %v, %v, want ErrCacheMiss", key, item, err)
+	}
+}
+
+func TestSetAddReplace(t *testing.T) {
+	_, _, client := newTestServer(t)
+
+	if err := client.Replace(&memcache.Item{Key: "k", Value: []byte("r")}); err != memcache.ErrNotStored {
+		t.Fatalf("Replace 不存在的 key: %v, want ErrNotStored", err)
+	}
+	if err := client.Add(&memcache.Item{Key: "k", Value: []byte("a"), Flags: 7}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if item := mustGet(t, client, "k", "a"); item.Flags != 7 {
+		t.Fatalf("Flags = %d, want 7", item.Flags)
+	}
+	if err := client.Add(&memcache.Item{Key: "k", Value: []byte("b")}); err != memcache.ErrNotStored {
+		t.Fatalf("Add 已经存在的 key: %v, want ErrNotStored", err)
+	}
+	if err := client.Replace(&memcache.Item{Key: "k", Value: []byte("r")}); err != nil {
+		t.Fatalf("Replace: %v", err)
+	}
+	mustGet(t, client, "k", "r")
+	if err := client.Set(&memcache.Item{Key: "k", Value: []byte("s")}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	mustGet(t, client, "k", "s")
+
+	items, err := client.GetMulti([]string{"k", "missing"})
+	if err != nil || len(items) != 1 || string(items["k"].Value) != "s" {
+		t.Fatalf("GetMulti = %v, %v", items, err)
+	}
+
+	if err := client.Delete("k"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := client.Delete("k"); err != memcache.ErrCacheMiss {
+		t.Fatalf("Delete 不存在的 key: %v, want ErrCacheMiss", err)
+	}
+	mustMiss(t, client, "k")
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	_, _, client := newTestServer(t)
+
+	if err := client.CompareAndSwap(&memcache.Item{Key: "k", Value: []byte("x")}); err != memcache.ErrCacheMiss {
+		t.Fatalf("CompareAndSwap 不存在的 key: %v, want ErrCacheMiss", err)
+	}
+	client.Set(&memcache.Item{Key: "k", Value: []byte("1")})
+	item := mustGet(t, client, "k", "1")
+	stale := mustGet(t, client, "k", "1")
+
+	item.Value = []byte("2")
+	if err := client.CompareAndSwap(item); err != nil {
+		t.Fatalf("CompareAndSwap: %v", err)
+	}
+	stale.Value = []byte("3")
+	if err := client.CompareAndSwap(stale); err != memcache.ErrCASConflict {
+		t.Fatalf("CompareAndSwap 旧的 cas: %v, want ErrCASConflict", err)
+	}
+	mustGet(t, client, "k", "2")
+}
+
+func TestIncrDecr(t *testing.T) {
+	_, _, client := newTestServer(t)
+
+	if _, err := client.Increment("n", 1); err != memcache.ErrCacheMiss {
+		t.Fatalf("Increment 不存在的 key: %v, want ErrCacheMiss", err)
+	}
+	client.Set(&memcache.Item{Key: "n", Value: []byte("10")})
+	if v, err := client.Increment("n", 5); err != nil || v != 15 {
+		t.Fatalf("Increment = %d, %v, want 15", v, err)
+	}
+	if v, err := client.Decrement("n", 20); err != nil || v != 0 {
+		t.Fatalf("Decrement 小于0 = %d, %v, want 0", v, err)
+	}
+	client.Set(&memcache.Item{Key: "n", Value: []byte("18446744073709551615")})
+	if v, err := client.Increment("n", 2); err != nil || v != 1 {
+		t.Fatalf("Increment 溢出 = %d, %v, want 1", v, err)
+	}
+
+	client.Set(&memcache.Item{Key: "s", Value: []byte("abc")})
+	if _, err := client.Increment("s", 1); err == nil {
+		t.Fatalf("Increment 非数字的值没有出错")
+	}
+}
+
+func TestExpiryAndTouch(t *testing.T) {
+	_, clock, client := newTestServer(t)
+
+	client.Set(&memcache.Item{Key: "short", Value: []byte("1"), Expiration: 10})
+	client.Set(&memcache.Item{Key: "forever", Value: []byte("1")})
+	client.Set(&memcache.Item{Key: "absolute", Value: []byte("1"), Expiration: int32(test_start.Add(time.Hour).Unix())})
+
+	clock.Advance(9 * time.Second)
+	mustGet(t, client, "short", "1")
+	if err := client.Touch("short", 30); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	clock.Advance(29 * time.Second)
+	mustGet(t, client, "short", "1")
+	clock.Advance(time.Second)
+	mustMiss(t, client, "short")
+	if err := client.Touch("short", 30); err != memcache.ErrCacheMiss {
+		t.Fatalf("Touch 已经过期的 key: %v, want ErrCacheMiss", err)
+	}
+
+	mustGet(t, client, "absolute", "1")
+	clock.Set(test_start.Add(time.Hour))
+	mustMiss(t, client, "absolute")
+	mustGet(t, client, "forever", "1")
+}
+
+func TestFlushAll(t *testing.T) {
+	srv, clock, client := newTestServer(t)
+
+	client.Set(&memcache.Item{Key: "a", Value: []byte("1")})
+	if err := client.FlushAll(); err != nil {
+		t.Fatalf("FlushAll: %v", err)
+	}
+	mustMiss(t, client, "a")
+
+	//延迟的 flush_all 到时间后使这之前写入的数据失效，之后写入的数据不受影响
+	client.Set(&memcache.Item{Key: "old", Value: []byte("1")})
+	if reply := srv.flushAll([]string{"10"}); string(reply) != "OK\r\n" {
+		t.Fatalf("flush_all 10 = %q", reply)
+	}
+	clock.Advance(5 * time.Second)
+	client.Set(&memcache.Item{Key: "before", Value: []byte("1")})
+	mustGet(t, client, "old", "1")
+	clock.Advance(5 * time.Second)
+	mustMiss(t, client, "old")
+	mustMiss(t, client, "before")
+	client.Set(&memcache.Item{Key: "after", Value: []byte("1")})
+	clock.Advance(time.Minute)
+	mustGet(t, client, "after", "1")
+}
+
+func TestFaultDrop(t *testing.T) {
+	srv, _, client := newTestServer(t)
+	client.Set(&memcache.Item{Key: "k", Value: []byte("1")})
+
+	//memcache.Client 的 Get 发送 gets, get 的故障同样生效
+	srv.InjectFault(Fault{Command: "get", Drop: true, Times: 1})
+	if _, err := client.Get("k"); err == nil || err == memcache.ErrCacheMiss {
+		t.Fatalf("注入 Drop 后 Get: %v, want 连接错误", err)
+	}
+	mustGet(t, client, "k", "1")
+
+	//只对指定的命令生效，命令已经执行，只是没有回复
+	srv.InjectFault(Fault{Command: "delete", Drop: true})
+	mustGet(t, client, "k", "1")
+	if err := client.Delete("k"); err == nil {
+		t.Fatalf("注入 Drop 后 Delete 没有出错")
+	}
+	srv.ClearFaults()
+	if err := client.Delete("k"); err != memcache.ErrCacheMiss {
+		t.Fatalf("ClearFaults 后 Delete: %v, want ErrCacheMiss", err)
+	}
+	if srv.Stats().Commands["gets"] == 0 {
+		t.Fatalf("Stats 中没有 gets 的计数: %v", srv.Stats())
+	}
+}
+
+func TestFaultDelay(t *testing.T) {
+	srv, _, client := newTestServer(t)
+	client.Timeout = 50 * time.Millisecond
+	client.Set(&memcache.Item{Key: "k", Value: []byte("1")})
+
+	srv.InjectFault(Fault{Command: "get", Delay: 300 * time.Millisecond, Times: 1})
+	if _, err := client.Get("k"); err == nil {
+		t.Fatalf("延迟超过 Timeout 时 Get 没有出错")
+	}
+	//没有超过 Timeout 的延迟正常回复
+	client.Timeout = time.Second
+	srv.InjectFault(Fault{Delay: 10 * time.Millisecond, Times: 1})
+	mustGet(t, client, "k", "1")
+}
+
+func TestDropConnections(t *testing.T) {
+	srv, _, client := newTestServer(t)
+	client.Set(&memcache.Item{Key: "k", Value: []byte("1")})
+	if n := srv.Stats().Connections; n != 1 {
+		t.Fatalf("Connections = %d, want 1", n)
+	}
+
+	srv.DropConnections()
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().Connections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("DropConnections 后连接没有关闭")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//客户端复用已经断开的连接会出错一次，之后重新连接
+	if _, err := client.Get("k"); err != nil {
+		mustGet(t, client, "k", "1")
+	}
+	if v, ok := srv.Value("k"); !ok || string(v) != "1" {
+		t.Fatalf("Value(k) = %q, %v", v, ok)
+	}
+}
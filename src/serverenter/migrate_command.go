@@ -0,0 +1,99 @@
+/*
+* 数据库结构迁移子命令
+* user_manager migrate up [N]     执行还没有执行的迁移，N 为最多执行的个数，默认全部
+* user_manager migrate down [N]   回滚最近执行的迁移，N 为回滚的个数，默认1个
+* user_manager migrate status     查看全部迁移的执行状态
+ */
+package main
+
+import (
+	"fmt"
+	"os"
+	"serverenter/user"
+	"strconv"
+)
+
+const MIGRATE_USAGE = "用法: migrate up [N] | migrate down [N] | migrate status"
+
+/*
+ *  Description:   执行迁移子命令
+ *  Params       :   args migrate 后面的参数
+ *   Returns      :   进程的退出码
+ */
+func RunMigrate(args []string) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, MIGRATE_USAGE)
+		return 2
+	}
+	steps := 0
+	if len(args) == 2 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps <= 0 {
+			fmt.Fprintln(os.Stderr, MIGRATE_USAGE)
+			return 2
+		}
+	}
+
+	config, err := GetGlobalConfig()
+	if err == nil {
+		err = config.Init(DEFAULT_CONF_FILE)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "读取配置失败:", err)
+		return 1
+	}
+	if config.StoreType == USER.STORE_TYPE_MEMORY {
+		fmt.Println("内存存储不需要迁移")
+		return 0
+	}
+
+	db, err := USER.OpenDB(config.MysqlConn, 1)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "连接数据库失败:", err)
+		return 1
+	}
+	defer db.Close()
+	migrator := USER.NewMigrator(db)
+
+	var done []USER.Migration
+	switch args[0] {
+	case "up":
+		done, err = migrator.Up(steps)
+	case "down":
+		done, err = migrator.Down(steps)
+	case "status":
+		return printMigrateStatus(migrator)
+	default:
+		fmt.Fprintln(os.Stderr, MIGRATE_USAGE)
+		return 2
+	}
+
+	for _, migration := range done {
+		fmt.Printf("%s %d_%s\n", args[0], migration.Version, migration.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "迁移失败:", err)
+		return 1
+	}
+	if len(done) == 0 {
+		fmt.Println("没有需要执行的迁移")
+	}
+	return 0
+}
+
+func printMigrateStatus(migrator *USER.Migrator) int {
+	status, err := migrator.Status()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "获取迁移状态失败:", err)
+		return 1
+	}
+	for _, item := range status {
+		applied := "pending"
+		if item.AppliedAt != nil {
+			applied = item.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-30s  %s\n", item.Version, item.Name, applied)
+	}
+	return 0
+}
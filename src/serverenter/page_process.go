@@ -0,0 +1,209 @@
+/*
+* 用户列表(GET /user, GET /user/trash)的分页信息
+* 1. 带 limit 时按游标分页，带 offset 时按偏移分页，见 logic_process.go
+* 2. total 为满足条件的用户总数，超过配置的 TotalCountThreshold 时为估计值，total_exact 为 false
+*    count=exact 总是精确统计，count=false 不统计总数(热点路径使用)
+* 3. 响应中带 limit, offset 或 cursor(请求的游标)，翻页链接 first, prev, next, last(只在按偏移分页且总数精确时)
+*    总数同时在 X-Total-Count 头中返回，翻页链接同时在 Link 头中返回(RFC 5988)
+ */
+package main
+
+import (
+	"errors"
+	"net/url"
+	"serverenter/user"
+	"strconv"
+	"strings"
+	"third/gin"
+)
+
+//默认列表总数精确统计的最大行数
+const DEFAULT_TOTAL_COUNT_THRESHOLD = 10000
+
+//Link 头中链接的顺序
+var page_rels = []string{"first", "prev", "next", "last"}
+
+//统计总数的方式
+type counting struct {
+	enabled   bool //false 不统计总数
+	threshold int  //精确统计的最大行数，0 表示总是精确统计
+}
+
+/*
+ *  Description:   获取统计总数的方式，查询参数 count 为 true(默认), exact 或 false
+ */
+func (u_mgr *UserManager) getCounting(c *gin.Context) (counting, error) {
+	switch c.Query("count") {
+	case "", "true":
+		return counting{enabled: true, threshold: u_mgr.count_threshold}, nil
+	case "exact":
+		return counting{enabled: true}, nil
+	case "false":
+		return counting{}, nil
+	}
+	return counting{}, errors.New("count 只能是 true, exact 或 false")
+}
+
+/*
+ *  Description:   获取一页用户和分页信息，并设置 X-Total-Count 和 Link 头
+ *  Param         :  c *gin.Context http服务, usr_pack 查询包, usr_list 返回的用户列表
+ *                   count 统计总数的方式, deleted true 查询回收站
+ *  Return        :   gin.H 响应体
+ */
+func (u_mgr *UserManager) listUsers(c *gin.Context, usr_pack *USER.UserQueryPack, usr_list *USER.UserList,
+	count counting, deleted bool) (gin.H, error) {
+	store := u_mgr.readStore(c)
+	fetch := store.FetchUsers
+	if deleted {
+		fetch = store.FetchDeletedUsers
+	}
+	page, err := fetchPage(usr_pack, usr_list, fetch)
+	if err != nil {
+		return nil, err
+	}
+
+	//没有分页时列表就是全部用户，不需要再统计
+	total, exact := -1, false
+	if usr_pack.Limit == -1 && usr_pack.Offset == -1 && usr_pack.Cursor == nil {
+		total, exact = len(*usr_list), true
+	} else if count.enabled {
+		total, exact, err = store.TotalUsers(usr_pack, deleted, count.threshold)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if total != -1 {
+		page["total"] = total
+		page["total_exact"] = exact
+		c.Writer.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+
+	if usr_pack.Limit != -1 {
+		page["limit"] = usr_pack.Limit
+	}
+	if usr_pack.Cursor != nil {
+		page["cursor"] = c.Query("after") + c.Query("before")
+	} else if usr_pack.Offset != -1 {
+		page["offset"] = usr_pack.Offset
+	}
+
+	links := pageLinks(c, usr_pack, page, len(*usr_list), total, exact)
+	header := []string{}
+	for _, rel := range page_rels {
+		if link, ok := links[rel]; ok {
+			page[rel] = link
+			header = append(header, "<"+link+">; rel=\""+rel+"\"")
+		}
+	}
+	if len(header) != 0 {
+		c.Writer.Header().Set("Link", strings.Join(header, ", "))
+	}
+	return page, nil
+}
+
+/*
+ *  Description:   生成翻页链接，在当前请求的参数上替换 offset, after, before
+ *  Param         :  page 响应体(带 next_cursor, prev_cursor), size 当前页的用户数, total 总数(-1 表示没有统计)
+ *  Return        :   map[string]string rel -> 链接
+ */
+func pageLinks(c *gin.Context, usr_pack *USER.UserQueryPack, page gin.H, size, total int, exact bool) map[string]string {
+	links := make(map[string]string)
+	limit := usr_pack.Limit
+	if limit <= 0 {
+		return links
+	}
+
+	link := func(key, value string) string {
+		query := c.Request.URL.Query()
+		query.Del("offset")
+		query.Del("after")
+		query.Del("before")
+		if key != "" {
+			query.Set(key, value)
+		}
+		return (&url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}).String()
+	}
+
+	//按游标分页
+	if usr_pack.Offset == -1 {
+		links["first"] = link("", "")
+		if cursor, ok := page["prev_cursor"].(string); ok {
+			links["prev"] = link("before", cursor)
+		}
+		if cursor, ok := page["next_cursor"].(string); ok {
+			links["next"] = link("after", cursor)
+		}
+		return links
+	}
+
+	//按偏移分页，总数精确时按总数判断是否有下一页，否则按当前页是否满了判断
+	offset := usr_pack.Offset
+	links["first"] = link("offset", "0")
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links["prev"] = link("offset", strconv.Itoa(prev))
+	}
+	if (exact && offset+limit < total) || (!exact && size == limit) {
+		links["next"] = link("offset", strconv.Itoa(offset+limit))
+	}
+	if exact && total > 0 {
+		links["last"] = link("offset", strconv.Itoa((total-1)/limit*limit))
+	}
+	return links
+}
+
+/*
+ *  Description:   获取一页用户，多取一条判断翻页的方向上是否还有用户，并生成游标
+ *                 按 offset 分页或没有 limit 时不生成游标
+ *  Param         :  usr_pack 查询包, usr_list 返回的用户列表, fetch 获取用户的方法
+ *  Return        :   gin.H 响应体, object 为用户列表，有下一页/上一页时带 next_cursor/prev_cursor
+ */
+func fetchPage(usr_pack *USER.UserQueryPack, usr_list *USER.UserList,
+	fetch func(*USER.UserList, *USER.UserQueryPack) error) (gin.H, error) {
+	page := gin.H{"object": usr_list}
+	cursor := usr_pack.Cursor
+	if cursor == nil && (usr_pack.Limit == -1 || usr_pack.Offset != -1) {
+		return page, fetch(usr_list, usr_pack)
+	}
+
+	limit := usr_pack.Limit
+	if limit != -1 {
+		usr_pack.Limit++
+	}
+	err := fetch(usr_list, usr_pack)
+	usr_pack.Limit = limit
+	if err != nil {
+		return nil, err
+	}
+
+	//多取的一条在翻页方向的末尾
+	more := limit != -1 && len(*usr_list) > limit
+	backward := cursor != nil && cursor.Before
+	if more && backward {
+		*usr_list = (*usr_list)[1:]
+	} else if more {
+		*usr_list = (*usr_list)[:limit]
+	}
+
+	//游标之后(或之前)没有用户时，用原来的游标回到另一个方向
+	list := *usr_list
+	if len(list) == 0 {
+		if backward {
+			page["next_cursor"] = cursor.String()
+		} else if cursor != nil {
+			page["prev_cursor"] = cursor.String()
+		}
+		return page, nil
+	}
+
+	if more || backward {
+		page["next_cursor"] = USER.EncodeCursor(usr_pack.Sorting(), &list[len(list)-1])
+	}
+	if (more && backward) || (cursor != nil && !backward) {
+		page["prev_cursor"] = USER.EncodeCursor(usr_pack.Sorting(), &list[0])
+	}
+	return page, nil
+}
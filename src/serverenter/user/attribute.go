@@ -0,0 +1,343 @@
+/*
+ 用户自定义属性，管理员在运行时定义属性的名字，类型和校验规则，每个用户可以保存这些属性的值
+ 1. 类型有 string, int, bool, date, enum, 值在程序中分别为 string, int64, bool, string(YYYY-MM-DD), string
+ 2. 值在存储中统一编码为字符串，读取时按定义的类型解码
+ 3. 修改校验规则不会重新校验已经保存的值
+*/
+package USER
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+//属性类型
+const (
+	ATTR_STRING = "string"
+	ATTR_INT    = "int"
+	ATTR_BOOL   = "bool"
+	ATTR_DATE   = "date"
+	ATTR_ENUM   = "enum"
+)
+
+var (
+	ErrAttributeNotFound = errors.New("属性定义不存在")
+	ErrAttributeExists   = errors.New("属性定义已经存在")
+)
+
+//属性值编码后的最大长度，与 user_attribute.value 列一致
+const MAX_ATTRIBUTE_LENGTH = 1024
+
+var attribute_name = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+//属性的值无效
+type AttributeError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+func (err *AttributeError) Error() string {
+	return "属性 " + err.Name + " " + err.Message
+}
+
+//校验规则，只有与类型相关的规则有效
+type AttributeRules struct {
+	MaxLength int      `json:"max_length,omitempty"` //string 的最大长度(字符数)，0 表示不限制
+	Pattern   string   `json:"pattern,omitempty"`    //string 必须匹配的正则表达式
+	Min       *int64   `json:"min,omitempty"`        //int 的最小值
+	Max       *int64   `json:"max,omitempty"`        //int 的最大值
+	Values    []string `json:"values,omitempty"`     //enum 允许的值
+}
+
+//属性定义，存入数据库中的结构
+type AttributeDefinition struct {
+	ID    int            `gorm:"primary_key" json:"id"`
+	Name  string         `json:"name"`
+	Type  string         `json:"type"`
+	Rules AttributeRules `sql:"-" json:"rules"`
+
+	//Rules 在数据库中以json保存
+	RulesJSON string `gorm:"column:rules" sql:"type:text" json:"-"`
+}
+
+/*
+ *  Description:    初始化数据库中的表名
+ *   Returns      :   返回数据库中的表名字符串
+ */
+func (def AttributeDefinition) TableName() string {
+	return "attribute_definition"
+}
+
+/*
+ *  Description:    检查属性定义的名字，类型和规则是否有效
+ */
+func (def *AttributeDefinition) Check() error {
+	if !attribute_name.MatchString(def.Name) {
+		return errors.New("属性名只能包含小写字母，数字和下划线，以字母开头，最长64个字符")
+	}
+
+	rules := def.Rules
+	switch def.Type {
+	case ATTR_STRING:
+		if rules.MaxLength < 0 {
+			return errors.New("max_length 不能小于0")
+		}
+		if _, err := regexp.Compile(rules.Pattern); err != nil {
+			return fmt.Errorf("pattern 无效: %v", err)
+		}
+	case ATTR_INT:
+		if rules.Min != nil && rules.Max != nil && *rules.Min > *rules.Max {
+			return errors.New("min 不能大于 max")
+		}
+	case ATTR_ENUM:
+		if len(rules.Values) == 0 {
+			return errors.New("enum 类型必须指定 values")
+		}
+	case ATTR_BOOL, ATTR_DATE:
+	default:
+		return fmt.Errorf("未知的属性类型 %q，允许的类型: string, int, bool, date, enum", def.Type)
+	}
+
+	//与类型无关的规则不允许设置，避免误以为生效
+	if def.Type != ATTR_STRING && (rules.MaxLength != 0 || rules.Pattern != "") {
+		return errors.New("max_length 和 pattern 只能用于 string 类型")
+	}
+	if def.Type != ATTR_INT && (rules.Min != nil || rules.Max != nil) {
+		return errors.New("min 和 max 只能用于 int 类型")
+	}
+	if def.Type != ATTR_ENUM && len(rules.Values) != 0 {
+		return errors.New("values 只能用于 enum 类型")
+	}
+	return nil
+}
+
+/*
+ *  Description:    校验属性值并转换成该类型在程序中的值
+ *  Params       :   value 输入的值，可以是字符串(查询参数)或json解码后的值
+ *   Returns      :   interface{} 转换后的值， error 无效时返回 *AttributeError
+ */
+func (def *AttributeDefinition) Validate(value interface{}) (interface{}, error) {
+	invalid := func(format string, args ...interface{}) (interface{}, error) {
+		return nil, &AttributeError{Name: def.Name, Message: fmt.Sprintf(format, args...)}
+	}
+
+	switch def.Type {
+	case ATTR_INT:
+		var n int64
+		switch v := value.(type) {
+		case string:
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return invalid("必须是整数")
+			}
+			n = parsed
+		case float64:
+			if v != math.Trunc(v) || math.Abs(v) > 1<<53 {
+				return invalid("必须是整数")
+			}
+			n = int64(v)
+		case int64:
+			n = v
+		case int:
+			n = int64(v)
+		default:
+			return invalid("必须是整数")
+		}
+		if def.Rules.Min != nil && n < *def.Rules.Min {
+			return invalid("不能小于 %d", *def.Rules.Min)
+		}
+		if def.Rules.Max != nil && n > *def.Rules.Max {
+			return invalid("不能大于 %d", *def.Rules.Max)
+		}
+		return n, nil
+	case ATTR_BOOL:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return invalid("必须是 true 或 false")
+	}
+
+	str, ok := value.(string)
+	if !ok || str == "" {
+		return invalid("必须是非空字符串")
+	}
+	switch def.Type {
+	case ATTR_STRING:
+		if utf8.RuneCountInString(str) > MAX_ATTRIBUTE_LENGTH {
+			return invalid("长度不能超过 %d", MAX_ATTRIBUTE_LENGTH)
+		}
+		if def.Rules.MaxLength > 0 && utf8.RuneCountInString(str) > def.Rules.MaxLength {
+			return invalid("长度不能超过 %d", def.Rules.MaxLength)
+		}
+		if def.Rules.Pattern != "" && !regexp.MustCompile(def.Rules.Pattern).MatchString(str) {
+			return invalid("必须匹配 %s", def.Rules.Pattern)
+		}
+		return str, nil
+	case ATTR_DATE:
+		date, err := ParseDate(str)
+		if err != nil {
+			return invalid("必须是 YYYY-MM-DD 格式的日期")
+		}
+		return string(date), nil
+	case ATTR_ENUM:
+		for _, allowed := range def.Rules.Values {
+			if str == allowed {
+				return str, nil
+			}
+		}
+		return invalid("必须是 %v 中的一个", def.Rules.Values)
+	}
+	return invalid("的类型 %s 未知", def.Type)
+}
+
+/*
+ *  Description:    把存储中编码后的字符串解码成该类型在程序中的值
+ */
+func (def *AttributeDefinition) decode(value string) (interface{}, error) {
+	switch def.Type {
+	case ATTR_INT:
+		return strconv.ParseInt(value, 10, 64)
+	case ATTR_BOOL:
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+/*
+ *  Description:    把 Rules 编码成json, 存入数据库前调用
+ */
+func (def *AttributeDefinition) encode() error {
+	rules, err := json.Marshal(def.Rules)
+	if err != nil {
+		return err
+	}
+	def.RulesJSON = string(rules)
+	return nil
+}
+
+/*
+ *  Description:    从json解码 Rules, 从数据库读出后调用
+ */
+func (def *AttributeDefinition) decodeRules() error {
+	if def.RulesJSON == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(def.RulesJSON), &def.Rules)
+}
+
+/*
+ *  Description:    把属性值编码成存储中的字符串，值必须已经通过 Validate
+ */
+func EncodeAttribute(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+//用户的属性值，属性名 -> 值，值为 nil 表示删除该属性(只用于修改)
+type Attributes map[string]interface{}
+
+/*
+ *  Description:    按名字排序的属性名，用于生成稳定的查询条件
+ */
+func (attrs Attributes) names() []string {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//全部属性定义
+type AttributeDefinitions []AttributeDefinition
+
+/*
+ *  Description:    按名字查找属性定义
+ */
+func (defs AttributeDefinitions) Find(name string) *AttributeDefinition {
+	for i := range defs {
+		if defs[i].Name == name {
+			return &defs[i]
+		}
+	}
+	return nil
+}
+
+/*
+ *  Description:    校验并转换全部属性值，值为 nil 时保留(表示删除)
+ *   Returns      :   Attributes 转换后的值， error 属性没有定义或值无效时返回 *AttributeError
+ */
+func (defs AttributeDefinitions) Normalize(attrs Attributes) (Attributes, error) {
+	if len(attrs) == 0 {
+		return nil, nil
+	}
+	result := make(Attributes, len(attrs))
+	for _, name := range attrs.names() {
+		def := defs.Find(name)
+		if def == nil {
+			return nil, &AttributeError{Name: name, Message: "没有定义"}
+		}
+		if attrs[name] == nil {
+			result[name] = nil
+			continue
+		}
+		value, err := def.Validate(attrs[name])
+		if err != nil {
+			return nil, err
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+/*
+ *  Description:    把存储中的属性值按定义解码，没有定义或解码失败的值忽略
+ */
+func (defs AttributeDefinitions) decode(raw map[string]string) Attributes {
+	if len(raw) == 0 {
+		return nil
+	}
+	attrs := make(Attributes, len(raw))
+	for name, value := range raw {
+		def := defs.Find(name)
+		if def == nil {
+			continue
+		}
+		if decoded, err := def.decode(value); err == nil {
+			attrs[name] = decoded
+		}
+	}
+	return attrs
+}
+
+//属性定义和属性值的存储
+type AttributeStore interface {
+	//增加属性定义，名字重复时返回 ErrAttributeExists
+	AddDefinition(def *AttributeDefinition) error
+	//按名字修改属性定义的规则，类型不能修改，不存在时返回 ErrAttributeNotFound
+	UpdateDefinition(def *AttributeDefinition) error
+	//按名字删除属性定义和全部用户的该属性值，不存在时返回 ErrAttributeNotFound
+	DeleteDefinition(name string) error
+	//获取全部属性定义，按ID排序
+	FetchDefinitions() (AttributeDefinitions, error)
+	//设置用户的属性值，值为 nil 时删除该属性，值必须已经通过 Validate
+	SetAttributes(user_id int, attrs Attributes) error
+	//获取用户的属性值，返回 用户ID -> 属性名 -> 编码后的值
+	FetchAttributes(user_ids []int) (map[int]map[string]string, error)
+}
@@ -0,0 +1,294 @@
+/*
+ 带自定义属性的用户存储，包装一个 UserStore
+ 1. 增加，修改用户后保存 User.Attributes 中的属性值
+ 2. 查询用户后按属性定义加载属性值，查询包只选择了用户字段时不加载
+ 属性值与用户字段在同一个事务中保存
+*/
+package USER
+
+type AttributedStore struct {
+	UserStore
+}
+
+/*
+ *  Description:    创建带自定义属性的用户存储
+ *  Params       :   store 被包装的用户存储
+ */
+func WithAttributes(store UserStore) *AttributedStore {
+	return &AttributedStore{UserStore: store}
+}
+
+func (store *AttributedStore) AddUser(usr *User) error {
+	attrs := usr.Attributes
+	return store.transaction(func(tx *AttributedStore) error {
+		if err := tx.UserStore.AddUser(usr); err != nil {
+			return err
+		}
+		return tx.save(usr, attrs)
+	})
+}
+
+func (store *AttributedStore) UpdateUsers(usr *User, low, high int) error {
+	attrs := usr.Attributes
+	return store.transaction(func(tx *AttributedStore) error {
+		if err := tx.UserStore.UpdateUsers(usr, low, high); err != nil || len(attrs) == 0 {
+			return err
+		}
+
+		//更新的条件只有ID和ID范围，用同样的条件获取被更新的用户
+		usr_list := UserList{}
+		u_pack := &UserQueryPack{Usr: User{ID: usr.ID}, Offset: -1, Limit: -1, IDRange: Range{low, high}}
+		if err := tx.UserStore.FetchUsers(&usr_list, u_pack); err != nil {
+			return err
+		}
+		for _, updated := range usr_list {
+			if err := tx.SetAttributes(updated.ID, attrs); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *AttributedStore) UpdateUser(usr *User, version int) error {
+	attrs := usr.Attributes
+	return store.transaction(func(tx *AttributedStore) error {
+		if err := tx.UserStore.UpdateUser(usr, version); err != nil {
+			return err
+		}
+		return tx.save(usr, attrs)
+	})
+}
+
+func (store *AttributedStore) ReplaceUser(usr *User, version int) error {
+	defs, err := store.FetchDefinitions()
+	if err != nil {
+		return err
+	}
+	//没有的属性也要写入(删除)
+	attrs := make(Attributes, len(defs))
+	for _, def := range defs {
+		attrs[def.Name] = usr.Attributes[def.Name]
+	}
+
+	return store.transaction(func(tx *AttributedStore) error {
+		if err := tx.UserStore.ReplaceUser(usr, version); err != nil {
+			return err
+		}
+		return tx.save(usr, attrs)
+	})
+}
+
+func (store *AttributedStore) PurgeUser(id, version int) error {
+	return store.transaction(func(tx *AttributedStore) error {
+		if err := tx.UserStore.PurgeUser(id, version); err != nil {
+			return err
+		}
+
+		raw, err := tx.FetchAttributes([]int{id})
+		if err != nil {
+			return err
+		}
+		attrs := Attributes{}
+		for name := range raw[id] {
+			attrs[name] = nil
+		}
+		return tx.SetAttributes(id, attrs)
+	})
+}
+
+/*
+ *  Description:    在事务中执行 fn, 用户字段和属性值在同一个事务中保存，见 inTransaction
+ */
+func (store *AttributedStore) transaction(fn func(tx *AttributedStore) error) error {
+	return inTransaction(store.UserStore, func(tx UserStore) error {
+		return fn(WithAttributes(tx))
+	})
+}
+
+func (store *AttributedStore) FetchUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	if err := store.UserStore.FetchUsers(usr_list, u_pack); err != nil || !u_pack.Fields.wantsAttributes() {
+		return err
+	}
+	return store.load(*usr_list)
+}
+
+func (store *AttributedStore) FetchDeletedUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	if err := store.UserStore.FetchDeletedUsers(usr_list, u_pack); err != nil || !u_pack.Fields.wantsAttributes() {
+		return err
+	}
+	return store.load(*usr_list)
+}
+
+func (store *AttributedStore) ExportUsers(u_pack *UserQueryPack, each func(usr *User) error) error {
+	if !u_pack.Fields.wantsAttributes() {
+		return store.UserStore.ExportUsers(u_pack, each)
+	}
+
+	//每 EXPORT_CHUNK_SIZE 个用户加载一次属性值
+	chunk := make(UserList, 0, EXPORT_CHUNK_SIZE)
+	flush := func() error {
+		if err := store.load(chunk); err != nil {
+			return err
+		}
+		for i := range chunk {
+			if err := each(&chunk[i]); err != nil {
+				return err
+			}
+		}
+		chunk = chunk[:0]
+		return nil
+	}
+	err := store.UserStore.ExportUsers(u_pack, func(usr *User) error {
+		chunk = append(chunk, *usr)
+		if len(chunk) < EXPORT_CHUNK_SIZE {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (store *AttributedStore) BeginTx() (UserTx, error) {
+	tx, err := store.UserStore.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	return &attributedTx{AttributedStore: WithAttributes(tx), tx: tx}, nil
+}
+
+//带自定义属性的事务，属性值与用户字段在同一个事务中保存
+type attributedTx struct {
+	*AttributedStore
+	tx UserTx
+}
+
+func (tx *attributedTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *attributedTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+func (store *AttributedStore) BeginImport(upsert string, atomic bool) (UserImporter, error) {
+	imp, err := store.UserStore.BeginImport(upsert, atomic)
+	if err != nil {
+		return nil, err
+	}
+	//属性值与用户在同一个事务中保存
+	imp.OnBatch(func(tx UserStore, usr_list UserList, results []ImportedUser) error {
+		return WithAttributes(tx).importAttributes(usr_list, results)
+	})
+	return imp, nil
+}
+
+/*
+ *  Description:    保存导入的一批用户的属性值，results 中的用户带上写入后的全部属性值
+ *  Params       :   usr_list 导入的这一批用户, results 每一行写入的结果
+ */
+func (store *AttributedStore) importAttributes(usr_list UserList, results []ImportedUser) error {
+	//加载被更新的用户已有的属性值，写入后的属性值为已有的合并导入的
+	befores := UserList{}
+	for _, result := range results {
+		if result.Err == nil && result.Before != nil {
+			befores = append(befores, *result.Before)
+		}
+	}
+	if err := store.load(befores); err != nil {
+		return err
+	}
+	loaded := make(map[int]Attributes, len(befores))
+	for _, before := range befores {
+		loaded[before.ID] = before.Attributes
+	}
+
+	for i := range results {
+		result := &results[i]
+		if result.Err != nil {
+			continue
+		}
+		var old Attributes
+		if result.Before != nil {
+			result.Before.Attributes = loaded[result.Before.ID]
+			old = result.Before.Attributes
+		}
+		if attrs := mergeAttributes(old, usr_list[i].Attributes); attrs != nil {
+			result.User.Attributes = attrs
+		}
+		if len(usr_list[i].Attributes) != 0 {
+			if err := store.SetAttributes(result.User.ID, usr_list[i].Attributes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ *  Description:    保存单个用户的属性值，再加载保存后的全部属性值
+ */
+func (store *AttributedStore) save(usr *User, attrs Attributes) error {
+	if len(attrs) != 0 {
+		if err := store.SetAttributes(usr.ID, attrs); err != nil {
+			return err
+		}
+	}
+	usr_list := UserList{*usr}
+	if err := store.load(usr_list); err != nil {
+		return err
+	}
+	usr.Attributes = usr_list[0].Attributes
+	return nil
+}
+
+/*
+ *  Description:    加载用户列表中每个用户的属性值
+ */
+func (store *AttributedStore) load(usr_list UserList) error {
+	if len(usr_list) == 0 {
+		return nil
+	}
+	ids := make([]int, len(usr_list))
+	for i := range usr_list {
+		ids[i] = usr_list[i].ID
+	}
+
+	defs, err := store.FetchDefinitions()
+	if err != nil {
+		return err
+	}
+	raw, err := store.FetchAttributes(ids)
+	if err != nil {
+		return err
+	}
+	for i := range usr_list {
+		usr_list[i].Attributes = defs.decode(raw[usr_list[i].ID])
+	}
+	return nil
+}
+
+/*
+ *  Description:    已有的属性值合并写入的属性值，值为 nil 的属性被删除，不修改 old
+ *   Returns      :   合并后的属性值，没有属性时返回 nil
+ */
+func mergeAttributes(old, values Attributes) Attributes {
+	attrs := Attributes{}
+	for name, value := range old {
+		attrs[name] = value
+	}
+	for name, value := range values {
+		if value == nil {
+			delete(attrs, name)
+		} else {
+			attrs[name] = value
+		}
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	return attrs
+}
@@ -0,0 +1,241 @@
+/*
+ 带修改历史的用户存储，包装一个 UserStore, 在每次增加，修改，删除成功后记录修改历史
+ 修改和修改历史在同一个事务中保存
+*/
+package USER
+
+import (
+	"time"
+)
+
+//操作人信息
+type Operator struct {
+	Name     string
+	ClientIP string
+}
+
+type AuditedStore struct {
+	UserStore
+	operator Operator
+}
+
+/*
+ *  Description:    创建带修改历史的用户存储，每个请求使用自己的操作人创建一个
+ *  Params       :   store 被包装的用户存储, operator 操作人
+ */
+func Audited(store UserStore, operator Operator) *AuditedStore {
+	return &AuditedStore{UserStore: store, operator: operator}
+}
+
+func (store *AuditedStore) AddUser(usr *User) error {
+	return store.transaction(func(tx *AuditedStore) error {
+		if err := tx.UserStore.AddUser(usr); err != nil {
+			return err
+		}
+		return tx.record(ACTION_ADD, nil, UserList{*usr})
+	})
+}
+
+func (store *AuditedStore) UpdateUsers(usr *User, low, high int) error {
+	u_pack := &UserQueryPack{Usr: User{ID: usr.ID}, Offset: -1, Limit: -1, IDRange: Range{low, high}}
+	return store.transaction(func(tx *AuditedStore) error {
+		before := UserList{}
+		if err := tx.FetchUsers(&before, u_pack); err != nil {
+			return err
+		}
+
+		if err := tx.UserStore.UpdateUsers(usr, low, high); err != nil {
+			return err
+		}
+
+		//更新的条件只有ID和ID范围，更新后用同样的条件获取新的数据
+		after := UserList{}
+		if err := tx.FetchUsers(&after, u_pack); err != nil {
+			return err
+		}
+		return tx.record(ACTION_UPDATE, before, after)
+	})
+}
+
+func (store *AuditedStore) UpdateUser(usr *User, version int) error {
+	return store.updateOne(ACTION_UPDATE, usr, version, UserStore.UpdateUser)
+}
+
+func (store *AuditedStore) ReplaceUser(usr *User, version int) error {
+	return store.updateOne(ACTION_REVERT, usr, version, UserStore.ReplaceUser)
+}
+
+func (store *AuditedStore) DeleteUsers(usr *User, low, high int) error {
+	return store.transaction(func(tx *AuditedStore) error {
+		before := UserList{}
+		if err := tx.FetchUsers(&before, &UserQueryPack{Usr: *usr, Offset: -1, Limit: -1, IDRange: Range{low, high}}); err != nil {
+			return err
+		}
+
+		if err := tx.UserStore.DeleteUsers(usr, low, high); err != nil {
+			return err
+		}
+		return tx.record(ACTION_DELETE, before, nil)
+	})
+}
+
+func (store *AuditedStore) DeleteUser(id, version int) error {
+	return store.transaction(func(tx *AuditedStore) error {
+		before, err := tx.get(id, false)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.UserStore.DeleteUser(id, version); err != nil {
+			return err
+		}
+		return tx.record(ACTION_DELETE, before, nil)
+	})
+}
+
+func (store *AuditedStore) RestoreUser(id int) error {
+	return store.transaction(func(tx *AuditedStore) error {
+		if err := tx.UserStore.RestoreUser(id); err != nil {
+			return err
+		}
+
+		after, err := tx.get(id, false)
+		if err != nil {
+			return err
+		}
+		//恢复不修改字段，只记录操作
+		return tx.record(ACTION_RESTORE, after, after)
+	})
+}
+
+func (store *AuditedStore) PurgeUser(id, version int) error {
+	return store.transaction(func(tx *AuditedStore) error {
+		before, err := tx.get(id, true)
+		if err != nil {
+			return err
+		}
+
+		if err := tx.UserStore.PurgeUser(id, version); err != nil {
+			return err
+		}
+		return tx.record(ACTION_PURGE, before, nil)
+	})
+}
+
+func (store *AuditedStore) BeginImport(upsert string, atomic bool) (UserImporter, error) {
+	imp, err := store.UserStore.BeginImport(upsert, atomic)
+	if err != nil {
+		return nil, err
+	}
+	//修改历史与用户在同一个事务中保存
+	imp.OnBatch(func(tx UserStore, usr_list UserList, results []ImportedUser) error {
+		return tx.AddHistory(store.importHistory(results))
+	})
+	return imp, nil
+}
+
+/*
+ *  Description:    导入的每个写入的行的修改历史
+ *  Params       :   results 每一行写入的结果
+ */
+func (store *AuditedStore) importHistory(results []ImportedUser) []History {
+	//同一个用户在一次导入中可能被更新多次，每一行与自己更新前的数据比较
+	now := time.Now()
+	entries := []History{}
+	for _, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		before := User{}
+		if result.Before != nil {
+			before = *result.Before
+		}
+		entries = append(entries, store.newHistory(ACTION_IMPORT, now, result.User, DiffUser(&before, &result.User)))
+	}
+	return entries
+}
+
+/*
+ *  Description:    按ID更新单个用户并记录修改历史
+ */
+func (store *AuditedStore) updateOne(action string, usr *User, version int, update func(UserStore, *User, int) error) error {
+	return store.transaction(func(tx *AuditedStore) error {
+		before, err := tx.get(usr.ID, false)
+		if err != nil {
+			return err
+		}
+
+		if err := update(tx.UserStore, usr, version); err != nil {
+			return err
+		}
+		return tx.record(action, before, UserList{*usr})
+	})
+}
+
+/*
+ *  Description:    在事务中执行 fn, 修改前数据的读取，修改和修改历史的写入在同一个事务中，见 inTransaction
+ */
+func (store *AuditedStore) transaction(fn func(tx *AuditedStore) error) error {
+	return inTransaction(store.UserStore, func(tx UserStore) error {
+		return fn(Audited(tx, store.operator))
+	})
+}
+
+/*
+ *  Description:    按ID获取单个用户
+ *  Params       :   id 用户ID, unscoped 是否包括软删除的用户
+ *   Returns      :   只包含该用户的列表，用户不存在时为空列表
+ */
+func (store *AuditedStore) get(id int, unscoped bool) (UserList, error) {
+	u_pack := &UserQueryPack{Usr: User{ID: id}, Offset: -1, Limit: -1, IDRange: Range{-1, -1}}
+	usr_list := UserList{}
+	if err := store.FetchUsers(&usr_list, u_pack); err != nil || len(usr_list) != 0 || !unscoped {
+		return usr_list, err
+	}
+	err := store.FetchDeletedUsers(&usr_list, u_pack)
+	return usr_list, err
+}
+
+/*
+ *  Description:    根据操作前后的用户列表，为每个用户生成一条修改历史
+ *                  before 中没有的用户视为新增，after 为 nil 时视为删除
+ *   Returns      :   记录失败时返回错误，调用方回滚事务，用户的修改不会生效
+ */
+func (store *AuditedStore) record(action string, before, after UserList) error {
+	befores := make(map[int]User, len(before))
+	for _, usr := range before {
+		befores[usr.ID] = usr
+	}
+
+	now := time.Now()
+	entries := []History{}
+	if after == nil {
+		//删除，字段变为空，快照为删除前的数据
+		for _, old := range before {
+			entries = append(entries, store.newHistory(action, now, old, DiffUser(&old, &User{})))
+		}
+	} else {
+		for _, usr := range after {
+			old := befores[usr.ID]
+			entries = append(entries, store.newHistory(action, now, usr, DiffUser(&old, &usr)))
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+	return store.AddHistory(entries)
+}
+
+func (store *AuditedStore) newHistory(action string, now time.Time, snapshot User, changes map[string]FieldChange) History {
+	return History{
+		UserID:    snapshot.ID,
+		Version:   snapshot.Version,
+		Action:    action,
+		Operator:  store.operator.Name,
+		ClientIP:  store.operator.ClientIP,
+		CreatedAt: now,
+		Changes:   changes,
+		Snapshot:  snapshot,
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ 用户生日，数据库中保存为 DATE, 程序中统一为 YYYY-MM-DD 格式的字符串，空字符串表示没有填写
+*/
+package USER
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const DATE_LAYOUT = "2006-01-02"
+
+var ErrBadDate = errors.New("日期格式错误，应为 YYYY-MM-DD")
+
+//日期，格式为 YYYY-MM-DD
+type Date string
+
+//兼容历史数据中的日期格式：1990-01-02, 1990/1/2, 1990.1.2, 90-01-02, 19900102
+var date_pattern = regexp.MustCompile(`^(\d{2}|\d{4})[-/.](\d{1,2})[-/.](\d{1,2})$|^(\d{4})(\d{2})(\d{2})$`)
+
+/*
+ *  Description:    解析日期，兼容多种历史格式，两位年份不晚于今年时视为20xx, 否则视为19xx
+ *   Returns      :   Date 规范化后的日期， error 无法解析时返回 ErrBadDate
+ */
+func ParseDate(value string) (Date, error) {
+	match := date_pattern.FindStringSubmatch(value)
+	if match == nil {
+		return "", ErrBadDate
+	}
+	parts := match[1:4]
+	if match[1] == "" {
+		parts = match[4:7]
+	}
+
+	year, _ := strconv.Atoi(parts[0])
+	month, _ := strconv.Atoi(parts[1])
+	day, _ := strconv.Atoi(parts[2])
+	if len(parts[0]) == 2 {
+		century := time.Now().Year() / 100 * 100
+		if year += century; year > time.Now().Year() {
+			year -= 100
+		}
+	}
+
+	t := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	//2月30日之类的日期会被 time.Date 顺延，这里视为错误
+	if t.Year() != year || int(t.Month()) != month || t.Day() != day {
+		return "", ErrBadDate
+	}
+	return Date(t.Format(DATE_LAYOUT)), nil
+}
+
+/*
+ *  Description:    解析并校验用户输入的生日，不能晚于今天
+ *  Params       :   value 输入的生日, loc 计算今天使用的时区
+ */
+func ParseBirthday(value string, loc *time.Location) (Date, error) {
+	date, err := ParseDate(value)
+	if err != nil {
+		return "", err
+	}
+	if date > DateOf(time.Now().In(loc)) {
+		return "", fmt.Errorf("生日 %s 晚于今天", date)
+	}
+	return date, nil
+}
+
+/*
+ *  Description:    获取时间所在的日期
+ */
+func DateOf(t time.Time) Date {
+	return Date(t.Format(DATE_LAYOUT))
+}
+
+/*
+ *  Description:    日期加减天数
+ */
+func (d Date) AddDays(days int) Date {
+	t, err := time.Parse(DATE_LAYOUT, string(d))
+	if err != nil {
+		return d
+	}
+	return DateOf(t.AddDate(0, 0, days))
+}
+
+func (d Date) Value() (driver.Value, error) {
+	if d == "" {
+		return nil, nil
+	}
+	return string(d), nil
+}
+
+func (d *Date) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*d = ""
+	case time.Time:
+		*d = DateOf(v)
+	case []byte:
+		*d = Date(v)
+	case string:
+		*d = Date(v)
+	default:
+		return fmt.Errorf("无法把 %T 转换成日期", value)
+	}
+	return nil
+}
+
+//日期范围 [From, To], 空表示不限制
+type DateRange struct {
+	From Date
+	To   Date
+}
+
+/*
+ *  Description:    判断日期是否在范围内，空日期不在任何有限制的范围内
+ */
+func (r DateRange) Contains(d Date) bool {
+	if r.From == "" && r.To == "" {
+		return true
+	}
+	return d != "" && (r.From == "" || d >= r.From) && (r.To == "" || d <= r.To)
+}
+
+/*
+ *  Description:    与另一个范围求交集
+ */
+func (r DateRange) Intersect(other DateRange) DateRange {
+	if other.From != "" && (r.From == "" || other.From > r.From) {
+		r.From = other.From
+	}
+	if other.To != "" && (r.To == "" || other.To < r.To) {
+		r.To = other.To
+	}
+	return r
+}
+
+/*
+ *  Description:    把年龄范围转换成生日范围
+ *  Params       :   today 今天(按配置的时区计算), min_age/max_age 年龄范围, -1 表示不限制
+ */
+func AgeRange(today time.Time, min_age, max_age int) DateRange {
+	r := DateRange{}
+	//年龄不小于 min_age: 生日不晚于 min_age 年前的今天
+	if min_age >= 0 {
+		r.To = yearsBefore(today, min_age)
+	}
+	//年龄不大于 max_age: 生日晚于 max_age+1 年前的今天
+	if max_age >= 0 {
+		r.From = yearsBefore(today, max_age+1).AddDays(1)
+	}
+	return r
+}
+
+/*
+ *  Description:    获取 years 年前的同一天，该月没有这一天时(2月29日)取该月最后一天
+ */
+func yearsBefore(today time.Time, years int) Date {
+	year, month, day := today.Date()
+	last_day := time.Date(year-years, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	if day > last_day {
+		day = last_day
+	}
+	return DateOf(time.Date(year-years, month, day, 0, 0, 0, 0, time.UTC))
+}
@@ -0,0 +1,490 @@
+/*
+ 带 memcache 缓存的用户存储，包装一个 UserStore
+ 1. 只缓存按ID查询单个用户(GET /user/:id)，缓存完整的用户(包括自定义属性)，查询不到的用户不缓存
+ 2. key 为 <前缀>:v<版本>:user:<ID>，修改版本后旧的缓存全部失效
+ 3. 通过这个存储增加，修改，删除用户后删除受影响的用户的缓存，批量修改先查出受影响的用户ID
+    删除属性定义等影响全部用户的操作增加代数(<前缀>:v<版本>:gen)，代数不同的缓存视为失效
+ 4. 事务和 atomic 导入中不读写缓存，提交后才删除受影响的缓存
+ 5. memcache 出错时当作没有命中，直接访问存储，删除缓存失败时缓存在 TTL 后过期
+ 6. 删除缓存写入 CACHE_TOMBSTONE_TTL 秒的墓碑，没有命中后写回时 key 不存在用 add, 已经存在用 cas,
+    删除前读到旧数据的请求写回时因为墓碑失败，不会覆盖删除；墓碑过期前不写入缓存
+*/
+package USER
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"third/gomemcache/memcache"
+	"time"
+)
+
+const (
+	DEFAULT_CACHE_TTL    = 300       //默认缓存的秒数
+	DEFAULT_CACHE_PREFIX = "usermgr" //默认 key 的前缀
+	CACHE_TOMBSTONE_TTL  = 10        //墓碑的秒数，应大于没有命中时读取存储并写回的时间
+)
+
+//删除缓存后写入的墓碑，不是有效的 json
+var cache_tombstone = []byte("-")
+
+//缓存使用的 memcache 操作，*memcache.Client 实现了这个接口
+type CacheClient interface {
+	GetMulti(keys []string) (map[string]*memcache.Item, error)
+	Set(item *memcache.Item) error
+	Add(item *memcache.Item) error
+	CompareAndSwap(item *memcache.Item) error
+	Increment(key string, delta uint64) (uint64, error)
+}
+
+//缓存的配置
+type CacheOptions struct {
+	TTL     int    //缓存的秒数，0 使用默认值
+	Prefix  string //key 的前缀，空使用默认值
+	Version int    //key 的版本，缓存的内容格式变化时修改
+}
+
+//缓存的计数
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`          //命中
+	Misses        uint64 `json:"misses"`        //没有命中，从存储读取
+	Bypasses      uint64 `json:"bypasses"`      //请求要求不读缓存
+	Errors        uint64 `json:"errors"`        //memcache 出错
+	Invalidations uint64 `json:"invalidations"` //删除缓存或增加代数的次数
+}
+
+type CachedStore struct {
+	UserStore
+	client  CacheClient
+	options CacheOptions
+	stats   *CacheStats //多个视图共用，原子访问
+
+	bypass  bool               //不读缓存，从存储读取后刷新缓存
+	pending *cacheInvalidation //事务中等待提交后删除的缓存，nil 表示不在事务中
+}
+
+//等待删除的缓存
+type cacheInvalidation struct {
+	ids map[int]bool
+	all bool
+}
+
+//缓存的内容
+type cacheEntry struct {
+	Gen  uint64 //写入时的代数
+	User User
+}
+
+/*
+ *  Description:    创建带缓存的用户存储
+ *  Params       :   store 被包装的用户存储, client memcache 客户端, options 缓存的配置
+ */
+func WithCache(store UserStore, client CacheClient, options CacheOptions) *CachedStore {
+	if options.TTL <= 0 {
+		options.TTL = DEFAULT_CACHE_TTL
+	}
+	if options.Prefix == "" {
+		options.Prefix = DEFAULT_CACHE_PREFIX
+	}
+	return &CachedStore{UserStore: store, client: client, options: options, stats: &CacheStats{}}
+}
+
+/*
+ *  Description:    不读缓存的视图，从存储读取后刷新缓存，计数与原存储共用
+ */
+func (store *CachedStore) Bypass() *CachedStore {
+	view := *store
+	view.bypass = true
+	return &view
+}
+
+/*
+ *  Description:    当前的计数
+ */
+func (store *CachedStore) Stats() CacheStats {
+	return CacheStats{
+		Hits:          atomic.LoadUint64(&store.stats.Hits),
+		Misses:        atomic.LoadUint64(&store.stats.Misses),
+		Bypasses:      atomic.LoadUint64(&store.stats.Bypasses),
+		Errors:        atomic.LoadUint64(&store.stats.Errors),
+		Invalidations: atomic.LoadUint64(&store.stats.Invalidations),
+	}
+}
+
+func (store *CachedStore) userKey(id int) string {
+	return fmt.Sprintf("%s:v%d:user:%d", store.options.Prefix, store.options.Version, id)
+}
+
+func (store *CachedStore) genKey() string {
+	return fmt.Sprintf("%s:v%d:gen", store.options.Prefix, store.options.Version)
+}
+
+/*
+ *  Description:    查询包是否只按ID查询单个用户，只有这种查询使用缓存
+ *   Returns      :   int 用户ID，不能使用缓存时为0
+ */
+func cacheableID(u_pack *UserQueryPack) int {
+	usr := &u_pack.Usr
+	if usr.ID == 0 || (u_pack.IDRange.Low != -1 && u_pack.IDRange.High != -1) {
+		return 0
+	}
+	if u_pack.Filter != nil || u_pack.Cursor != nil || u_pack.Birthday != (DateRange{}) || u_pack.Group != 0 ||
+		u_pack.Offset > 0 || u_pack.Limit == 0 {
+		return 0
+	}
+	if usr.Name != "" || usr.Gender != "" || usr.Birthday != "" || usr.Email != "" || usr.Phone != "" || len(usr.Attributes) != 0 {
+		return 0
+	}
+	return usr.ID
+}
+
+func (store *CachedStore) FetchUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	id := cacheableID(u_pack)
+	if id == 0 || store.pending != nil {
+		return store.UserStore.FetchUsers(usr_list, u_pack)
+	}
+
+	gen, cached, item := store.get(id)
+	switch {
+	case store.bypass:
+		atomic.AddUint64(&store.stats.Bypasses, 1)
+	case cached != nil:
+		atomic.AddUint64(&store.stats.Hits, 1)
+		*usr_list = UserList{*cached}
+		return nil
+	default:
+		atomic.AddUint64(&store.stats.Misses, 1)
+	}
+
+	//缓存完整的用户，输出时再按 fields 选择字段
+	full := *u_pack
+	full.Fields = nil
+	if err := store.UserStore.FetchUsers(usr_list, &full); err != nil {
+		return err
+	}
+	if len(*usr_list) == 1 && gen != 0 {
+		store.set(gen, item, &(*usr_list)[0])
+	}
+	return nil
+}
+
+/*
+ *  Description:    读取当前代数和缓存的用户
+ *   Returns      :   uint64 当前代数，0 表示不能写入缓存(不知道代数或者有墓碑)， *User 缓存的用户，没有命中时为 nil
+ *                    *memcache.Item 已有的缓存项，写入时用 cas 替换，nil 表示不存在
+ */
+func (store *CachedStore) get(id int) (uint64, *User, *memcache.Item) {
+	gen_key, user_key := store.genKey(), store.userKey(id)
+	items, err := store.client.GetMulti([]string{gen_key, user_key})
+	if err != nil {
+		atomic.AddUint64(&store.stats.Errors, 1)
+		return 0, nil, nil
+	}
+
+	//代数被淘汰时重新生成，不能与之前用过的代数相同
+	gen_item := items[gen_key]
+	if gen_item == nil {
+		store.initGen()
+		return 0, nil, nil
+	}
+	gen, err := strconv.ParseUint(string(gen_item.Value), 10, 64)
+	if err != nil {
+		atomic.AddUint64(&store.stats.Errors, 1)
+		return 0, nil, nil
+	}
+
+	item := items[user_key]
+	switch {
+	case item == nil:
+		return gen, nil, nil
+	case bytes.Equal(item.Value, cache_tombstone):
+		//刚删除过，正在读取的可能是旧数据
+		return 0, nil, nil
+	case store.bypass:
+		return gen, nil, item
+	}
+	entry := cacheEntry{}
+	decoder := json.NewDecoder(bytes.NewReader(item.Value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&entry); err != nil {
+		atomic.AddUint64(&store.stats.Errors, 1)
+		return gen, nil, item
+	}
+	if entry.Gen != gen || entry.User.ID != id {
+		return gen, nil, item
+	}
+	return gen, &entry.User, item
+}
+
+/*
+ *  Description:    写入缓存的用户，读取后缓存被删除(写入了墓碑)或者被其他请求写入时放弃
+ *  Params       :   gen 读取时的代数, item get 返回的已有缓存项，nil 表示读取时不存在
+ */
+func (store *CachedStore) set(gen uint64, item *memcache.Item, usr *User) {
+	data, err := json.Marshal(&cacheEntry{Gen: gen, User: *usr})
+	if err != nil {
+		atomic.AddUint64(&store.stats.Errors, 1)
+		return
+	}
+	if item == nil {
+		err = store.client.Add(&memcache.Item{Key: store.userKey(usr.ID), Value: data, Expiration: int32(store.options.TTL)})
+	} else {
+		item.Value, item.Expiration = data, int32(store.options.TTL)
+		err = store.client.CompareAndSwap(item)
+	}
+	switch err {
+	case nil, memcache.ErrNotStored, memcache.ErrCASConflict, memcache.ErrCacheMiss:
+	default:
+		atomic.AddUint64(&store.stats.Errors, 1)
+	}
+}
+
+/*
+ *  Description:    代数不存在时用当前时间初始化，已经存在时不修改
+ */
+func (store *CachedStore) initGen() {
+	item := &memcache.Item{Key: store.genKey(), Value: []byte(strconv.FormatInt(time.Now().UnixNano(), 10))}
+	if err := store.client.Add(item); err != nil && err != memcache.ErrNotStored {
+		atomic.AddUint64(&store.stats.Errors, 1)
+	}
+}
+
+/*
+ *  Description:    删除用户的缓存，用墓碑替换使删除前开始的读取不能写回，事务中等到提交后再删除
+ */
+func (store *CachedStore) invalidate(ids ...int) {
+	for _, id := range ids {
+		if store.pending != nil {
+			store.pending.ids[id] = true
+			continue
+		}
+		atomic.AddUint64(&store.stats.Invalidations, 1)
+		item := &memcache.Item{Key: store.userKey(id), Value: cache_tombstone, Expiration: CACHE_TOMBSTONE_TTL}
+		if err := store.client.Set(item); err != nil {
+			atomic.AddUint64(&store.stats.Errors, 1)
+		}
+	}
+}
+
+/*
+ *  Description:    增加代数，全部用户的缓存失效，事务中等到提交后再增加
+ */
+func (store *CachedStore) invalidateAll() {
+	if store.pending != nil {
+		store.pending.all = true
+		return
+	}
+	atomic.AddUint64(&store.stats.Invalidations, 1)
+	_, err := store.client.Increment(store.genKey(), 1)
+	if err == memcache.ErrCacheMiss {
+		store.initGen()
+	} else if err != nil {
+		atomic.AddUint64(&store.stats.Errors, 1)
+	}
+}
+
+/*
+ *  Description:    批量操作前查出满足条件的用户ID，没有任何条件时返回 all 为 true
+ *  Params       :   cond 用户字段条件, low/high ID范围，与 UpdateUsers/DeleteUsers 相同
+ */
+func (store *CachedStore) matchedIDs(cond User, low, high int) (ids []int, all bool, err error) {
+	has_range := low != -1 && high != -1
+	if has_range {
+		cond.ID = 0
+	}
+	if !has_range && cond.ID == 0 && cond.Name == "" && cond.Gender == "" && cond.Birthday == "" &&
+		cond.Email == "" && cond.Phone == "" && len(cond.Attributes) == 0 {
+		return nil, true, nil
+	}
+
+	//只读取ID
+	usr_list := UserList{}
+	u_pack := &UserQueryPack{Usr: cond, Offset: -1, Limit: -1, IDRange: Range{low, high}, Fields: &FieldSet{}}
+	if err := store.UserStore.FetchUsers(&usr_list, u_pack); err != nil {
+		return nil, false, err
+	}
+	for _, usr := range usr_list {
+		ids = append(ids, usr.ID)
+	}
+	return ids, false, nil
+}
+
+/*
+ *  Description:    批量操作成功后删除 matchedIDs 查出的用户的缓存
+ */
+func (store *CachedStore) invalidateMatched(ids []int, all bool) {
+	if all {
+		store.invalidateAll()
+		return
+	}
+	store.invalidate(ids...)
+}
+
+func (store *CachedStore) AddUser(usr *User) error {
+	if err := store.UserStore.AddUser(usr); err != nil {
+		return err
+	}
+	store.invalidate(usr.ID)
+	return nil
+}
+
+func (store *CachedStore) UpdateUsers(usr *User, low, high int) error {
+	//更新的条件只有ID和ID范围
+	ids, all, err := store.matchedIDs(User{ID: usr.ID}, low, high)
+	if err != nil {
+		return err
+	}
+	if err := store.UserStore.UpdateUsers(usr, low, high); err != nil {
+		return err
+	}
+	store.invalidateMatched(ids, all)
+	return nil
+}
+
+func (store *CachedStore) UpdateUser(usr *User, version int) error {
+	if err := store.UserStore.UpdateUser(usr, version); err != nil {
+		return err
+	}
+	store.invalidate(usr.ID)
+	return nil
+}
+
+func (store *CachedStore) ReplaceUser(usr *User, version int) error {
+	if err := store.UserStore.ReplaceUser(usr, version); err != nil {
+		return err
+	}
+	store.invalidate(usr.ID)
+	return nil
+}
+
+func (store *CachedStore) DeleteUsers(usr *User, low, high int) error {
+	//删除后这些用户查询不到，先查出来
+	ids, all, err := store.matchedIDs(*usr, low, high)
+	if err != nil {
+		return err
+	}
+	if err := store.UserStore.DeleteUsers(usr, low, high); err != nil {
+		return err
+	}
+	store.invalidateMatched(ids, all)
+	return nil
+}
+
+func (store *CachedStore) DeleteUser(id, version int) error {
+	if err := store.UserStore.DeleteUser(id, version); err != nil {
+		return err
+	}
+	store.invalidate(id)
+	return nil
+}
+
+func (store *CachedStore) RestoreUser(id int) error {
+	if err := store.UserStore.RestoreUser(id); err != nil {
+		return err
+	}
+	store.invalidate(id)
+	return nil
+}
+
+func (store *CachedStore) PurgeUser(id, version int) error {
+	if err := store.UserStore.PurgeUser(id, version); err != nil {
+		return err
+	}
+	store.invalidate(id)
+	return nil
+}
+
+func (store *CachedStore) SetAttributes(user_id int, attrs Attributes) error {
+	if err := store.UserStore.SetAttributes(user_id, attrs); err != nil {
+		return err
+	}
+	store.invalidate(user_id)
+	return nil
+}
+
+func (store *CachedStore) DeleteDefinition(name string) error {
+	if err := store.UserStore.DeleteDefinition(name); err != nil {
+		return err
+	}
+	store.invalidateAll()
+	return nil
+}
+
+func (store *CachedStore) BeginTx() (UserTx, error) {
+	tx, err := store.UserStore.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	view := *store
+	view.UserStore = tx
+	view.pending = &cacheInvalidation{ids: make(map[int]bool)}
+	return &cachedTx{CachedStore: &view, tx: tx}, nil
+}
+
+//带缓存的事务，不读写缓存，提交后删除受影响的缓存
+type cachedTx struct {
+	*CachedStore
+	tx UserTx
+}
+
+func (tx *cachedTx) Commit() error {
+	if err := tx.tx.Commit(); err != nil {
+		return err
+	}
+	pending := tx.pending
+	tx.pending = nil
+	if pending.all {
+		tx.invalidateAll()
+	}
+	for id := range pending.ids {
+		tx.invalidate(id)
+	}
+	return nil
+}
+
+func (tx *cachedTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+func (store *CachedStore) BeginImport(upsert string, atomic bool) (UserImporter, error) {
+	imp, err := store.UserStore.BeginImport(upsert, atomic)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedImporter{UserImporter: imp, store: store, atomic: atomic}, nil
+}
+
+//导入时删除被更新的用户的缓存，atomic 时提交后再删除
+type cachedImporter struct {
+	UserImporter
+	store   *CachedStore
+	atomic  bool
+	pending []int
+}
+
+func (imp *cachedImporter) Write(usr_list UserList) ([]ImportedUser, error) {
+	//每批一个事务时，提交出错也返回结果，这一批可能已经写入，同样删除缓存
+	results, err := imp.UserImporter.Write(usr_list)
+	ids := []int{}
+	for _, result := range results {
+		if result.Err == nil {
+			ids = append(ids, result.User.ID)
+		}
+	}
+	if imp.atomic {
+		imp.pending = append(imp.pending, ids...)
+	} else {
+		imp.store.invalidate(ids...)
+	}
+	return results, err
+}
+
+func (imp *cachedImporter) Commit() error {
+	//提交的结果不确定时(例如连接断开)也可能已经写入，总是删除缓存
+	err := imp.UserImporter.Commit()
+	imp.store.invalidate(imp.pending...)
+	imp.pending = nil
+	return err
+}
@@ -0,0 +1,287 @@
+package USER
+
+import (
+	"bytes"
+	"serverenter/memcached"
+	"testing"
+	"third/gomemcache/memcache"
+	"time"
+)
+
+//测试中的缓存，通过 clock 使墓碑过期
+type testCache struct {
+	*CachedStore
+	srv   *MEMCACHED.Server
+	clock *MEMCACHED.FakeClock
+}
+
+func newTestCache(t *testing.T) *testCache {
+	clock := MEMCACHED.NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	srv, err := MEMCACHED.NewServer(clock)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	client := memcache.New(srv.Addr())
+	client.Timeout = time.Second
+	store := WithCache(WithAttributes(NewMemStore()), client, CacheOptions{TTL: 600, Prefix: "test"})
+	return &testCache{CachedStore: store, srv: srv, clock: clock}
+}
+
+/*
+ *  Description:    等待墓碑过期
+ */
+func (cache *testCache) expireTombstones() {
+	cache.clock.Advance(CACHE_TOMBSTONE_TTL * time.Second)
+}
+
+func fetchOne(t *testing.T, store UserStore, id int) *User {
+	t.Helper()
+	usr_list := UserList{}
+	u_pack := &UserQueryPack{Usr: User{ID: id}, Offset: -1, Limit: -1, IDRange: Range{Low: -1, High: -1}}
+	if err := store.FetchUsers(&usr_list, u_pack); err != nil {
+		t.Fatalf("FetchUsers(%d): %v", id, err)
+	}
+	if len(usr_list) != 1 {
+		t.Fatalf("FetchUsers(%d) 返回 %d 个用户", id, len(usr_list))
+	}
+	return &usr_list[0]
+}
+
+func addUsers(t *testing.T, store UserStore, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := store.AddUser(&User{Name: name}); err != nil {
+			t.Fatalf("AddUser(%s): %v", name, err)
+		}
+	}
+}
+
+/*
+ *  Description:    等待墓碑过期后读取用户使之写入缓存，第一次读取时初始化代数，第二次读取时写入
+ */
+func warm(t *testing.T, cache *testCache, ids ...int) {
+	t.Helper()
+	cache.expireTombstones()
+	for _, id := range ids {
+		fetchOne(t, cache, id)
+		fetchOne(t, cache, id)
+		assertCached(t, cache, id, true)
+	}
+}
+
+/*
+ *  Description:    检查用户是否在缓存中，墓碑不算
+ */
+func assertCached(t *testing.T, cache *testCache, id int, want bool) {
+	t.Helper()
+	value, ok := cache.srv.Value(cache.userKey(id))
+	if ok = ok && !bytes.Equal(value, cache_tombstone); ok != want {
+		t.Fatalf("用户 %d 在缓存中: %v, want %v", id, ok, want)
+	}
+}
+
+func TestCacheHitMissBypass(t *testing.T) {
+	cache := newTestCache(t)
+	addUsers(t, cache, "a")
+	cache.expireTombstones()
+
+	fetchOne(t, cache, 1)
+	fetchOne(t, cache, 1)
+	if usr := fetchOne(t, cache, 1); usr.Name != "a" {
+		t.Fatalf("命中的用户 = %+v", usr)
+	}
+	stats := cache.Stats()
+	if stats.Misses != 2 || stats.Hits != 1 || stats.Bypasses != 0 || stats.Errors != 0 {
+		t.Fatalf("Stats = %+v, want 2 misses, 1 hit", stats)
+	}
+
+	//绕过缓存时从存储读取，并刷新缓存
+	cache.UserStore.UpdateUser(&User{ID: 1, Name: "b"}, 0)
+	if usr := fetchOne(t, cache.Bypass(), 1); usr.Name != "b" {
+		t.Fatalf("绕过缓存读到 %+v", usr)
+	}
+	if usr := fetchOne(t, cache, 1); usr.Name != "b" {
+		t.Fatalf("绕过缓存后没有刷新缓存: %+v", usr)
+	}
+	stats = cache.Stats()
+	if stats.Bypasses != 1 || stats.Hits != 2 {
+		t.Fatalf("Stats = %+v, want 1 bypass, 2 hits", stats)
+	}
+
+	//不是按ID查询单个用户时不使用缓存
+	usr_list := UserList{}
+	cache.FetchUsers(&usr_list, &UserQueryPack{Usr: User{Name: "b"}, Offset: -1, Limit: -1, IDRange: Range{Low: -1, High: -1}})
+	if cache.Stats() != stats {
+		t.Fatalf("按条件查询改变了计数: %+v", cache.Stats())
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	cache := newTestCache(t)
+	addUsers(t, cache, "a")
+	warm(t, cache, 1)
+
+	//memcache 出错时直接读存储
+	cache.srv.InjectFault(MEMCACHED.Fault{Command: "get", Drop: true, Times: 1})
+	if usr := fetchOne(t, cache, 1); usr.Name != "a" {
+		t.Fatalf("出错时读到 %+v", usr)
+	}
+	if stats := cache.Stats(); stats.Errors != 1 {
+		t.Fatalf("Stats = %+v, want 1 error", stats)
+	}
+}
+
+func TestCacheInvalidateSingle(t *testing.T) {
+	cache := newTestCache(t)
+	addUsers(t, cache, "a", "b")
+	warm(t, cache, 1, 2)
+
+	usr := &User{ID: 1, Name: "a2"}
+	if err := cache.UpdateUser(usr, 0); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	assertCached(t, cache, 1, false)
+	assertCached(t, cache, 2, true)
+	if usr := fetchOne(t, cache, 1); usr.Name != "a2" {
+		t.Fatalf("更新后读到 %+v", usr)
+	}
+
+	warm(t, cache, 1)
+	if err := cache.DeleteUser(1, 0); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	assertCached(t, cache, 1, false)
+}
+
+func TestCacheInvalidateRange(t *testing.T) {
+	cache := newTestCache(t)
+	addUsers(t, cache, "a", "b", "c")
+	warm(t, cache, 1, 2, 3)
+
+	if err := cache.UpdateUsers(&User{Gender: "F"}, 2, 3); err != nil {
+		t.Fatalf("UpdateUsers: %v", err)
+	}
+	assertCached(t, cache, 1, true)
+	assertCached(t, cache, 2, false)
+	assertCached(t, cache, 3, false)
+
+	//没有条件的批量删除增加代数，缓存还在但已经失效
+	warm(t, cache, 2)
+	if err := cache.DeleteUsers(&User{}, -1, -1); err != nil {
+		t.Fatalf("DeleteUsers: %v", err)
+	}
+	usr_list := UserList{}
+	u_pack := &UserQueryPack{Usr: User{ID: 1}, Offset: -1, Limit: -1, IDRange: Range{Low: -1, High: -1}}
+	if err := cache.FetchUsers(&usr_list, u_pack); err != nil || len(usr_list) != 0 {
+		t.Fatalf("全部删除后读到 %v, %v", usr_list, err)
+	}
+}
+
+func TestCacheInvalidateTx(t *testing.T) {
+	cache := newTestCache(t)
+	addUsers(t, cache, "a", "b")
+	warm(t, cache, 1, 2)
+
+	tx, err := cache.BeginTx()
+	if err != nil {
+		t.Fatalf("BeginTx: %v", err)
+	}
+	if err := tx.UpdateUser(&User{ID: 1, Name: "a2"}, 0); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	//提交前不删除缓存
+	assertCached(t, cache, 1, true)
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	assertCached(t, cache, 1, false)
+	assertCached(t, cache, 2, true)
+
+	//回滚时不删除缓存
+	warm(t, cache, 1)
+	tx, _ = cache.BeginTx()
+	tx.UpdateUser(&User{ID: 1, Name: "a3"}, 0)
+	tx.Rollback()
+	assertCached(t, cache, 1, true)
+	if usr := fetchOne(t, cache, 1); usr.Name != "a2" {
+		t.Fatalf("回滚后读到 %+v", usr)
+	}
+}
+
+func TestCacheInvalidateImport(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		cache := newTestCache(t)
+		cache.UserStore.AddUser(&User{Name: "a", Email: "a@x.com"})
+		cache.UserStore.AddUser(&User{Name: "b", Email: "b@x.com"})
+		warm(t, cache, 1, 2)
+
+		imp, err := cache.BeginImport(UPSERT_EMAIL, atomic)
+		if err != nil {
+			t.Fatalf("BeginImport: %v", err)
+		}
+		if _, err := imp.Write(UserList{{Name: "a2", Email: "a@x.com"}, {Name: "c", Email: "c@x.com"}}); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		//每批一个事务时写入后立即删除，atomic 时提交后才删除
+		assertCached(t, cache, 1, atomic)
+		if err := imp.Commit(); err != nil {
+			t.Fatalf("Commit: %v", err)
+		}
+		assertCached(t, cache, 1, false)
+		assertCached(t, cache, 2, true)
+		if usr := fetchOne(t, cache, 1); usr.Name != "a2" {
+			t.Fatalf("atomic=%v 导入后读到 %+v", atomic, usr)
+		}
+	}
+}
+
+func TestCacheStaleFill(t *testing.T) {
+	cache := newTestCache(t)
+	addUsers(t, cache, "a")
+	cache.expireTombstones()
+	fetchOne(t, cache, 1)
+
+	//没有命中后读到旧数据，写回前用户被修改，写回时 key 为墓碑，add 失败
+	gen, _, item := cache.get(1)
+	if gen == 0 || item != nil {
+		t.Fatalf("get = %d, %v, want 代数和不存在的缓存项", gen, item)
+	}
+	old := fetchOne(t, cache.UserStore, 1)
+	if err := cache.UpdateUser(&User{ID: 1, Name: "a2"}, 0); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	cache.set(gen, item, old)
+	assertCached(t, cache, 1, false)
+	if usr := fetchOne(t, cache, 1); usr.Name != "a2" {
+		t.Fatalf("修改后读到 %+v", usr)
+	}
+
+	//已有缓存时，写回前用户被修改，cas 失败
+	warm(t, cache, 1)
+	gen, _, item = cache.Bypass().get(1)
+	if item == nil {
+		t.Fatalf("get 没有返回已有的缓存项")
+	}
+	old = fetchOne(t, cache.UserStore, 1)
+	if err := cache.UpdateUser(&User{ID: 1, Name: "a3"}, 0); err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	cache.set(gen, item, old)
+	assertCached(t, cache, 1, false)
+	if usr := fetchOne(t, cache, 1); usr.Name != "a3" {
+		t.Fatalf("修改后读到 %+v", usr)
+	}
+
+	//墓碑过期前不写入缓存，过期后正常写入
+	fetchOne(t, cache, 1)
+	assertCached(t, cache, 1, false)
+	warm(t, cache, 1)
+	if usr := fetchOne(t, cache, 1); usr.Name != "a3" {
+		t.Fatalf("墓碑过期后读到 %+v", usr)
+	}
+	//写回时 add, cas 失败不算错误
+	if stats := cache.Stats(); stats.Errors != 0 {
+		t.Fatalf("Stats = %+v, want 0 errors", stats)
+	}
+}
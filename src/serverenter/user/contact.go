@@ -0,0 +1,136 @@
+/*
+ 用户的联系方式：邮箱和手机号
+ 1. 邮箱统一为小写，手机号统一为 E.164 格式(+8613800138000)，没有国家码时使用默认国家码
+ 2. 邮箱和手机号在全部用户(包括软删除的用户)中唯一，重复时返回 ConflictError
+*/
+package USER
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+//默认国家码
+const DEFAULT_COUNTRY_CODE = "86"
+
+var (
+	ErrBadEmail = errors.New("邮箱格式错误")
+	ErrBadPhone = errors.New("手机号格式错误")
+)
+
+//可以为空的字符串，空字符串存为 NULL, 使唯一索引允许多个用户不填写
+type NullString string
+
+func (s NullString) Value() (driver.Value, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return string(s), nil
+}
+
+func (s *NullString) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*s = ""
+	case []byte:
+		*s = NullString(v)
+	case string:
+		*s = NullString(v)
+	default:
+		return fmt.Errorf("无法把 %T 转换成字符串", value)
+	}
+	return nil
+}
+
+//唯一字段与已有的用户重复
+type ConflictError struct {
+	Field      string `json:"field"`
+	Value      string `json:"value"`
+	ExistingID int    `json:"existing_id"`
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("%s %s 已经被用户 %d 使用", err.Field, err.Value, err.ExistingID)
+}
+
+/*
+ *  Description:    规范化邮箱，去掉首尾空白并转为小写
+ *   Returns      :   NullString 规范化后的邮箱， error 格式错误时返回 ErrBadEmail
+ */
+func NormalizeEmail(email string) (NullString, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", nil
+	}
+	//只接受裸地址，不接受 "名字 <地址>" 的形式
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return "", ErrBadEmail
+	}
+	return NullString(email), nil
+}
+
+var (
+	phone_separators = strings.NewReplacer(" ", "", "-", "", "(", "", ")", "", ".", "")
+	phone_digits     = regexp.MustCompile(`^\d+$`)
+	cn_mobile        = regexp.MustCompile(`^1\d{10}$`)
+)
+
+/*
+ *  Description:    把手机号规范化为 E.164 格式
+ *  Params       :   phone 输入的手机号，可以带 +国家码 或 00国家码，可以包含空格，横线，括号
+ *                   country_code 没有国家码时使用的国家码，空时使用 DEFAULT_COUNTRY_CODE
+ *   Returns      :   NullString 规范化后的手机号， error 格式错误时返回 ErrBadPhone
+ */
+func NormalizePhone(phone, country_code string) (NullString, error) {
+	phone = phone_separators.Replace(strings.TrimSpace(phone))
+	if phone == "" {
+		return "", nil
+	}
+	if country_code == "" {
+		country_code = DEFAULT_COUNTRY_CODE
+	}
+
+	var digits string
+	switch {
+	case strings.HasPrefix(phone, "+"):
+		digits = phone[1:]
+	case strings.HasPrefix(phone, "00"):
+		digits = phone[2:]
+	default:
+		//国内号码去掉长途前缀0
+		digits = country_code + strings.TrimPrefix(phone, "0")
+	}
+
+	//E.164 最长15位数字
+	if !phone_digits.MatchString(digits) || len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrBadPhone
+	}
+	if strings.HasPrefix(digits, "86") && !cn_mobile.MatchString(digits[2:]) {
+		return "", ErrBadPhone
+	}
+	return NullString("+" + digits), nil
+}
+
+/*
+ *  Description:    在用户列表中查找与 usr 的唯一字段重复的其他用户
+ *   Returns      :   error 重复时返回 *ConflictError，没有重复时返回 nil
+ */
+func findConflict(usr *User, others UserList) error {
+	for _, other := range others {
+		if other.ID == usr.ID {
+			continue
+		}
+		if usr.Email != "" && other.Email == usr.Email {
+			return &ConflictError{Field: "email", Value: string(usr.Email), ExistingID: other.ID}
+		}
+		if usr.Phone != "" && other.Phone == usr.Phone {
+			return &ConflictError{Field: "phone", Value: string(usr.Phone), ExistingID: other.ID}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+ 查询用户列表时的游标，按边界用户在排序字段上的值翻页(keyset 分页)
+ 1. 游标对客户端不透明，内容为生成游标时的排序和边界用户的排序字段的值, 编码为 base64url 的json
+ 2. 翻页时不使用偏移，数据在两页之间增加或删除也不会跳过或重复
+*/
+package USER
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+var (
+	ErrBadCursor   = errors.New("游标无效")
+	ErrCursorOrder = errors.New("游标与排序不一致")
+)
+
+type Cursor struct {
+	Sort   Sort          //生成游标时的排序
+	Values []interface{} //边界用户在排序字段上的值
+	Before bool          //true 取边界之前的一页，false 取边界之后的一页
+}
+
+//游标编码的内容
+type cursorToken struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
+/*
+ *  Description:    生成以 usr 为边界的游标
+ *  Params       :   order 当前页的排序, usr 边界用户
+ */
+func EncodeCursor(order Sort, usr *User) string {
+	data, _ := json.Marshal(&cursorToken{Sort: order.String(), Values: order.values(usr)})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+/*
+ *  Description:    解析客户端传来的游标
+ *  Params       :   token 游标, before true 表示取游标之前的一页
+ *   Returns      :   *Cursor 游标， error 无效时返回 ErrBadCursor
+ */
+func ParseCursor(token string, before bool) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	raw := cursorToken{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, ErrBadCursor
+	}
+	order, err := ParseSort(raw.Sort)
+	if err != nil || order.String() != raw.Sort || len(raw.Values) != len(order) {
+		return nil, ErrBadCursor
+	}
+
+	//json 中的数字解码为 float64，按字段的类型转换回来
+	values := make([]interface{}, len(order))
+	for i, field := range order {
+		switch value := raw.Values[i].(type) {
+		case float64:
+			if (field.Name != "id") || value != math.Trunc(value) || value <= 0 || value > math.MaxInt32 {
+				return nil, ErrBadCursor
+			}
+			values[i] = int(value)
+		case string:
+			if field.Name == "id" {
+				return nil, ErrBadCursor
+			}
+			values[i] = value
+		case nil:
+			if !sort_columns[field.Name].nullable {
+				return nil, ErrBadCursor
+			}
+		default:
+			return nil, ErrBadCursor
+		}
+	}
+	return &Cursor{Sort: order, Values: values, Before: before}, nil
+}
+
+/*
+ *  Description:    重新编码游标，与 EncodeCursor 生成的相同
+ */
+func (cursor *Cursor) String() string {
+	data, _ := json.Marshal(&cursorToken{Sort: cursor.Sort.String(), Values: cursor.Values})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+/*
+ *  Description:    实际查询时的排序
+ *                  取边界之前的一页时按相反的方向查询离边界最近的用户，再恢复成原来的顺序
+ */
+func (cursor *Cursor) query() Sort {
+	if cursor.Before {
+		return cursor.Sort.reverse()
+	}
+	return cursor.Sort
+}
+
+/*
+ *  Description:    用户是否在游标要取的一侧
+ */
+func (cursor *Cursor) accept(usr *User) bool {
+	return cursor.query().compare(usr, cursor.Values) > 0
+}
@@ -1,11 +1,1006 @@
 package USER
 
 import (
-	_ "third/go-sql-driver/mysql"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"third/go-sql-driver/mysql"
 	"third/gorm"
 )
 
-//用户管理类，实现了增加，删除，修改，查询等操作
+//mysql 唯一索引冲突的错误码
+const ER_DUP_ENTRY = 1062
+
+//用户管理类，基于gorm的mysql存储，实现了 UserStore 接口
 type DB struct {
 	*gorm.DB
+	in_tx bool //BeginTx 创建的事务，内部不再开始新的事务
+}
+
+/*
+ *  Description:    创建数据库连接池，不修改表结构，表结构通过 Migrator 迁移
+ *  Params       :   conn mysql连接串, pool_size 连接池大小
+ *   Returns      :   *DB 连接池指针，　error nil表示成功　非nil表示失败
+ */
+func OpenDB(conn string, pool_size int) (*DB, error) {
+	db, err := gorm.Open("mysql", conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.DB().Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	db.DB().SetMaxOpenConns(pool_size)
+	db.DB().SetMaxIdleConns(pool_size >> 1)
+	return &DB{DB: &db}, nil
+}
+
+/*
+ *  Description:    检查数据库结构是否是最新的，有没有执行的迁移时返回错误
+ */
+func (db *DB) CheckSchema() error {
+	pending, err := NewMigrator(db).Pending()
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("数据库结构落后 %d 个版本，请先执行 migrate up", pending)
+	}
+	return nil
+}
+
+func (db *DB) AddUser(usr *User) error {
+	usr.Version = 1
+	add := db.Model(&User{})
+	return db.conflict(usr, add.Create(usr).Error)
+}
+
+func (db *DB) UpdateUsers(usr *User, low, high int) error {
+
+	update := db.Model(&User{})
+
+	//数据ID范围限制
+	if low != -1 && high != -1 {
+		//ID范围有效 u_pack.Usr.ID 强制赋值成0
+		usr.ID = 0
+		update = update.Where("id >= ? and id <= ?", low, high)
+	} else if usr.ID != 0 {
+		update = update.Where("id = ?", usr.ID)
+	}
+
+	err := update.UpdateColumns(updateAttrs(usr)).Error
+	return db.conflict(usr, err)
+}
+
+func (db *DB) UpdateUser(usr *User, version int) error {
+	return db.updateOne(usr, version, updateAttrs(usr))
+}
+
+func (db *DB) ReplaceUser(usr *User, version int) error {
+	attrs := updateAttrs(usr)
+	attrs["name"], attrs["gender"], attrs["birthday"] = usr.Name, usr.Gender, usr.Birthday
+	attrs["email"], attrs["phone"] = usr.Email, usr.Phone
+	return db.updateOne(usr, version, attrs)
+}
+
+/*
+ *  Description:    按ID更新单个用户的指定字段，成功后 usr 为更新后的完整数据
+ */
+func (db *DB) updateOne(usr *User, version int, attrs map[string]interface{}) error {
+	update := db.Model(&User{}).Where("id = ?", usr.ID)
+	if version != 0 {
+		update = update.Where("version = ?", version)
+	}
+
+	update = update.UpdateColumns(attrs)
+	if update.Error != nil {
+		return db.conflict(usr, update.Error)
+	}
+	if update.RowsAffected == 0 {
+		return db.missReason(db.DB, usr.ID)
+	}
+	return db.First(usr, usr.ID).Error
+}
+
+func (db *DB) DeleteUser(id, version int) error {
+	del := db.Where("id = ?", id)
+	if version != 0 {
+		del = del.Where("version = ?", version)
+	}
+
+	del = del.Delete(&User{})
+	if del.Error != nil {
+		return del.Error
+	}
+	if del.RowsAffected == 0 {
+		return db.missReason(db.DB, id)
+	}
+	return nil
+}
+
+func (db *DB) DeleteUsers(usr *User, low, high int) error {
+
+	del := db.Model(&User{})
+
+	//数据ID范围限制
+	if low != -1 && high != -1 {
+		//ID范围有效 u_pack.Usr.ID 强制赋值成0
+		usr.ID = 0
+		del = del.Where("id >= ? and id <= ?", low, high)
+	}
+
+	//非空字段作为删除条件，自定义属性不在 user 表中
+	cond := *usr
+	cond.Attributes = nil
+	return del.Where(&cond).Delete(&User{}).Error
+}
+
+func (db *DB) RestoreUser(id int) error {
+	restore := db.Exec("UPDATE user SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL", id)
+	if restore.Error != nil {
+		return restore.Error
+	}
+	if restore.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (db *DB) PurgeUser(id, version int) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		purge := tx.Unscoped().Where("id = ?", id)
+		if version != 0 {
+			purge = purge.Where("version = ?", version)
+		}
+
+		purge = purge.Delete(&User{})
+		if purge.Error != nil {
+			return purge.Error
+		}
+		if purge.RowsAffected == 0 {
+			return db.missReason(tx.Unscoped(), id)
+		}
+		//同时删除密码和组关系
+		if err := tx.Exec("DELETE FROM user_credential WHERE user_id = ?", id).Error; err != nil {
+			return err
+		}
+		return memberships(tx).Delete(tx, &User{ID: id})
+	})
+}
+
+/*
+ *  Description:    按ID操作单个用户没有影响任何行时，区分用户不存在和版本不一致
+ *  Params       :   scope 查询范围(是否包括软删除的用户), id 用户ID
+ */
+func (db *DB) missReason(scope *gorm.DB, id int) error {
+	count := 0
+	if err := scope.Model(&User{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+	return ErrVersionMismatch
+}
+
+/*
+ *  Description:    把唯一索引冲突转换成 ConflictError, 查出与 usr 重复的已有用户(包括软删除的用户)
+ *  Params       :   usr 写入的用户, err 写入的错误
+ */
+func (db *DB) conflict(usr *User, err error) error {
+	mysql_err, ok := err.(*mysql.MySQLError)
+	if !ok || mysql_err.Number != ER_DUP_ENTRY {
+		return err
+	}
+
+	others := UserList{}
+	find := db.Unscoped().Where("email = ? OR phone = ?", usr.Email, usr.Phone).Find(&others)
+	if find.Error != nil {
+		return err
+	}
+	if conflict := findConflict(usr, others); conflict != nil {
+		return conflict
+	}
+	return err
+}
+
+/*
+ *  Description:    更新的字段：非空字段和版本号加1
+ */
+func updateAttrs(usr *User) map[string]interface{} {
+	attrs := map[string]interface{}{"version": gorm.Expr("version + 1")}
+	if usr.Name != "" {
+		attrs["name"] = usr.Name
+	}
+	if usr.Gender != "" {
+		attrs["gender"] = usr.Gender
+	}
+	if usr.Birthday != "" {
+		attrs["birthday"] = usr.Birthday
+	}
+	if usr.Email != "" {
+		attrs["email"] = usr.Email
+	}
+	if usr.Phone != "" {
+		attrs["phone"] = usr.Phone
+	}
+	return attrs
+}
+
+func (db *DB) FetchUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	if u_pack == nil {
+		return errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	return fetchPage(db.filter(u_pack, false), usr_list, u_pack)
+}
+
+func (db *DB) FetchDeletedUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	if u_pack == nil {
+		return errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	return fetchPage(db.filter(u_pack, true), usr_list, u_pack)
+}
+
+//只有偏移没有数量限制时使用的数量，MySQL 不支持没有 LIMIT 的 OFFSET
+const MAX_LIMIT uint64 = math.MaxUint64
+
+/*
+ *  Description:    在查询上加上偏移和数量限制，-1 表示没有
+ */
+func limitOffset(query *gorm.DB, offset, limit int) *gorm.DB {
+	if offset != -1 {
+		query = query.Offset(offset)
+		if limit == -1 {
+			query = query.Limit(MAX_LIMIT)
+		}
+	}
+	if limit != -1 {
+		query = query.Limit(limit)
+	}
+	return query
+}
+
+/*
+ *  Description:    在查询条件上加上偏移(或游标)，数量和排序，获取用户列表
+ */
+func fetchPage(query *gorm.DB, usr_list *UserList, u_pack *UserQueryPack) error {
+	cursor := u_pack.Cursor
+
+	//数据偏移和数量限制，有游标时不使用偏移
+	offset := u_pack.Offset
+	if cursor != nil {
+		offset = -1
+	}
+	query = limitOffset(query, offset, u_pack.Limit)
+
+	//数据排序，有游标时从边界开始按游标的方向查询
+	order := u_pack.Sorting()
+	if cursor != nil {
+		order = cursor.query()
+		cond, args := order.seek(cursor.Values)
+		query = query.Where(cond, args...)
+	}
+	if len(order) != 0 {
+		query = query.Order(order.orderBy())
+	}
+
+	//只查询需要的列
+	if u_pack.Fields != nil {
+		query = query.Select(u_pack.Fields.columns(order))
+	}
+
+	if err := query.Find(usr_list).Error; err != nil {
+		return err
+	}
+
+	//取边界之前的一页时是反向查询的，恢复成原来的顺序
+	if cursor != nil && cursor.Before {
+		usr_list.reverse()
+	}
+	return nil
+}
+
+func (db *DB) ExportUsers(u_pack *UserQueryPack, each func(usr *User) error) error {
+	if u_pack == nil {
+		return errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	query := limitOffset(db.filter(u_pack, false), u_pack.Offset, u_pack.Limit)
+	order := u_pack.Sorting()
+	if len(order) == 0 {
+		order = OrderSort(1)
+	}
+	query = query.Order(order.orderBy())
+	if u_pack.Fields != nil {
+		query = query.Select(u_pack.Fields.columns(order))
+	}
+
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		usr := User{}
+		if err := scanUser(rows, columns, &usr); err != nil {
+			return err
+		}
+		if err := each(&usr); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+/*
+ *  Description:    按列名把当前行读取到用户中，name 和 gender 可能为 NULL
+ */
+func scanUser(rows *sql.Rows, columns []string, usr *User) error {
+	var name, gender sql.NullString
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "id":
+			targets[i] = &usr.ID
+		case "name":
+			targets[i] = &name
+		case "gender":
+			targets[i] = &gender
+		case "birthday":
+			targets[i] = &usr.Birthday
+		case "email":
+			targets[i] = &usr.Email
+		case "phone":
+			targets[i] = &usr.Phone
+		case "version":
+			targets[i] = &usr.Version
+		case "deleted_at":
+			targets[i] = &usr.DeletedAt
+		default:
+			targets[i] = new(interface{})
+		}
+	}
+	if err := rows.Scan(targets...); err != nil {
+		return err
+	}
+	usr.Name, usr.Gender = name.String, gender.String
+	return nil
+}
+
+func (db *DB) CountUsers(u_pack *UserQueryPack) (int, error) {
+	if u_pack == nil {
+		return 0, errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	count := 0
+	err := db.filter(u_pack, false).Count(&count).Error
+	return count, err
+}
+
+func (db *DB) TotalUsers(u_pack *UserQueryPack, deleted bool, threshold int) (int, bool, error) {
+	if u_pack == nil {
+		return 0, false, errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	count := 0
+	if threshold <= 0 {
+		err := db.filter(u_pack, deleted).Count(&count).Error
+		return count, err == nil, err
+	}
+
+	//和查询使用同一组条件，在子查询中最多数 threshold+1 行
+	cond, args := db.conditions(u_pack, deleted)
+	cond = "WHERE " + cond
+	limit_args := append(append([]interface{}{}, args...), threshold+1)
+	err := db.Raw("SELECT COUNT(*) FROM (SELECT 1 FROM `user` "+cond+" LIMIT ?) t", limit_args...).Row().Scan(&count)
+	if err != nil || count <= threshold {
+		return count, err == nil, err
+	}
+
+	//超过阈值时使用 EXPLAIN 估计的行数，至少为已经数到的行数
+	estimate, err := db.explainRows(cond, args)
+	if err != nil || estimate < count {
+		return count, false, err
+	}
+	return estimate, false, nil
+}
+
+/*
+ *  Description:    用 EXPLAIN 估计查询条件匹配的用户数量: rows * filtered%
+ *  Params       :   cond 查询条件(WHERE 子句), args 查询条件的参数
+ */
+func (db *DB) explainRows(cond string, args []interface{}) (int, error) {
+	rows, err := db.Raw("EXPLAIN SELECT * FROM `user` "+cond, args...).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	//不同版本的 EXPLAIN 列不同，按列名读取，第一行为 user 表
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	estimate, filtered := 0.0, 100.0
+	for i, column := range columns {
+		switch strings.ToLower(column) {
+		case "rows":
+			estimate, _ = strconv.ParseFloat(values[i].String, 64)
+		case "filtered":
+			if value, err := strconv.ParseFloat(values[i].String, 64); err == nil {
+				filtered = value
+			}
+		}
+	}
+	return int(estimate * filtered / 100), nil
+}
+
+/*
+ *  Description:    根据查询包构造查询，不包括偏移，数量和排序
+ *  Params       :   deleted 为 true 时只查询已经软删除的用户(回收站)
+ */
+func (db *DB) filter(u_pack *UserQueryPack, deleted bool) *gorm.DB {
+	cond, args := db.conditions(u_pack, deleted)
+	//软删除条件已经在 cond 中，不再使用 gorm 默认的 deleted_at 条件
+	return db.Model(&User{}).Unscoped().Where(cond, args...)
+}
+
+/*
+ *  Description:    根据查询包中的ID范围和非空字段构造查询条件，查询，计数和 EXPLAIN 都使用同一组条件
+ *   Returns      :   用 AND 连接的 WHERE 条件(不带 WHERE 关键字)和条件参数
+ */
+func (db *DB) conditions(u_pack *UserQueryPack, deleted bool) (string, []interface{}) {
+	usr := u_pack.Usr
+
+	conds := []string{}
+	args := []interface{}{}
+	where := func(cond string, values ...interface{}) {
+		conds = append(conds, "("+cond+")")
+		args = append(args, values...)
+	}
+
+	if deleted {
+		where("deleted_at IS NOT NULL")
+	} else {
+		where("deleted_at IS NULL")
+	}
+
+	//数据ID范围限制
+	if u_pack.IDRange.Low != -1 && u_pack.IDRange.High != -1 {
+		//ID范围有效 u_pack.Usr.ID 强制赋值成0
+		usr.ID = 0
+		where("id >= ? and id <= ?", u_pack.IDRange.Low, u_pack.IDRange.High)
+	}
+
+	//生日范围
+	if u_pack.Birthday.From != "" {
+		where("birthday >= ?", u_pack.Birthday.From)
+	}
+	if u_pack.Birthday.To != "" {
+		where("birthday <= ?", u_pack.Birthday.To)
+	}
+
+	//自定义属性
+	for _, name := range usr.Attributes.names() {
+		if usr.Attributes[name] == nil {
+			continue
+		}
+		where("id IN (SELECT ua.user_id FROM user_attribute ua JOIN attribute_definition ad ON ad.id = ua.attribute_id "+
+			"WHERE ad.name = ? AND ua.value = ?)", name, EncodeAttribute(usr.Attributes[name]))
+	}
+	usr.Attributes = nil
+
+	//filter 表达式
+	if u_pack.Filter != nil {
+		cond, filter_args := u_pack.Filter.SQL()
+		where(cond, filter_args...)
+	}
+
+	//用户组
+	if u_pack.Group != 0 {
+		where("id IN (SELECT user_id FROM user_group_member WHERE group_id = ?)", u_pack.Group)
+	}
+
+	//非空字段作为等值条件，和 gorm 的结构体条件取同样的字段，按结构体中的顺序
+	scope := db.NewScope(&usr)
+	fields := scope.Fields()
+	for _, struct_field := range scope.GetStructFields() {
+		if field, ok := fields[struct_field.DBName]; ok && field.IsNormal && !field.IsIgnored && !field.IsBlank {
+			where(field.DBName+" = ?", field.Field.Interface())
+		}
+	}
+
+	return strings.Join(conds, " AND "), args
+}
+
+func (db *DB) AddHistory(entries []History) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		for i := range entries {
+			if err := entries[i].encode(); err != nil {
+				return err
+			}
+			if err := tx.Create(&entries[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) FetchHistory(user_id, offset, limit int) ([]History, int, error) {
+	total := 0
+	query := db.Model(&History{}).Where("user_id = ?", user_id)
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	entries := []History{}
+	if err := limitOffset(query.Order("id desc"), offset, limit).Find(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		if err := entries[i].decode(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return entries, total, nil
+}
+
+func (db *DB) AddDefinition(def *AttributeDefinition) error {
+	if err := def.encode(); err != nil {
+		return err
+	}
+	err := db.Create(def).Error
+	if mysql_err, ok := err.(*mysql.MySQLError); ok && mysql_err.Number == ER_DUP_ENTRY {
+		return ErrAttributeExists
+	}
+	return err
+}
+
+func (db *DB) UpdateDefinition(def *AttributeDefinition) error {
+	old := AttributeDefinition{}
+	if err := db.findDefinition(def.Name, &old); err != nil {
+		return err
+	}
+	if old.Type != def.Type {
+		return errors.New("属性的类型不能修改")
+	}
+	if err := def.encode(); err != nil {
+		return err
+	}
+	def.ID = old.ID
+	return db.Model(&old).UpdateColumns(map[string]interface{}{"rules": def.RulesJSON}).Error
+}
+
+func (db *DB) DeleteDefinition(name string) error {
+	def := AttributeDefinition{}
+	if err := db.findDefinition(name, &def); err != nil {
+		return err
+	}
+
+	return db.transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM user_attribute WHERE attribute_id = ?", def.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&def).Error
+	})
+}
+
+/*
+ *  Description:    按名字获取属性定义，不存在时返回 ErrAttributeNotFound
+ */
+func (db *DB) findDefinition(name string, def *AttributeDefinition) error {
+	find := db.Where("name = ?", name).First(def)
+	if find.RecordNotFound() {
+		return ErrAttributeNotFound
+	}
+	if find.Error != nil {
+		return find.Error
+	}
+	return def.decodeRules()
+}
+
+func (db *DB) FetchDefinitions() (AttributeDefinitions, error) {
+	defs := AttributeDefinitions{}
+	if err := db.Order("id").Find(&defs).Error; err != nil {
+		return nil, err
+	}
+	for i := range defs {
+		if err := defs[i].decodeRules(); err != nil {
+			return nil, err
+		}
+	}
+	return defs, nil
+}
+
+func (db *DB) SetAttributes(user_id int, attrs Attributes) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		for _, name := range attrs.names() {
+			def := AttributeDefinition{}
+			if err := tx.Where("name = ?", name).First(&def).Error; err != nil {
+				return &AttributeError{Name: name, Message: "没有定义"}
+			}
+
+			var err error
+			if attrs[name] == nil {
+				err = tx.Exec("DELETE FROM user_attribute WHERE user_id = ? AND attribute_id = ?", user_id, def.ID).Error
+			} else {
+				err = tx.Exec("INSERT INTO user_attribute (user_id, attribute_id, value) VALUES (?, ?, ?) "+
+					"ON DUPLICATE KEY UPDATE value = VALUES(value)", user_id, def.ID, EncodeAttribute(attrs[name])).Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) FetchAttributes(user_ids []int) (map[int]map[string]string, error) {
+	result := make(map[int]map[string]string)
+	if len(user_ids) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Raw("SELECT ua.user_id, ad.name, ua.value FROM user_attribute ua "+
+		"JOIN attribute_definition ad ON ad.id = ua.attribute_id WHERE ua.user_id IN (?)", user_ids).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user_id int
+		var name, value string
+		if err := rows.Scan(&user_id, &name, &value); err != nil {
+			return nil, err
+		}
+		if result[user_id] == nil {
+			result[user_id] = make(map[string]string)
+		}
+		result[user_id][name] = value
+	}
+	return result, rows.Err()
+}
+
+/*
+ *  Description:    Group.Members 的 many2many 关联表，组关系通过 gorm 的 JoinTableHandler 读写
+ */
+func memberships(db *gorm.DB) gorm.JoinTableHandlerInterface {
+	field, _ := db.NewScope(&Group{}).FieldByName("Members")
+	return field.Relationship.JoinTableHandler
+}
+
+func (db *DB) AddGroup(group *Group) error {
+	err := db.Create(group).Error
+	if mysql_err, ok := err.(*mysql.MySQLError); ok && mysql_err.Number == ER_DUP_ENTRY {
+		return ErrGroupExists
+	}
+	return err
+}
+
+func (db *DB) UpdateGroup(group *Group) error {
+	//mysql 在值没有变化时影响的行数为0，先检查组是否存在
+	if _, err := db.FetchGroup(group.ID); err != nil {
+		return err
+	}
+	attrs := map[string]interface{}{"name": group.Name, "description": group.Description}
+	err := db.Model(&Group{}).Where("id = ?", group.ID).UpdateColumns(attrs).Error
+	if mysql_err, ok := err.(*mysql.MySQLError); ok && mysql_err.Number == ER_DUP_ENTRY {
+		return ErrGroupExists
+	}
+	return err
+}
+
+func (db *DB) DeleteGroup(id int) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		del := tx.Where("id = ?", id).Delete(&Group{})
+		if del.Error != nil {
+			return del.Error
+		}
+		if del.RowsAffected == 0 {
+			return ErrGroupNotFound
+		}
+		return memberships(tx).Delete(tx, &Group{ID: id})
+	})
+}
+
+func (db *DB) FetchGroup(id int) (*Group, error) {
+	group := &Group{}
+	find := db.Where("id = ?", id).First(group)
+	if find.RecordNotFound() {
+		return nil, ErrGroupNotFound
+	}
+	if find.Error != nil {
+		return nil, find.Error
+	}
+	return group, nil
+}
+
+func (db *DB) FetchGroups() ([]Group, error) {
+	groups := []Group{}
+	if err := db.Order("id").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (db *DB) AddMember(group_id, user_id int) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		group := &Group{}
+		if find := tx.Where("id = ?", group_id).First(group); find.Error != nil {
+			if find.RecordNotFound() {
+				return ErrGroupNotFound
+			}
+			return find.Error
+		}
+		//软删除的用户不能加入组
+		count := 0
+		if err := tx.Model(&User{}).Where("id = ?", user_id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+		//已经是成员时不插入
+		return memberships(tx).Add(tx, group, &User{ID: user_id})
+	})
+}
+
+func (db *DB) RemoveMember(group_id, user_id int) error {
+	if _, err := db.FetchGroup(group_id); err != nil {
+		return err
+	}
+	del := db.Exec("DELETE FROM user_group_member WHERE group_id = ? AND user_id = ?", group_id, user_id)
+	if del.Error != nil {
+		return del.Error
+	}
+	if del.RowsAffected == 0 {
+		return ErrNotMember
+	}
+	return nil
+}
+
+func (db *DB) FetchUserGroups(user_id int) ([]Group, error) {
+	groups := []Group{}
+	err := db.transaction(func(tx *gorm.DB) error {
+		//软删除的用户保留组关系，但和不存在的用户一样返回 ErrUserNotFound
+		count := 0
+		if err := tx.Model(&User{}).Where("id = ?", user_id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+		return tx.Joins("JOIN user_group_member m ON m.group_id = user_group.id").
+			Where("m.user_id = ?", user_id).Order("user_group.id").Find(&groups).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (db *DB) SetCredential(cred *Credential, current string) error {
+	return db.transaction(func(tx *gorm.DB) error {
+		//软删除的用户不能设置密码
+		count := 0
+		if err := tx.Model(&User{}).Where("id = ?", cred.UserID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+
+		if current == "" {
+			err := tx.Exec("INSERT INTO user_credential (user_id, algorithm, hash, updated_at) VALUES (?, ?, ?, ?)",
+				cred.UserID, cred.Algorithm, cred.Hash, cred.UpdatedAt).Error
+			if mysql_err, ok := err.(*mysql.MySQLError); ok && mysql_err.Number == ER_DUP_ENTRY {
+				return ErrCredentialChanged
+			}
+			return err
+		}
+		//新的哈希使用新的盐，与 current 一定不同，影响的行数为0表示已经被修改
+		update := tx.Exec("UPDATE user_credential SET algorithm = ?, hash = ?, updated_at = ? WHERE user_id = ? AND hash = ?",
+			cred.Algorithm, cred.Hash, cred.UpdatedAt, cred.UserID, current)
+		if update.Error != nil {
+			return update.Error
+		}
+		if update.RowsAffected == 0 {
+			return ErrCredentialChanged
+		}
+		return nil
+	})
+}
+
+func (db *DB) FetchCredential(user_id int) (*Credential, error) {
+	cred := &Credential{}
+	find := db.Where("user_id = ?", user_id).First(cred)
+	if find.RecordNotFound() {
+		return nil, ErrNoCredential
+	}
+	if find.Error != nil {
+		return nil, find.Error
+	}
+	return cred, nil
+}
+
+/*
+ *  Description:    在事务中执行 fn, fn 返回错误时回滚，已经在 BeginTx 的事务中时直接使用该事务
+ */
+func (db *DB) transaction(fn func(tx *gorm.DB) error) error {
+	if db.in_tx {
+		return fn(db.DB)
+	}
+	tx := db.Begin()
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (db *DB) BeginTx() (UserTx, error) {
+	if db.in_tx {
+		return nil, errors.New("不支持嵌套的事务")
+	}
+	tx := db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &dbTx{DB: &DB{DB: tx, in_tx: true}}, nil
+}
+
+//mysql 的事务，所有操作使用同一个连接
+type dbTx struct {
+	*DB
+}
+
+func (tx *dbTx) Commit() error {
+	return tx.DB.DB.Commit().Error
+}
+
+func (tx *dbTx) Rollback() error {
+	err := tx.DB.DB.Rollback().Error
+	if err == sql.ErrTxDone {
+		return ErrTxDone
+	}
+	return err
+}
+
+//事务由 Commit 或 Rollback 结束，不关闭连接池
+func (tx *dbTx) Close() error {
+	return nil
+}
+
+func (db *DB) BeginImport(upsert string, atomic bool) (UserImporter, error) {
+	if db.in_tx {
+		return nil, errors.New("事务中不能批量导入")
+	}
+	imp := &dbImporter{db: db, upsert: upsert}
+	if atomic {
+		tx := db.Begin()
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		imp.tx = &DB{DB: tx, in_tx: true}
+	}
+	return imp, nil
+}
+
+//mysql 的一次导入，atomic 时所有批次在同一个事务中，否则每批一个事务
+type dbImporter struct {
+	db     *DB
+	tx     *DB //atomic 时整个导入的事务
+	upsert string
+	importHooks
+}
+
+func (imp *dbImporter) Write(usr_list UserList) ([]ImportedUser, error) {
+	if imp.tx != nil {
+		return imp.write(imp.tx, usr_list)
+	}
+
+	tx := imp.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+	results, err := imp.write(&DB{DB: tx, in_tx: true}, usr_list)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return results, tx.Commit().Error
+}
+
+/*
+ *  Description:    在事务中写入一批用户，再执行注册的 ImportHook
+ */
+func (imp *dbImporter) write(tx *DB, usr_list UserList) ([]ImportedUser, error) {
+	results, err := importBatch(&dbImportWriter{tx: tx}, usr_list, imp.upsert)
+	if err != nil {
+		return nil, err
+	}
+	if err := imp.run(tx, usr_list, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (imp *dbImporter) Commit() error {
+	if imp.tx == nil {
+		return nil
+	}
+	return imp.tx.DB.Commit().Error
+}
+
+func (imp *dbImporter) Rollback() error {
+	if imp.tx == nil {
+		return nil
+	}
+	return imp.tx.DB.Rollback().Error
+}
+
+//在事务中写入导入的用户，唯一索引冲突也在事务中查找
+type dbImportWriter struct {
+	tx *DB
+}
+
+func (w *dbImportWriter) findByKeys(emails, phones []string) (UserList, error) {
+	conds := []string{}
+	args := []interface{}{}
+	if len(emails) != 0 {
+		conds = append(conds, "email IN (?)")
+		args = append(args, emails)
+	}
+	if len(phones) != 0 {
+		conds = append(conds, "phone IN (?)")
+		args = append(args, phones)
+	}
+
+	usr_list := UserList{}
+	if len(conds) == 0 {
+		return usr_list, nil
+	}
+	err := w.tx.Unscoped().Where(strings.Join(conds, " OR "), args...).Find(&usr_list).Error
+	return usr_list, err
+}
+
+func (w *dbImportWriter) insert(usr *User) error {
+	usr.Version = 1
+	return w.tx.conflict(usr, w.tx.Model(&User{}).Create(usr).Error)
+}
+
+func (w *dbImportWriter) update(id int, usr *User) error {
+	update := w.tx.Model(&User{}).Where("id = ?", id).UpdateColumns(updateAttrs(usr))
+	if update.Error != nil {
+		return w.tx.conflict(usr, update.Error)
+	}
+	return w.tx.First(usr, id).Error
+}
+
+func (db *DB) Close() error {
+	return db.DB.Close()
 }
@@ -0,0 +1,192 @@
+/*
+ 批量更新和删除的预演(dry run)，只读取数据，不做任何修改
+*/
+package USER
+
+const (
+	DRY_RUN_UPDATE = "update"
+	DRY_RUN_DELETE = "delete"
+)
+
+//单个字段修改前后的值
+type FieldChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+//单行数据的预览，删除时 After 为空
+type RowPreview struct {
+	ID      int                    `json:"id"`
+	Before  User                   `json:"before"`
+	After   *User                  `json:"after"`
+	Changes map[string]FieldChange `json:"changes"`
+}
+
+//预演结果
+type DryRunResult struct {
+	Operation string         `json:"operation"`
+	Affected  int            `json:"affected"`  //会影响的总行数
+	Truncated bool           `json:"truncated"` //Rows 只列出了部分行
+	Rows      []RowPreview   `json:"rows"`
+	Guard     *GuardError    `json:"guard"`    //真正执行时会被安全检查拒绝的原因，nil 表示可以执行
+	Conflict  *ConflictError `json:"conflict"` //真正执行时唯一字段重复(返回 409)的原因，nil 表示没有重复
+}
+
+/*
+ *  Description:    预演更新用户，返回会被修改的行和每个字段修改前后的值
+ *  Params       :   store 用户存储, low/high ID范围, max_rows 最多列出的行数
+ *   Returns      :   *DryRunResult 预演结果， error nil表示成功　非nil表示失败
+ */
+func (usr *User) PreviewUpdate(store UserStore, low, high, max_rows int) (*DryRunResult, error) {
+	values := *usr
+	if low != -1 && high != -1 {
+		values.ID = 0
+	}
+
+	result, matched, err := preview(store, DRY_RUN_UPDATE, User{ID: values.ID}, low, high, max_rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Conflict, err = previewConflict(store, &values, matched, result.Affected); err != nil {
+		return nil, err
+	}
+	for _, before := range matched {
+		//与真正的更新相同，只更新非空字段，自定义属性合并到已有的属性中
+		after := applyUpdate(before, &values)
+		after.Attributes = mergeAttributes(before.Attributes, values.Attributes)
+		result.Rows = append(result.Rows, RowPreview{ID: before.ID, Before: before, After: &after, Changes: DiffUser(&before, &after)})
+	}
+	return result, nil
+}
+
+/*
+ *  Description:    检查更新的 email 和 phone 是否会与已有用户(包括软删除的用户)重复
+ *                   同时更新多行时，第一行之后的行与第一行重复
+ *  Params       :   values 更新的值, matched 列出的会被更新的行, affected 会被更新的总行数
+ */
+func previewConflict(store UserStore, values *User, matched UserList, affected int) (*ConflictError, error) {
+	for _, field := range []string{UPSERT_EMAIL, UPSERT_PHONE} {
+		value := uniqueValue(values, field)
+		if value == "" {
+			continue
+		}
+		cond := User{}
+		if field == UPSERT_EMAIL {
+			cond.Email = NullString(value)
+		} else {
+			cond.Phone = NullString(value)
+		}
+
+		owners, deleted := UserList{}, UserList{}
+		u_pack := &UserQueryPack{Usr: cond, Offset: -1, Limit: -1, IDRange: Range{Low: -1, High: -1}}
+		if err := store.FetchUsers(&owners, u_pack); err != nil {
+			return nil, err
+		}
+		if err := store.FetchDeletedUsers(&deleted, u_pack); err != nil {
+			return nil, err
+		}
+		for _, owner := range append(owners, deleted...) {
+			//只更新已经使用该值的用户自己时不重复
+			if affected == 1 && len(matched) == 1 && matched[0].ID == owner.ID {
+				continue
+			}
+			return &ConflictError{Field: field, Value: value, ExistingID: owner.ID}, nil
+		}
+		if affected > 1 && len(matched) != 0 {
+			return &ConflictError{Field: field, Value: value, ExistingID: matched[0].ID}, nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+ *  Description:    预演删除用户，返回会被删除的行
+ *  Params       :   store 用户存储, low/high ID范围, max_rows 最多列出的行数
+ *   Returns      :   *DryRunResult 预演结果， error nil表示成功　非nil表示失败
+ */
+func (usr *User) PreviewDelete(store UserStore, low, high, max_rows int) (*DryRunResult, error) {
+	result, matched, err := preview(store, DRY_RUN_DELETE, *usr, low, high, max_rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, before := range matched {
+		result.Rows = append(result.Rows, RowPreview{ID: before.ID, Before: before, Changes: DiffUser(&before, &User{})})
+	}
+	return result, nil
+}
+
+/*
+ *  Description:    统计并列出满足条件的行
+ */
+func preview(store UserStore, operation string, cond User, low, high, max_rows int) (*DryRunResult, UserList, error) {
+	u_pack := &UserQueryPack{Usr: cond, Offset: -1, Limit: max_rows, Order: 1, IDRange: Range{low, high}}
+
+	affected, err := store.CountUsers(u_pack)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matched := UserList{}
+	if err := store.FetchUsers(&matched, u_pack); err != nil {
+		return nil, nil, err
+	}
+
+	result := &DryRunResult{
+		Operation: operation,
+		Affected:  affected,
+		Truncated: len(matched) < affected,
+		Rows:      []RowPreview{},
+	}
+	return result, matched, nil
+}
+
+/*
+ *  Description:    比较两个用户的字段(不包括ID)，返回有变化的字段
+ *   Returns      :   字段名 -> 修改前后的值
+ */
+func DiffUser(before, after *User) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	if before.Name != after.Name {
+		changes["name"] = FieldChange{Before: before.Name, After: after.Name}
+	}
+	if before.Gender != after.Gender {
+		changes["gender"] = FieldChange{Before: before.Gender, After: after.Gender}
+	}
+	if before.Birthday != after.Birthday {
+		changes["birthday"] = FieldChange{Before: string(before.Birthday), After: string(after.Birthday)}
+	}
+	if before.Email != after.Email {
+		changes["email"] = FieldChange{Before: string(before.Email), After: string(after.Email)}
+	}
+	if before.Phone != after.Phone {
+		changes["phone"] = FieldChange{Before: string(before.Phone), After: string(after.Phone)}
+	}
+
+	//自定义属性以 attr.<属性名> 表示
+	names := Attributes{}
+	for name := range before.Attributes {
+		names[name] = nil
+	}
+	for name := range after.Attributes {
+		names[name] = nil
+	}
+	for _, name := range names.names() {
+		old, new := attributeString(before.Attributes, name), attributeString(after.Attributes, name)
+		if old != new {
+			changes["attr."+name] = FieldChange{Before: old, After: new}
+		}
+	}
+	return changes
+}
+
+/*
+ *  Description:    获取属性值的字符串形式，没有该属性时为空字符串
+ */
+func attributeString(attrs Attributes, name string) string {
+	if value, ok := attrs[name]; ok && value != nil {
+		return EncodeAttribute(value)
+	}
+	return ""
+}
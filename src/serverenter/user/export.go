@@ -0,0 +1,85 @@
+/*
+ 导出用户，逐个读取用户写到输出中，内存占用与用户总数无关
+ 1. mysql 从游标(sql.Rows)逐行读取，自定义属性每 EXPORT_CHUNK_SIZE 个用户加载一次
+ 2. CSV 的列为选择的字段(默认为全部字段)和自定义属性 attr.<属性名>，值与 json 输出相同
+*/
+package USER
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+//导出时每次加载自定义属性的用户数
+const EXPORT_CHUNK_SIZE = 500
+
+//默认导出的用户字段，另外每个自定义属性一列
+var export_columns = []string{"id", "name", "gender", "birthday", "email", "phone", "version"}
+
+/*
+ *  Description:    导出 CSV 的列名
+ *  Params       :   defs 全部属性定义, labels 是否在 gender 后输出性别的本地化名称 gender_label
+ *   Returns      :   []string 列名，fields 为 nil 时为全部字段和全部自定义属性
+ */
+func (fields *FieldSet) CSVColumns(defs AttributeDefinitions, labels bool) []string {
+	names := export_columns
+	if fields != nil {
+		names = make([]string, len(fields.fields))
+		for i, field := range fields.fields {
+			names[i] = field.name
+		}
+	}
+
+	columns := []string{}
+	for _, name := range names {
+		columns = append(columns, name)
+		if name == "gender" && labels {
+			columns = append(columns, "gender_label")
+		}
+	}
+	for _, def := range defs {
+		if fields == nil || fields.attributes || fields.attr_names[def.Name] {
+			columns = append(columns, "attr."+def.Name)
+		}
+	}
+	return columns
+}
+
+/*
+ *  Description:    用户在每一列上的值，没有值时为空字符串
+ *  Params       :   usr 用户, columns CSVColumns 返回的列名
+ */
+func CSVRecord(usr *User, columns []string) []string {
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		switch column {
+		case "id":
+			record[i] = strconv.Itoa(usr.ID)
+		case "name":
+			record[i] = usr.Name
+		case "gender":
+			record[i] = usr.Gender
+		case "gender_label":
+			record[i] = usr.GenderLabel
+		case "birthday":
+			record[i] = string(usr.Birthday)
+		case "email":
+			record[i] = string(usr.Email)
+		case "phone":
+			record[i] = string(usr.Phone)
+		case "version":
+			record[i] = strconv.Itoa(usr.Version)
+		case "deleted_at":
+			if !usr.DeletedAt.IsZero() {
+				record[i] = usr.DeletedAt.Format(time.RFC3339)
+			}
+		default:
+			value, ok := usr.Attributes[strings.TrimPrefix(column, "attr.")]
+			if ok && value != nil {
+				record[i] = EncodeAttribute(value)
+			}
+		}
+	}
+	return record
+}
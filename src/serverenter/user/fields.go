@@ -0,0 +1,162 @@
+/*
+ 查询用户时只返回部分字段，例如 fields=id,name,attr.level
+ 1. 字段为 id, name, gender, birthday, email, phone, version, deleted_at, attributes(全部自定义属性) 或 attr.<属性名>
+ 2. mysql 只查询需要的列，另外总是查询 id, version(ETag) 和排序字段(游标)
+ 3. 没有自定义属性的字段时不加载属性值
+ 4. 输出的键名与完整的用户相同，gender 带上 GenderLabel
+*/
+package USER
+
+import (
+	"fmt"
+	"strings"
+)
+
+//fields 中的字段无效
+type FieldsError struct {
+	Field   string   `json:"field"`
+	Message string   `json:"message"`
+	Allowed []string `json:"allowed"`
+}
+
+func (err *FieldsError) Error() string {
+	return fmt.Sprintf("字段 %q %s，允许的字段: %s", err.Field, err.Message, strings.Join(err.Allowed, ", "))
+}
+
+//可以选择的用户字段，列名 -> 输出的键名和值
+type userField struct {
+	name  string
+	key   string
+	value func(usr *User) interface{}
+}
+
+var user_fields = []userField{
+	{"id", "ID", func(usr *User) interface{} { return usr.ID }},
+	{"name", "Name", func(usr *User) interface{} { return usr.Name }},
+	{"gender", "Gender", func(usr *User) interface{} { return usr.Gender }},
+	{"birthday", "Birthday", func(usr *User) interface{} { return usr.Birthday }},
+	{"email", "Email", func(usr *User) interface{} { return usr.Email }},
+	{"phone", "Phone", func(usr *User) interface{} { return usr.Phone }},
+	{"version", "Version", func(usr *User) interface{} { return usr.Version }},
+	{"deleted_at", "DeletedAt", func(usr *User) interface{} { return usr.DeletedAt }},
+}
+
+//选择的字段，nil 表示全部字段
+type FieldSet struct {
+	fields     []userField     //选择的用户字段，按 user_fields 的顺序
+	attributes bool            //全部自定义属性
+	attr_names map[string]bool //选择的自定义属性
+}
+
+/*
+ *  Description:    解析 fields 参数，字段用逗号分隔
+ *  Params       :   source fields 参数, defs 全部属性定义，用于校验 attr.<属性名>
+ *   Returns      :   *FieldSet 选择的字段， error 字段无效时返回 *FieldsError
+ */
+func ParseFields(source string, defs AttributeDefinitions) (*FieldSet, error) {
+	allowed := make([]string, 0, len(user_fields)+2)
+	for _, field := range user_fields {
+		allowed = append(allowed, field.name)
+	}
+	allowed = append(allowed, "attributes", "attr.<属性名>")
+
+	selected := make(map[string]bool)
+	fields := &FieldSet{attr_names: make(map[string]bool)}
+	for _, part := range strings.Split(source, ",") {
+		name := strings.TrimSpace(part)
+		switch {
+		case name == "":
+			return nil, &FieldsError{Field: name, Message: "为空", Allowed: allowed}
+		case name == "attributes":
+			fields.attributes = true
+		case strings.HasPrefix(name, "attr."):
+			attr := strings.TrimPrefix(name, "attr.")
+			if defs.Find(attr) == nil {
+				return nil, &FieldsError{Field: name, Message: "没有定义", Allowed: allowed}
+			}
+			fields.attr_names[attr] = true
+		default:
+			found := false
+			for _, field := range user_fields {
+				found = found || field.name == name
+			}
+			if !found {
+				return nil, &FieldsError{Field: name, Message: "不存在", Allowed: allowed}
+			}
+			selected[name] = true
+		}
+	}
+	for _, field := range user_fields {
+		if selected[field.name] {
+			fields.fields = append(fields.fields, field)
+		}
+	}
+	return fields, nil
+}
+
+/*
+ *  Description:    是否需要加载自定义属性
+ */
+func (fields *FieldSet) wantsAttributes() bool {
+	return fields == nil || fields.attributes || len(fields.attr_names) != 0
+}
+
+/*
+ *  Description:    sql 查询的列，包括选择的字段，id, version 和排序字段
+ */
+func (fields *FieldSet) columns(order Sort) string {
+	need := map[string]bool{"id": true, "version": true}
+	for _, field := range fields.fields {
+		need[field.name] = true
+	}
+	for _, field := range order {
+		need[field.Name] = true
+	}
+
+	columns := []string{}
+	for _, field := range user_fields {
+		if need[field.name] {
+			columns = append(columns, "`"+field.name+"`")
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+/*
+ *  Description:    只保留用户选择的字段
+ *   Returns      :   map[string]interface{} 输出的键名 -> 值
+ */
+func (fields *FieldSet) Project(usr *User) map[string]interface{} {
+	result := make(map[string]interface{}, len(fields.fields)+1)
+	for _, field := range fields.fields {
+		result[field.key] = field.value(usr)
+		if field.name == "gender" && usr.GenderLabel != "" {
+			result["GenderLabel"] = usr.GenderLabel
+		}
+	}
+
+	attrs := usr.Attributes
+	if !fields.attributes {
+		attrs = Attributes{}
+		for name := range fields.attr_names {
+			if value, ok := usr.Attributes[name]; ok {
+				attrs[name] = value
+			}
+		}
+	}
+	if len(attrs) != 0 {
+		result["Attributes"] = attrs
+	}
+	return result
+}
+
+/*
+ *  Description:    只保留用户列表中每个用户选择的字段
+ */
+func (fields *FieldSet) ProjectList(usr_list UserList) []map[string]interface{} {
+	result := make([]map[string]interface{}, len(usr_list))
+	for i := range usr_list {
+		result[i] = fields.Project(&usr_list[i])
+	}
+	return result
+}
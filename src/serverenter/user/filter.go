@@ -0,0 +1,827 @@
+/*
+ GET /user 的 filter 表达式
+   expr       := and_expr ("or" and_expr)*
+   and_expr   := unary ("and" unary)*
+   unary      := "not" unary | "(" expr ")" | condition
+   condition  := field op value
+               | field ["not"] "in" "(" value ("," value)* ")"
+               | field ("startswith" | "contains") string
+               | field "is" ["not"] "null"
+   op         := "=" | "!=" | "<>" | "<" | "<=" | ">" | ">=" | "~"
+   value      := "字符串" | 整数 | 日期(1990-01-01) | true | false
+ 1. field 为 id, name, gender, birthday, email, phone, version 或 attr.<属性名>
+ 2. ~ 为 LIKE 匹配，% 匹配任意个字符，_ 匹配一个字符，\ 转义
+ 3. 关键字不区分大小写，字段的值按字段类型校验，gender, email, phone 与输入时一样规范化
+ 4. 没有值(NULL, name 和 gender 为空字符串)的字段只满足 is null，不满足任何比较，包括 !=
+ 5. mysql 中字符串的比较按列的排序规则，内存存储中区分大小写
+ 6. 表达式转换成参数化的查询条件，值不会拼接到 sql 中
+*/
+package USER
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//filter 表达式的最大长度(字符数)
+const MAX_FILTER_LENGTH = 2048
+
+//filter 表达式的语法或语义错误
+type FilterError struct {
+	Position int    `json:"position"` //出错的位置，从1开始的字符序号
+	Message  string `json:"message"`
+}
+
+func (err *FilterError) Error() string {
+	return fmt.Sprintf("filter 第 %d 个字符: %s", err.Position, err.Message)
+}
+
+//校验和规范化字段值需要的信息
+type FilterOptions struct {
+	Genders     *GenderVocabulary
+	CountryCode string
+	Definitions AttributeDefinitions
+}
+
+//解析后的 filter 表达式
+type Filter struct {
+	source string
+	root   filterNode
+}
+
+/*
+ *  Description:    解析 filter 表达式
+ *  Params       :   source 表达式, opts 校验字段值需要的信息
+ *   Returns      :   *Filter 解析后的表达式， error 错误时返回带位置的 *FilterError
+ */
+func ParseFilter(source string, opts *FilterOptions) (*Filter, error) {
+	if len([]rune(source)) > MAX_FILTER_LENGTH {
+		return nil, &FilterError{Position: MAX_FILTER_LENGTH, Message: fmt.Sprintf("表达式超过 %d 个字符", MAX_FILTER_LENGTH)}
+	}
+	tokens, err := lexFilter(source)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens, opts: opts}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := parser.peek(); tok.kind != tokEOF {
+		return nil, tok.errorf("多余的 %s", tok)
+	}
+	return &Filter{source: source, root: root}, nil
+}
+
+func (filter *Filter) String() string {
+	return filter.source
+}
+
+/*
+ *  Description:    转换成参数化的 sql 条件
+ *   Returns      :   string 带 ? 占位符的条件， []interface{} 参数
+ */
+func (filter *Filter) SQL() (string, []interface{}) {
+	args := []interface{}{}
+	return filter.root.sql(&args), args
+}
+
+/*
+ *  Description:    判断用户是否满足表达式，用于内存存储
+ *  Params       :   usr 用户, attrs 用户的属性值(编码后的字符串)
+ */
+func (filter *Filter) Match(usr *User, attrs map[string]string) bool {
+	return filter.root.match(usr, attrs)
+}
+
+/* ---------- 词法分析 ---------- */
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDate
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type filterToken struct {
+	kind int
+	text string //标识符，运算符的原文，字符串的内容
+	pos  int    //从1开始的字符序号
+}
+
+func (tok filterToken) String() string {
+	switch tok.kind {
+	case tokEOF:
+		return "表达式结尾"
+	case tokString:
+		return strconv.Quote(tok.text)
+	}
+	return "'" + tok.text + "'"
+}
+
+func (tok filterToken) errorf(format string, args ...interface{}) *FilterError {
+	return &FilterError{Position: tok.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+//是否为指定的关键字，不区分大小写
+func (tok filterToken) is(keyword string) bool {
+	return tok.kind == tokIdent && strings.EqualFold(tok.text, keyword)
+}
+
+var filter_date = regexp.MustCompile(`^\d{4}-\d{1,2}-\d{1,2}$`)
+
+func lexFilter(source string) ([]filterToken, error) {
+	runes := []rune(source)
+	tokens := []filterToken{}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, filterToken{kind: tokLParen, text: "(", pos: start + 1})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{kind: tokRParen, text: ")", pos: start + 1})
+			i++
+		case r == ',':
+			tokens = append(tokens, filterToken{kind: tokComma, text: ",", pos: start + 1})
+			i++
+		case r == '"':
+			text, end, err := lexString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{kind: tokString, text: text, pos: start + 1})
+			i = end
+		case strings.ContainsRune("=!<>~", r):
+			op := string(r)
+			if i+1 < len(runes) {
+				if two := string(runes[i : i+2]); two == "!=" || two == "<>" || two == "<=" || two == ">=" {
+					op = two
+				}
+			}
+			if op == "!" {
+				return nil, &FilterError{Position: start + 1, Message: "无效的运算符 '!'，不等于请使用 !="}
+			}
+			tokens = append(tokens, filterToken{kind: tokOp, text: op, pos: start + 1})
+			i += len([]rune(op))
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			i++
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '-') {
+				i++
+			}
+			text := string(runes[start:i])
+			kind := tokNumber
+			if filter_date.MatchString(text) {
+				kind = tokDate
+			} else if _, err := strconv.ParseInt(text, 10, 64); err != nil {
+				return nil, &FilterError{Position: start + 1, Message: fmt.Sprintf("无效的数字或日期 %q", text)}
+			}
+			tokens = append(tokens, filterToken{kind: kind, text: text, pos: start + 1})
+		case r == '_' || unicode.IsLetter(r):
+			i++
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '.' || unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokIdent, text: string(runes[start:i]), pos: start + 1})
+		default:
+			return nil, &FilterError{Position: start + 1, Message: fmt.Sprintf("无效的字符 %q", r)}
+		}
+	}
+	return append(tokens, filterToken{kind: tokEOF, pos: len(runes) + 1}), nil
+}
+
+/*
+ *  Description:    读取双引号字符串，支持 \" 和 \\ 转义，其他 \x 原样保留(用于 LIKE 的转义)
+ *   Returns      :   string 内容， int 结束引号之后的位置
+ */
+func lexString(runes []rune, start int) (string, int, error) {
+	var text strings.Builder
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case '"':
+			return text.String(), i + 1, nil
+		case '\\':
+			if i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+				i++
+			}
+		}
+		text.WriteRune(runes[i])
+	}
+	return "", 0, &FilterError{Position: start + 1, Message: "字符串没有结束的引号"}
+}
+
+/* ---------- 语法分析 ---------- */
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+	opts   *FilterOptions
+	depth  int
+}
+
+//括号的最大嵌套层数
+const max_filter_depth = 32
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	tok := p.tokens[p.next]
+	if tok.kind != tokEOF {
+		p.next++
+	}
+	return tok
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("or") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("and") {
+		p.take()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterLogic{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	tok := p.peek()
+	if (tok.is("not") || tok.kind == tokLParen) && p.depth >= max_filter_depth {
+		return nil, tok.errorf("嵌套超过 %d 层", max_filter_depth)
+	}
+
+	switch {
+	case tok.is("not"):
+		p.take()
+		p.depth++
+		node, err := p.parseUnary()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node: node}, nil
+	case tok.kind == tokLParen:
+		p.take()
+		p.depth++
+		node, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != tokRParen {
+			return nil, closing.errorf("缺少 ')'，遇到 %s", closing)
+		}
+		return node, nil
+	}
+	return p.parseCondition()
+}
+
+func (p *filterParser) parseCondition() (filterNode, error) {
+	tok := p.take()
+	if tok.kind != tokIdent || isFilterKeyword(tok.text) {
+		return nil, tok.errorf("应该是字段名，遇到 %s", tok)
+	}
+	field, err := p.resolveField(tok)
+	if err != nil {
+		return nil, err
+	}
+
+	op_tok := p.take()
+	cond := &filterCompare{field: field}
+	switch {
+	case op_tok.kind == tokOp:
+		cond.op = op_tok.text
+		if cond.op == "<>" {
+			cond.op = "!="
+		}
+		if cond.op == "~" {
+			cond.op = "like"
+		}
+		value, err := p.parseValue(field, cond.op)
+		if err != nil {
+			return nil, err
+		}
+		cond.values = []interface{}{value}
+	case op_tok.is("startswith"), op_tok.is("contains"):
+		value_tok := p.take()
+		if value_tok.kind != tokString {
+			return nil, value_tok.errorf("%s 后面应该是字符串，遇到 %s", op_tok.text, value_tok)
+		}
+		pattern := escapeLike(value_tok.text) + "%"
+		if op_tok.is("contains") {
+			pattern = "%" + pattern
+		}
+		cond.op = "like"
+		cond.values = []interface{}{pattern}
+	case op_tok.is("in"), op_tok.is("not") && p.peek().is("in"):
+		cond.op = "in"
+		if op_tok.is("not") {
+			p.take()
+			cond.op = "not in"
+		}
+		if cond.values, err = p.parseList(field); err != nil {
+			return nil, err
+		}
+	case op_tok.is("is"):
+		cond.op = "is null"
+		if p.peek().is("not") {
+			p.take()
+			cond.op = "is not null"
+		}
+		if null_tok := p.take(); !null_tok.is("null") {
+			return nil, null_tok.errorf("is 后面应该是 null 或 not null，遇到 %s", null_tok)
+		}
+		return cond, nil
+	default:
+		return nil, op_tok.errorf("应该是运算符，遇到 %s", op_tok)
+	}
+
+	if !field.allows(cond.op) {
+		return nil, op_tok.errorf("字段 %s 不支持运算符 %s", field.name, op_tok.text)
+	}
+	if cond.op == "like" {
+		cond.like = likeRegexp(cond.values[0].(string))
+	}
+	return cond, nil
+}
+
+func (p *filterParser) parseList(field *filterField) ([]interface{}, error) {
+	if tok := p.take(); tok.kind != tokLParen {
+		return nil, tok.errorf("in 后面应该是 '('，遇到 %s", tok)
+	}
+	values := []interface{}{}
+	for {
+		value, err := p.parseValue(field, "in")
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		tok := p.take()
+		if tok.kind == tokRParen {
+			return values, nil
+		}
+		if tok.kind != tokComma {
+			return nil, tok.errorf("应该是 ',' 或 ')'，遇到 %s", tok)
+		}
+	}
+}
+
+/*
+ *  Description:    读取一个值，并按字段类型转换和规范化
+ */
+func (p *filterParser) parseValue(field *filterField, op string) (interface{}, error) {
+	tok := p.take()
+	var raw interface{}
+	switch tok.kind {
+	case tokString, tokDate:
+		raw = tok.text
+	case tokNumber:
+		n, _ := strconv.ParseInt(tok.text, 10, 64)
+		raw = n
+	case tokIdent:
+		if !tok.is("true") && !tok.is("false") {
+			return nil, tok.errorf("应该是值，遇到 %s", tok)
+		}
+		raw = tok.is("true")
+	default:
+		return nil, tok.errorf("应该是值，遇到 %s", tok)
+	}
+
+	value, err := field.convert(raw)
+	if err == nil {
+		value, err = p.normalize(field, op, value)
+	}
+	if err != nil {
+		return nil, tok.errorf("%s", err.Error())
+	}
+	return value, nil
+}
+
+func isFilterKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "and", "or", "not", "in", "is", "null", "true", "false", "startswith", "contains":
+		return true
+	}
+	return false
+}
+
+/*
+ *  Description:    转义 LIKE 中的通配符
+ */
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+/* ---------- 字段 ---------- */
+
+//字段值的类型
+const (
+	fieldInt = iota
+	fieldString
+	fieldDate
+	fieldBool
+)
+
+type filterField struct {
+	name     string
+	column   string               //user 表中的列，自定义属性为空
+	attr     *AttributeDefinition //自定义属性的定义
+	kind     int
+	nullable bool //空值存为 NULL, 否则空字符串也是值
+}
+
+func (p *filterParser) resolveField(tok filterToken) (*filterField, error) {
+	name := tok.text
+	switch strings.ToLower(name) {
+	case "id", "version":
+		return &filterField{name: name, column: strings.ToLower(name), kind: fieldInt}, nil
+	case "name", "gender":
+		return &filterField{name: name, column: strings.ToLower(name), kind: fieldString}, nil
+	case "email", "phone":
+		return &filterField{name: name, column: strings.ToLower(name), kind: fieldString, nullable: true}, nil
+	case "birthday":
+		return &filterField{name: name, column: "birthday", kind: fieldDate, nullable: true}, nil
+	}
+
+	if strings.HasPrefix(name, "attr.") {
+		def := p.opts.Definitions.Find(strings.TrimPrefix(name, "attr."))
+		if def == nil {
+			return nil, tok.errorf("属性 %s 没有定义", strings.TrimPrefix(name, "attr."))
+		}
+		field := &filterField{name: name, attr: def, kind: fieldString, nullable: true}
+		switch def.Type {
+		case ATTR_INT:
+			field.kind = fieldInt
+		case ATTR_BOOL:
+			field.kind = fieldBool
+		case ATTR_DATE:
+			field.kind = fieldDate
+		}
+		return field, nil
+	}
+	return nil, tok.errorf("未知的字段 %s，允许 id, name, gender, birthday, email, phone, version, attr.<属性名>", name)
+}
+
+/*
+ *  Description:    判断字段类型是否支持运算符
+ */
+func (field *filterField) allows(op string) bool {
+	switch op {
+	case "like":
+		return field.kind == fieldString
+	case "<", "<=", ">", ">=":
+		return field.kind != fieldBool
+	}
+	return true
+}
+
+/*
+ *  Description:    把表达式中的值转换成字段的类型
+ */
+func (field *filterField) convert(raw interface{}) (interface{}, error) {
+	switch field.kind {
+	case fieldInt:
+		n, ok := raw.(int64)
+		if !ok {
+			return nil, fmt.Errorf("字段 %s 的值应该是整数", field.name)
+		}
+		return n, nil
+	case fieldBool:
+		b, ok := raw.(bool)
+		if !ok {
+			return nil, fmt.Errorf("字段 %s 的值应该是 true 或 false", field.name)
+		}
+		return b, nil
+	case fieldDate:
+		str, ok := raw.(string)
+		if !ok {
+			return nil, fmt.Errorf("字段 %s 的值应该是日期", field.name)
+		}
+		date, err := ParseDate(str)
+		if err != nil {
+			return nil, fmt.Errorf("字段 %s 的值 %q 不是有效的日期", field.name, str)
+		}
+		return string(date), nil
+	}
+
+	var str string
+	switch v := raw.(type) {
+	case string:
+		str = v
+	case int64:
+		str = strconv.FormatInt(v, 10)
+	default:
+		return nil, fmt.Errorf("字段 %s 的值应该是字符串", field.name)
+	}
+	return str, nil
+}
+
+/*
+ *  Description:    等值比较的值与输入时一样规范化，LIKE 和大小比较只把邮箱转为小写
+ */
+func (p *filterParser) normalize(field *filterField, op string, value interface{}) (interface{}, error) {
+	str, ok := value.(string)
+	if !ok || field.attr != nil {
+		return value, nil
+	}
+	exact := op == "=" || op == "!=" || op == "in" || op == "not in"
+	switch field.column {
+	case "gender":
+		if exact && p.opts.Genders != nil {
+			return p.opts.Genders.Normalize(str)
+		}
+	case "email":
+		if exact {
+			email, err := NormalizeEmail(str)
+			return string(email), err
+		}
+		return strings.ToLower(str), nil
+	case "phone":
+		if exact {
+			phone, err := NormalizePhone(str, p.opts.CountryCode)
+			return string(phone), err
+		}
+	}
+	return str, nil
+}
+
+/* ---------- 语法树 ---------- */
+
+type filterNode interface {
+	sql(args *[]interface{}) string
+	match(usr *User, attrs map[string]string) bool
+}
+
+type filterLogic struct {
+	op    string //AND 或 OR
+	left  filterNode
+	right filterNode
+}
+
+func (node *filterLogic) sql(args *[]interface{}) string {
+	return "(" + node.left.sql(args) + " " + node.op + " " + node.right.sql(args) + ")"
+}
+
+func (node *filterLogic) match(usr *User, attrs map[string]string) bool {
+	if node.op == "AND" {
+		return node.left.match(usr, attrs) && node.right.match(usr, attrs)
+	}
+	return node.left.match(usr, attrs) || node.right.match(usr, attrs)
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+func (node *filterNot) sql(args *[]interface{}) string {
+	return "(NOT " + node.node.sql(args) + ")"
+}
+
+func (node *filterNot) match(usr *User, attrs map[string]string) bool {
+	return !node.node.match(usr, attrs)
+}
+
+type filterCompare struct {
+	field  *filterField
+	op     string //=, !=, <, <=, >, >=, like, in, not in, is null, is not null
+	values []interface{}
+	like   *regexp.Regexp //内存存储中 LIKE 使用的正则表达式
+}
+
+func (node *filterCompare) sql(args *[]interface{}) string {
+	if node.field.attr != nil {
+		return node.attrSQL(args)
+	}
+
+	col := node.field.column
+	switch node.op {
+	case "is null":
+		if node.field.nullable {
+			return "(" + col + " IS NULL)"
+		}
+		return "(" + col + " IS NULL OR " + col + " = '')"
+	case "is not null":
+		if node.field.nullable {
+			return "(" + col + " IS NOT NULL)"
+		}
+		return "(" + col + " IS NOT NULL AND " + col + " <> '')"
+	}
+	//NULL 参与比较的结果为 NULL, 加上 IS NOT NULL 使结果为 false, not 的结果才与内存存储一致
+	//name, gender 的空字符串与 is null 一样按没有值处理，不满足任何比较
+	if !node.field.nullable && node.field.kind == fieldString {
+		return "(" + col + " IS NOT NULL AND " + col + " <> '' AND " + col + " " + node.valueSQL(args) + ")"
+	}
+	return "(" + col + " IS NOT NULL AND " + col + " " + node.valueSQL(args) + ")"
+}
+
+/*
+ *  Description:    自定义属性的条件，转换成 user_attribute 表上的子查询
+ */
+func (node *filterCompare) attrSQL(args *[]interface{}) string {
+	subquery := "SELECT ua.user_id FROM user_attribute ua JOIN attribute_definition ad ON ad.id = ua.attribute_id WHERE ad.name = ?"
+	*args = append(*args, node.field.attr.Name)
+	switch node.op {
+	case "is null":
+		return "(id NOT IN (" + subquery + "))"
+	case "is not null":
+		return "(id IN (" + subquery + "))"
+	}
+
+	value := "ua.value"
+	if node.field.kind == fieldInt {
+		value = "CAST(ua.value AS SIGNED)"
+	}
+	return "(id IN (" + subquery + " AND " + value + " " + node.valueSQL(args) + "))"
+}
+
+/*
+ *  Description:    运算符和参数部分，例如 "= ?", "IN (?, ?)"
+ */
+func (node *filterCompare) valueSQL(args *[]interface{}) string {
+	values := node.values
+	if node.field.attr != nil && node.field.kind != fieldInt {
+		values = make([]interface{}, len(node.values))
+		for i, value := range node.values {
+			values[i] = EncodeAttribute(value)
+		}
+	}
+
+	switch node.op {
+	case "in", "not in":
+		marks := make([]string, len(values))
+		for i := range values {
+			marks[i] = "?"
+		}
+		*args = append(*args, values...)
+		return strings.ToUpper(node.op) + " (" + strings.Join(marks, ", ") + ")"
+	case "like":
+		*args = append(*args, values[0])
+		return "LIKE ?"
+	}
+	*args = append(*args, values[0])
+	return node.op + " ?"
+}
+
+func (node *filterCompare) match(usr *User, attrs map[string]string) bool {
+	actual, ok := node.actual(usr, attrs)
+	switch node.op {
+	case "is null":
+		return !ok
+	case "is not null":
+		return ok
+	}
+	if !ok {
+		return false
+	}
+
+	switch node.op {
+	case "in", "not in":
+		found := false
+		for _, value := range node.values {
+			if compareFilterValue(actual, value) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (node.op == "in")
+	case "like":
+		return node.like.MatchString(actual.(string))
+	}
+
+	cmp := compareFilterValue(actual, node.values[0])
+	switch node.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+/*
+ *  Description:    获取用户的字段值
+ *   Returns      :   interface{} 字段值(int64, string, bool)， bool 是否有值
+ */
+func (node *filterCompare) actual(usr *User, attrs map[string]string) (interface{}, bool) {
+	if def := node.field.attr; def != nil {
+		raw, ok := attrs[def.Name]
+		if !ok {
+			return nil, false
+		}
+		value, err := def.decode(raw)
+		return value, err == nil
+	}
+
+	switch node.field.column {
+	case "id":
+		return int64(usr.ID), true
+	case "version":
+		return int64(usr.Version), true
+	case "name":
+		return usr.Name, usr.Name != ""
+	case "gender":
+		return usr.Gender, usr.Gender != ""
+	case "birthday":
+		return string(usr.Birthday), usr.Birthday != ""
+	case "email":
+		return string(usr.Email), usr.Email != ""
+	case "phone":
+		return string(usr.Phone), usr.Phone != ""
+	}
+	return nil, false
+}
+
+/*
+ *  Description:    比较两个同类型的值
+ *   Returns      :   <0 a 小于 b, 0 相等, >0 a 大于 b
+ */
+func compareFilterValue(a, b interface{}) int {
+	switch av := a.(type) {
+	case int64:
+		bv, _ := b.(int64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+		return 0
+	case bool:
+		bv, _ := b.(bool)
+		if av == bv {
+			return 0
+		}
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+/*
+ *  Description:    把 LIKE 模式转换成正则表达式，\ 转义下一个字符
+ */
+func likeRegexp(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("(?s)^")
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		case '\\':
+			if i+1 < len(runes) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
@@ -0,0 +1,223 @@
+package USER
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//子查询的公共部分，见 attrSQL
+const test_attr_subquery = "SELECT ua.user_id FROM user_attribute ua JOIN attribute_definition ad ON ad.id = ua.attribute_id WHERE ad.name = ?"
+
+func testFilterOptions(t *testing.T) *FilterOptions {
+	genders, err := NewGenderVocabulary(nil)
+	if err != nil {
+		t.Fatalf("NewGenderVocabulary: %v", err)
+	}
+	return &FilterOptions{
+		Genders:     genders,
+		CountryCode: "86",
+		Definitions: AttributeDefinitions{
+			{ID: 1, Name: "level", Type: ATTR_INT},
+			{ID: 2, Name: "vip", Type: ATTR_BOOL},
+			{ID: 3, Name: "city", Type: ATTR_STRING},
+		},
+	}
+}
+
+//测试用的用户和属性值，2 没有任何值
+var test_filter_users = []struct {
+	usr   User
+	attrs map[string]string
+}{
+	{User{ID: 1, Name: "Alice", Gender: "female", Birthday: "1990-01-01", Email: "alice@x.com", Phone: "+8613800138000", Version: 1},
+		map[string]string{"level": "3", "vip": "true", "city": "bj"}},
+	{User{ID: 2, Version: 1}, nil},
+	{User{ID: 3, Name: "Bob", Gender: "male", Birthday: "1985-06-15", Phone: "+8613900139000", Version: 2},
+		map[string]string{"level": "10", "vip": "false"}},
+	{User{ID: 4, Name: `a%b_c\d`, Gender: "male", Email: "c@x.com", Version: 1},
+		map[string]string{"city": "sh"}},
+}
+
+func mustParseFilter(t *testing.T, source string) *Filter {
+	t.Helper()
+	filter, err := ParseFilter(source, testFilterOptions(t))
+	if err != nil {
+		t.Fatalf("ParseFilter(%q): %v", source, err)
+	}
+	return filter
+}
+
+func matchedIDs(filter *Filter) []int {
+	ids := []int{}
+	for _, u := range test_filter_users {
+		if filter.Match(&u.usr, u.attrs) {
+			ids = append(ids, u.usr.ID)
+		}
+	}
+	return ids
+}
+
+/*
+ *  Description:    每个表达式同时检查生成的 sql 和内存存储的匹配结果，ids 为 mysql 中 sql 条件选中的用户
+ */
+func TestFilterSQLMatchParity(t *testing.T) {
+	cases := []struct {
+		source string
+		sql    string
+		args   []interface{}
+		ids    []int
+	}{
+		//name, gender 的空字符串没有值，只满足 is null
+		{`name = "Alice"`, "(name IS NOT NULL AND name <> '' AND name = ?)", []interface{}{"Alice"}, []int{1}},
+		{`name != "Alice"`, "(name IS NOT NULL AND name <> '' AND name != ?)", []interface{}{"Alice"}, []int{3, 4}},
+		{`name <> "Alice"`, "(name IS NOT NULL AND name <> '' AND name != ?)", []interface{}{"Alice"}, []int{3, 4}},
+		{`not name = "Alice"`, "(NOT (name IS NOT NULL AND name <> '' AND name = ?))", []interface{}{"Alice"}, []int{2, 3, 4}},
+		{`name = ""`, "(name IS NOT NULL AND name <> '' AND name = ?)", []interface{}{""}, []int{}},
+		{`name is null`, "(name IS NULL OR name = '')", []interface{}{}, []int{2}},
+		{`gender IS NOT NULL`, "(gender IS NOT NULL AND gender <> '')", []interface{}{}, []int{1, 3, 4}},
+		{`gender = "m"`, "(gender IS NOT NULL AND gender <> '' AND gender = ?)", []interface{}{"male"}, []int{3, 4}},
+		{`gender != "女"`, "(gender IS NOT NULL AND gender <> '' AND gender != ?)", []interface{}{"female"}, []int{3, 4}},
+
+		//email, phone, birthday 的空值为 NULL
+		{`email is null`, "(email IS NULL)", []interface{}{}, []int{2, 3}},
+		{`email != "alice@x.com"`, "(email IS NOT NULL AND email != ?)", []interface{}{"alice@x.com"}, []int{4}},
+		{`email = "ALICE@X.com"`, "(email IS NOT NULL AND email = ?)", []interface{}{"alice@x.com"}, []int{1}},
+		{`email ~ "ALICE%"`, "(email IS NOT NULL AND email LIKE ?)", []interface{}{"alice%"}, []int{1}},
+		{`phone = "13800138000"`, "(phone IS NOT NULL AND phone = ?)", []interface{}{"+8613800138000"}, []int{1}},
+		{`birthday < 1990-1-1`, "(birthday IS NOT NULL AND birthday < ?)", []interface{}{"1990-01-01"}, []int{3}},
+		{`birthday >= "1985-06-15"`, "(birthday IS NOT NULL AND birthday >= ?)", []interface{}{"1985-06-15"}, []int{1, 3}},
+
+		//整数字段
+		{`id in (1, 3) or id >= 4`, "((id IS NOT NULL AND id IN (?, ?)) OR (id IS NOT NULL AND id >= ?))", []interface{}{int64(1), int64(3), int64(4)}, []int{1, 3, 4}},
+		{`id not in (1)`, "(id IS NOT NULL AND id NOT IN (?))", []interface{}{int64(1)}, []int{2, 3, 4}},
+		{`version > 1 or id = -1`, "((version IS NOT NULL AND version > ?) OR (id IS NOT NULL AND id = ?))", []interface{}{int64(1), int64(-1)}, []int{3}},
+
+		//优先级: not > and > or, 括号
+		{`name startswith "B" or gender = "f" and id > 1`,
+			"((name IS NOT NULL AND name <> '' AND name LIKE ?) OR ((gender IS NOT NULL AND gender <> '' AND gender = ?) AND (id IS NOT NULL AND id > ?)))",
+			[]interface{}{"B%", "female", int64(1)}, []int{3}},
+		{`(name startswith "B" or gender = "f") and id > 1`,
+			"(((name IS NOT NULL AND name <> '' AND name LIKE ?) OR (gender IS NOT NULL AND gender <> '' AND gender = ?)) AND (id IS NOT NULL AND id > ?))",
+			[]interface{}{"B%", "female", int64(1)}, []int{3}},
+		{`NOT NOT id = 2 AND Name IS NULL`, "((NOT (NOT (id IS NOT NULL AND id = ?))) AND (name IS NULL OR name = ''))", []interface{}{int64(2)}, []int{2}},
+
+		//自定义属性，没有值的用户不满足任何比较
+		{`attr.level > 5`, "(id IN (" + test_attr_subquery + " AND CAST(ua.value AS SIGNED) > ?))", []interface{}{"level", int64(5)}, []int{3}},
+		{`not attr.level = 3`, "(NOT (id IN (" + test_attr_subquery + " AND CAST(ua.value AS SIGNED) = ?)))", []interface{}{"level", int64(3)}, []int{2, 3, 4}},
+		{`attr.vip = true`, "(id IN (" + test_attr_subquery + " AND ua.value = ?))", []interface{}{"vip", "true"}, []int{1}},
+		{`attr.city in ("bj", "sh")`, "(id IN (" + test_attr_subquery + " AND ua.value IN (?, ?)))", []interface{}{"city", "bj", "sh"}, []int{1, 4}},
+		{`attr.city is null`, "(id NOT IN (" + test_attr_subquery + "))", []interface{}{"city"}, []int{2, 3}},
+		{`attr.city contains "h"`, "(id IN (" + test_attr_subquery + " AND ua.value LIKE ?))", []interface{}{"city", "%h%"}, []int{4}},
+	}
+
+	for _, c := range cases {
+		filter := mustParseFilter(t, c.source)
+		sql, args := filter.SQL()
+		if sql != c.sql {
+			t.Errorf("%s\n sql  = %s\n want = %s", c.source, sql, c.sql)
+		}
+		if !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s: args = %#v, want %#v", c.source, args, c.args)
+		}
+		if ids := matchedIDs(filter); !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%s: Match = %v, want %v", c.source, ids, c.ids)
+		}
+	}
+}
+
+func TestFilterEscaping(t *testing.T) {
+	cases := []struct {
+		source string
+		arg    string //LIKE 或比较的参数
+		ids    []int
+	}{
+		//字符串中 \" 和 \\ 转义
+		{`name = "a%b_c\\d"`, `a%b_c\d`, []int{4}},
+		{`name = "say \"hi\""`, `say "hi"`, []int{}},
+		//startswith, contains 的值中的通配符按字面匹配
+		{`name contains "%b_c\\"`, `%\%b\_c\\%`, []int{4}},
+		{`name startswith "a%"`, `a\%%`, []int{4}},
+		{`name startswith "A"`, `A%`, []int{1}},
+		//~ 的值是 LIKE 模式，\ 转义下一个字符
+		{`name ~ "a\%b\_c%"`, `a\%b\_c%`, []int{4}},
+		{`name ~ "a_b%"`, `a_b%`, []int{4}},
+		{`name ~ "a_c%"`, `a_c%`, []int{}},
+		{`name ~ "_lic_"`, `_lic_`, []int{1}},
+		{`name ~ "%\\\\d"`, `%\\d`, []int{4}},
+	}
+
+	for _, c := range cases {
+		filter := mustParseFilter(t, c.source)
+		_, args := filter.SQL()
+		if len(args) != 1 || args[0] != c.arg {
+			t.Errorf("%s: args = %#v, want [%q]", c.source, args, c.arg)
+		}
+		if ids := matchedIDs(filter); !reflect.DeepEqual(ids, c.ids) {
+			t.Errorf("%s: Match = %v, want %v", c.source, ids, c.ids)
+		}
+	}
+
+	//LIKE 在内存存储中不区分行，. 匹配换行
+	filter := mustParseFilter(t, `name ~ "a%b"`)
+	if !filter.Match(&User{Name: "a\nb"}, nil) {
+		t.Errorf("%s 没有匹配包含换行的值", filter)
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	cases := []struct {
+		source   string
+		position int
+		message  string
+	}{
+		{``, 1, "应该是字段名"},
+		{`name = `, 8, "应该是值"},
+		{`name = "abc`, 8, "字符串没有结束的引号"},
+		{`name ! "a"`, 6, "无效的运算符 '!'"},
+		{`name = "a" @`, 12, "无效的字符"},
+		{`id = 1-2`, 6, "无效的数字或日期"},
+		{`foo = 1`, 1, "未知的字段 foo"},
+		{`and = 1`, 1, "应该是字段名"},
+		{`1 = 1`, 1, "应该是字段名"},
+		{`attr.x = 1`, 1, "属性 x 没有定义"},
+		{`id = "a"`, 6, "应该是整数"},
+		{`attr.vip = 1`, 12, "应该是 true 或 false"},
+		{`birthday = 2020-13-01`, 12, "不是有效的日期"},
+		{`gender = "x"`, 10, "性别"},
+		{`email = "bad"`, 9, ""},
+		{`id ~ 1`, 4, "不支持运算符 ~"},
+		{`attr.vip > true`, 10, "不支持运算符 >"},
+		{`name like "a"`, 6, "应该是运算符"},
+		{`name startswith 1`, 17, "startswith 后面应该是字符串"},
+		{`name is "a"`, 9, "is 后面应该是 null"},
+		{`id in 1`, 7, "in 后面应该是 '('"},
+		{`id in (1 2)`, 10, "应该是 ',' 或 ')'"},
+		{`id in ()`, 8, "应该是值"},
+		{`(name = "a"`, 12, "缺少 ')'"},
+		{`name = "a")`, 11, "多余的 ')'"},
+		{`name = "a" name`, 12, "多余的 'name'"},
+		{`name = "a" or`, 14, "应该是字段名"},
+		{`not`, 4, "应该是字段名"},
+		{`名字 = "a"`, 1, "未知的字段 名字"},
+		{`名字 = "a" @`, 10, "无效的字符"},
+		{strings.Repeat("(", 33) + "id = 1" + strings.Repeat(")", 33), 33, "嵌套超过 32 层"},
+		{strings.Repeat("not ", 33) + "id = 1", 129, "嵌套超过 32 层"},
+		{`id = ` + strings.Repeat("1", MAX_FILTER_LENGTH), MAX_FILTER_LENGTH, "表达式超过"},
+	}
+
+	for _, c := range cases {
+		_, err := ParseFilter(c.source, testFilterOptions(t))
+		filter_err, ok := err.(*FilterError)
+		if !ok {
+			t.Errorf("ParseFilter(%q) = %v, want *FilterError", c.source, err)
+			continue
+		}
+		if filter_err.Position != c.position || !strings.Contains(filter_err.Message, c.message) {
+			t.Errorf("ParseFilter(%q) = %d: %s, want %d: ...%s...", c.source, filter_err.Position, filter_err.Message, c.position, c.message)
+		}
+	}
+
+	//32 层以内的嵌套可以解析
+	mustParseFilter(t, strings.Repeat("(", 32)+"id = 1"+strings.Repeat(")", 32))
+}
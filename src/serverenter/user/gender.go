@@ -0,0 +1,179 @@
+/*
+ 用户性别，取值由配置中的性别词表决定
+ 1. 输入时别名(M, 1, 男 等)映射成规范值，不在词表中的值返回 GenderError
+ 2. 输出时可以按语言附带本地化的名称
+*/
+package USER
+
+import (
+	"fmt"
+	"strings"
+)
+
+//词表中的一个性别
+type GenderValue struct {
+	Value   string            //规范值，存入数据库的值
+	Aliases []string          //输入时可以使用的别名，不区分大小写
+	Labels  map[string]string //语言 -> 本地化的名称
+}
+
+//没有配置时使用的默认词表
+var DefaultGenders = []GenderValue{
+	{Value: "male", Aliases: []string{"m", "man", "1", "男"}, Labels: map[string]string{"zh": "男", "en": "Male"}},
+	{Value: "female", Aliases: []string{"f", "woman", "2", "女"}, Labels: map[string]string{"zh": "女", "en": "Female"}},
+}
+
+//性别不在词表中
+type GenderError struct {
+	Value   string   `json:"value"`
+	Allowed []string `json:"allowed"`
+}
+
+func (err *GenderError) Error() string {
+	return fmt.Sprintf("性别 %q 无效，允许的值: %s", err.Value, strings.Join(err.Allowed, ", "))
+}
+
+type GenderVocabulary struct {
+	values  []GenderValue
+	aliases map[string]string //小写的规范值和别名 -> 规范值
+}
+
+/*
+ *  Description:    创建性别词表
+ *  Params       :   values 词表，为空时使用 DefaultGenders
+ *   Returns      :   *GenderVocabulary 词表， error 规范值为空或者别名重复
+ */
+func NewGenderVocabulary(values []GenderValue) (*GenderVocabulary, error) {
+	if len(values) == 0 {
+		values = DefaultGenders
+	}
+
+	vocab := &GenderVocabulary{values: values, aliases: make(map[string]string)}
+	for _, value := range values {
+		if value.Value == "" {
+			return nil, fmt.Errorf("性别词表中有空的规范值")
+		}
+		for _, alias := range append([]string{value.Value}, value.Aliases...) {
+			key := strings.ToLower(strings.TrimSpace(alias))
+			if canonical, ok := vocab.aliases[key]; ok && canonical != value.Value {
+				return nil, fmt.Errorf("性别别名 %q 同时属于 %s 和 %s", alias, canonical, value.Value)
+			}
+			vocab.aliases[key] = value.Value
+		}
+	}
+	return vocab, nil
+}
+
+/*
+ *  Description:    把输入的性别映射成规范值，空字符串表示没有填写，原样返回
+ *   Returns      :   string 规范值， error 不在词表中时返回 *GenderError
+ */
+func (vocab *GenderVocabulary) Normalize(gender string) (string, error) {
+	if gender == "" {
+		return "", nil
+	}
+	if canonical, ok := vocab.aliases[strings.ToLower(strings.TrimSpace(gender))]; ok {
+		return canonical, nil
+	}
+	return "", &GenderError{Value: gender, Allowed: vocab.Allowed()}
+}
+
+/*
+ *  Description:    获取全部规范值
+ */
+func (vocab *GenderVocabulary) Allowed() []string {
+	allowed := make([]string, 0, len(vocab.values))
+	for _, value := range vocab.values {
+		allowed = append(allowed, value.Value)
+	}
+	return allowed
+}
+
+/*
+ *  Description:    获取规范值在指定语言下的名称，没有该语言的名称时返回规范值本身
+ */
+func (vocab *GenderVocabulary) Label(gender, lang string) string {
+	for _, value := range vocab.values {
+		if value.Value != gender {
+			continue
+		}
+		if label, ok := value.Labels[lang]; ok {
+			return label
+		}
+		break
+	}
+	return gender
+}
+
+/*
+ *  Description:    给用户列表中的每个用户填上性别的本地化名称
+ */
+func (vocab *GenderVocabulary) LabelUsers(usr_list UserList, lang string) {
+	for i := range usr_list {
+		if usr_list[i].Gender != "" {
+			usr_list[i].GenderLabel = vocab.Label(usr_list[i].Gender, lang)
+		}
+	}
+}
+
+//无法映射的性别
+type GenderMiss struct {
+	ID     int
+	Gender string
+}
+
+//规范化的结果
+type GenderReport struct {
+	Total    int          //检查的用户数
+	Changed  int          //修改(或预演时需要修改)的用户数
+	Unmapped []GenderMiss //无法映射的用户，保持原值
+}
+
+/*
+ *  Description:    把数据库中已有的性别(包括软删除的用户)改写成规范值，修改的用户版本号加1
+ *                  只用于一次性的数据修复，不记录修改历史
+ *  Params       :   vocab 性别词表, dry_run true 时只统计不修改
+ */
+func (db *DB) NormalizeGenders(vocab *GenderVocabulary, dry_run bool) (*GenderReport, error) {
+	rows, err := db.Raw("SELECT `id`, `gender` FROM `user` WHERE `gender` IS NOT NULL AND `gender` <> '' ORDER BY `id`").Rows()
+	if err != nil {
+		return nil, err
+	}
+	//先读出全部数据再更新，避免读取时占用连接
+	genders := []GenderMiss{}
+	for rows.Next() {
+		row := GenderMiss{}
+		if err := rows.Scan(&row.ID, &row.Gender); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		genders = append(genders, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &GenderReport{Total: len(genders), Unmapped: []GenderMiss{}}
+	for _, row := range genders {
+		canonical, err := vocab.Normalize(row.Gender)
+		if err != nil {
+			report.Unmapped = append(report.Unmapped, row)
+			continue
+		}
+		if canonical == row.Gender {
+			continue
+		}
+		report.Changed++
+		if dry_run {
+			continue
+		}
+		//带上原值作为条件，期间被修改过的用户不覆盖
+		err = db.Exec("UPDATE `user` SET `gender` = ?, `version` = `version` + 1 WHERE `id` = ? AND `gender` = ?",
+			canonical, row.ID, row.Gender).Error
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,79 @@
+/*
+ 用户组(部门，项目组等)，一个用户可以属于多个组，一个组有多个用户
+ 1. 组和成员的关系保存在 user_group_member 表中，使用 gorm 的 many2many(Group.Members)
+ 2. 软删除的用户保留组关系，恢复后仍然是原来的组的成员，列出成员时不包括软删除的用户
+ 3. 彻底删除用户或删除组时删除相关的组关系
+*/
+package USER
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrGroupNotFound = errors.New("用户组不存在")
+	ErrGroupExists   = errors.New("用户组名已经存在")
+	ErrNotMember     = errors.New("用户不是该组的成员")
+)
+
+const (
+	MAX_GROUP_NAME_LENGTH        = 64   //组名的最大长度(字符数)，与 user_group.name 列一致
+	MAX_GROUP_DESCRIPTION_LENGTH = 1024 //描述的最大长度(字符数)
+)
+
+//用户组，存入数据库中的结构
+type Group struct {
+	ID          int    `gorm:"primary_key" json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+
+	//组的成员，只用于 gorm 的 many2many 关联，不直接读写
+	Members []User `gorm:"many2many:user_group_member" json:"-"`
+}
+
+/*
+ *  Description:    初始化数据库中的表名，group 是 mysql 的关键字
+ *   Returns      :   返回数据库中的表名字符串
+ */
+func (group Group) TableName() string {
+	return "user_group"
+}
+
+/*
+ *  Description:    去掉组名两端的空白，检查组名和描述是否有效
+ */
+func (group *Group) Check() error {
+	group.Name = strings.TrimSpace(group.Name)
+	if group.Name == "" {
+		return errors.New("组名不能为空")
+	}
+	if utf8.RuneCountInString(group.Name) > MAX_GROUP_NAME_LENGTH {
+		return errors.New("组名不能超过 64 个字符")
+	}
+	if utf8.RuneCountInString(group.Description) > MAX_GROUP_DESCRIPTION_LENGTH {
+		return errors.New("描述不能超过 1024 个字符")
+	}
+	return nil
+}
+
+//用户组和组成员的存储
+type GroupStore interface {
+	//增加用户组，组名重复时返回 ErrGroupExists
+	AddGroup(group *Group) error
+	//按ID修改组名和描述，不存在时返回 ErrGroupNotFound，组名重复时返回 ErrGroupExists
+	UpdateGroup(group *Group) error
+	//按ID删除用户组和组关系，不存在时返回 ErrGroupNotFound
+	DeleteGroup(id int) error
+	//按ID获取用户组，不存在时返回 ErrGroupNotFound
+	FetchGroup(id int) (*Group, error)
+	//获取全部用户组，按ID排序
+	FetchGroups() ([]Group, error)
+	//把用户加入组，已经是成员时不做处理，组不存在返回 ErrGroupNotFound，用户不存在(或已经软删除)返回 ErrUserNotFound
+	AddMember(group_id, user_id int) error
+	//把用户移出组，组不存在返回 ErrGroupNotFound，不是成员返回 ErrNotMember
+	RemoveMember(group_id, user_id int) error
+	//获取用户所在的组，按ID排序，用户不存在(或已经软删除)返回 ErrUserNotFound
+	FetchUserGroups(user_id int) ([]Group, error)
+}
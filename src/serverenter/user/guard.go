@@ -0,0 +1,103 @@
+/*
+ 批量更新和删除的安全检查
+ 1. 没有任何过滤条件的请求直接拒绝
+ 2. 影响的行数不能超过配置的最大值
+ 3. 批量操作必须带上 confirm=<预期影响行数>，与实际统计的行数一致才执行
+ 只通过ID操作单个用户不属于批量操作，不需要 confirm
+*/
+package USER
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+//默认允许批量操作影响的最大行数
+const DEFAULT_MAX_AFFECTED_ROWS = 1000
+
+//拒绝原因代码
+const (
+	GUARD_NO_FILTER        = "no_filter"        //没有任何过滤条件
+	GUARD_TOO_MANY_ROWS    = "too_many_rows"    //影响的行数超过最大值
+	GUARD_CONFIRM_REQUIRED = "confirm_required" //缺少 confirm 参数
+	GUARD_CONFIRM_MISMATCH = "confirm_mismatch" //confirm 与实际影响的行数不一致
+)
+
+//批量操作被拒绝的原因
+type GuardError struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Affected int    `json:"affected"` //实际会影响的行数
+	Max      int    `json:"max"`      //允许的最大行数
+	Confirm  string `json:"confirm"`  //请求中带的 confirm
+}
+
+func (err *GuardError) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+type BulkGuard struct {
+	MaxAffectedRows int
+}
+
+/*
+ *  Description:    创建批量操作安全检查
+ *  Params       :   max_affected_rows 允许影响的最大行数，<=0 时使用默认值
+ *   Returns      :   *BulkGuard 安全检查对象
+ */
+func NewBulkGuard(max_affected_rows int) *BulkGuard {
+	if max_affected_rows <= 0 {
+		max_affected_rows = DEFAULT_MAX_AFFECTED_ROWS
+	}
+	return &BulkGuard{MaxAffectedRows: max_affected_rows}
+}
+
+/*
+ *  Description:    检查批量操作是否允许执行
+ *  Params       :   store 用户存储, cond 过滤条件(ID和非空字段), low/high ID范围, confirm 请求中的确认值
+ *   Returns      :   int 会影响的行数， error nil 允许执行，否则为 *GuardError 或存储错误
+ */
+func (guard *BulkGuard) Check(store UserStore, cond User, low, high int, confirm string) (int, error) {
+	has_range := low != -1 && high != -1
+	if has_range {
+		cond.ID = 0
+	}
+	//自定义属性不是批量操作的条件
+	cond.Attributes = nil
+
+	//只操作单个用户
+	if !has_range && cond.ID != 0 {
+		return store.CountUsers(&UserQueryPack{Usr: cond, IDRange: Range{-1, -1}})
+	}
+
+	if !has_range && reflect.DeepEqual(cond, User{}) {
+		return 0, &GuardError{
+			Code:    GUARD_NO_FILTER,
+			Message: "没有任何过滤条件，请指定 id, low/high 或其他字段",
+			Max:     guard.MaxAffectedRows,
+			Confirm: confirm,
+		}
+	}
+
+	affected, err := store.CountUsers(&UserQueryPack{Usr: cond, IDRange: Range{low, high}})
+	if err != nil {
+		return 0, err
+	}
+
+	guard_err := &GuardError{Affected: affected, Max: guard.MaxAffectedRows, Confirm: confirm}
+	switch {
+	case affected > guard.MaxAffectedRows:
+		guard_err.Code = GUARD_TOO_MANY_ROWS
+		guard_err.Message = fmt.Sprintf("影响 %d 行，超过最大值 %d", affected, guard.MaxAffectedRows)
+	case confirm == "":
+		guard_err.Code = GUARD_CONFIRM_REQUIRED
+		guard_err.Message = fmt.Sprintf("批量操作会影响 %d 行，请带上 confirm=%d 重新请求", affected, affected)
+	case confirm != strconv.Itoa(affected):
+		guard_err.Code = GUARD_CONFIRM_MISMATCH
+		guard_err.Message = fmt.Sprintf("confirm=%s 与实际影响的 %d 行不一致", confirm, affected)
+	default:
+		return affected, nil
+	}
+	return affected, guard_err
+}
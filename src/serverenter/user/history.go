@@ -0,0 +1,108 @@
+/*
+ 用户修改历史，记录每次增加，修改，删除的操作人，时间，客户端IP和字段修改前后的值
+*/
+package USER
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//操作类型
+const (
+	ACTION_ADD     = "add"
+	ACTION_UPDATE  = "update"
+	ACTION_DELETE  = "delete"
+	ACTION_RESTORE = "restore"
+	ACTION_PURGE   = "purge"
+	ACTION_REVERT  = "revert"
+	ACTION_IMPORT  = "import"
+)
+
+//一条修改历史，存入数据库中的结构
+type History struct {
+	ID        int       `gorm:"primary_key" json:"id"`
+	UserID    int       `sql:"index" json:"user_id"`
+	Version   int       `json:"version"` //操作后用户的版本号
+	Action    string    `json:"action"`
+	Operator  string    `json:"operator"`  //操作人
+	ClientIP  string    `json:"client_ip"` //操作人的客户端IP
+	CreatedAt time.Time `json:"created_at"`
+
+	Changes  map[string]FieldChange `sql:"-" json:"changes"`  //字段修改前后的值
+	Snapshot User                   `sql:"-" json:"snapshot"` //操作后用户的完整数据，删除时为删除前的数据
+
+	//Changes 和 Snapshot 在数据库中以json保存
+	ChangesJSON  string `gorm:"column:changes" sql:"type:text" json:"-"`
+	SnapshotJSON string `gorm:"column:snapshot" sql:"type:text" json:"-"`
+}
+
+/*
+ *  Description:    初始化数据库中的表名
+ *   Returns      :   返回数据库中的表名字符串
+ */
+func (h History) TableName() string {
+	return "user_history"
+}
+
+/*
+ *  Description:    把 Changes 和 Snapshot 编码成json, 存入数据库前调用
+ */
+func (h *History) encode() error {
+	changes, err := json.Marshal(h.Changes)
+	if err != nil {
+		return err
+	}
+	snapshot, err := json.Marshal(h.Snapshot)
+	if err != nil {
+		return err
+	}
+	h.ChangesJSON = string(changes)
+	h.SnapshotJSON = string(snapshot)
+	return nil
+}
+
+/*
+ *  Description:    从json解码 Changes 和 Snapshot, 从数据库读出后调用
+ */
+func (h *History) decode() error {
+	if h.ChangesJSON != "" {
+		if err := json.Unmarshal([]byte(h.ChangesJSON), &h.Changes); err != nil {
+			return err
+		}
+	}
+	if h.SnapshotJSON != "" {
+		if err := json.Unmarshal([]byte(h.SnapshotJSON), &h.Snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//修改历史的存储
+type HistoryStore interface {
+	//增加修改历史
+	AddHistory(entries []History) error
+	//按时间倒序获取用户的修改历史，limit 为 -1 时不限制数量，同时返回总数
+	FetchHistory(user_id, offset, limit int) ([]History, int, error)
+}
+
+/*
+ *  Description:    获取用户在指定版本时的完整数据
+ *  Params       :   store 历史存储, user_id 用户ID, version 版本号
+ *   Returns      :   *User 该版本的用户数据，没有该版本时返回 ErrUserNotFound
+ */
+func UserAtVersion(store HistoryStore, user_id, version int) (*User, error) {
+	entries, _, err := store.FetchHistory(user_id, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	//删除和恢复不修改版本号，按时间倒序取最新的一条
+	for i := range entries {
+		if entries[i].Version == version {
+			usr := entries[i].Snapshot
+			return &usr, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
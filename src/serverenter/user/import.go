@@ -0,0 +1,197 @@
+/*
+ 批量导入用户
+ 1. 分批写入，每批在一个事务中；atomic 时整个导入在一个事务中，放弃时全部回滚
+ 2. upsert 为 email 或 phone 时，按该字段查找已有的用户并用非空字段更新，找不到时新增
+ 3. 唯一字段与已有用户(包括同一次导入中前面写入的行)重复的行不写入，结果中为 *ConflictError
+ 4. 每批先一次查出唯一字段相同的已有用户，再逐行写入
+ 5. 属性值和修改历史通过 ImportHook 在写入用户的同一个事务中保存，与用户一起提交或回滚
+*/
+package USER
+
+import (
+	"fmt"
+)
+
+//upsert 可以使用的唯一字段
+const (
+	UPSERT_EMAIL = "email"
+	UPSERT_PHONE = "phone"
+)
+
+//导入的一行写入存储的结果
+type ImportedUser struct {
+	User   User  //写入后的用户
+	Before *User //更新前的用户，nil 表示新增
+	Err    error //没有写入的原因，例如唯一字段重复
+}
+
+//每批用户写入之后在同一个事务中执行，tx 为这一批(atomic 时为整个导入)的事务中的存储
+//usr_list 为写入的这一批用户，results 为每一行的结果，返回错误时这一批没有写入
+type ImportHook func(tx UserStore, usr_list UserList, results []ImportedUser) error
+
+//一次导入，由 UserStore.BeginImport 创建
+type UserImporter interface {
+	//注册每批写入之后执行的操作，按注册的顺序执行，必须在第一次 Write 之前注册
+	OnBatch(hook ImportHook)
+	//按顺序写入一批用户，返回每一行的结果，error 不为 nil 时这一批没有写入，导入应该放弃
+	Write(usr_list UserList) ([]ImportedUser, error)
+	//完成导入，atomic 时提交事务
+	Commit() error
+	//放弃导入，atomic 时撤销全部写入，否则已经写入的批次保留
+	Rollback() error
+}
+
+//注册的 ImportHook, 存储的导入实现嵌入后支持 OnBatch
+type importHooks []ImportHook
+
+func (hooks *importHooks) OnBatch(hook ImportHook) {
+	*hooks = append(*hooks, hook)
+}
+
+/*
+ *  Description:    按注册的顺序执行 ImportHook, 遇到错误时停止
+ */
+func (hooks importHooks) run(tx UserStore, usr_list UserList, results []ImportedUser) error {
+	for _, hook := range hooks {
+		if err := hook(tx, usr_list, results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//导入时写入用户的存储操作，调用方保证在同一个事务(或锁)中调用
+type importWriter interface {
+	//查找 email 或 phone 在列表中的用户，包括软删除的用户
+	findByKeys(emails, phones []string) (UserList, error)
+	//新增用户，成功后 usr 带上ID和版本号
+	insert(usr *User) error
+	//用 usr 的非空字段更新用户，版本号加1，成功后 usr 为更新后的完整数据
+	update(id int, usr *User) error
+}
+
+/*
+ *  Description:    按顺序写入一批用户，每写入一行更新唯一字段的索引，后面的行可以更新前面的行写入的用户
+ *  Params       :   w 存储操作, usr_list 这一批用户, upsert 按哪个唯一字段更新，空表示只新增
+ *   Returns      :   []ImportedUser 每一行的结果， error 存储错误，这一批需要回滚
+ */
+func importBatch(w importWriter, usr_list UserList, upsert string) ([]ImportedUser, error) {
+	emails, phones := []string{}, []string{}
+	for _, usr := range usr_list {
+		if usr.Email != "" {
+			emails = append(emails, string(usr.Email))
+		}
+		if usr.Phone != "" {
+			phones = append(phones, string(usr.Phone))
+		}
+	}
+	existing, err := w.findByKeys(emails, phones)
+	if err != nil {
+		return nil, err
+	}
+	index := newUniqueIndex(existing)
+
+	results := make([]ImportedUser, len(usr_list))
+	for i := range usr_list {
+		usr := usr_list[i]
+		usr.ID, usr.Version, usr.DeletedAt = 0, 0, DeletedTime{}
+		usr.Attributes = nil
+		result := &results[i]
+
+		var target *User
+		if key := uniqueValue(&usr, upsert); key != "" {
+			target = index.get(upsert, key)
+			if target != nil && !target.DeletedAt.IsZero() {
+				result.Err = fmt.Errorf("%s %s 属于已经删除的用户 %d", upsert, key, target.ID)
+				continue
+			}
+		}
+		if result.Err = index.conflict(&usr, target); result.Err != nil {
+			continue
+		}
+
+		if target == nil {
+			err = w.insert(&usr)
+		} else {
+			before := *target
+			result.Before = &before
+			err = w.update(target.ID, &usr)
+		}
+		if _, ok := err.(*ConflictError); ok {
+			result.Before = nil
+			result.Err = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		index.remove(result.Before)
+		index.add(&usr)
+		result.User = usr
+	}
+	return results, nil
+}
+
+/*
+ *  Description:    用户在唯一字段上的值
+ */
+func uniqueValue(usr *User, field string) string {
+	switch field {
+	case UPSERT_EMAIL:
+		return string(usr.Email)
+	case UPSERT_PHONE:
+		return string(usr.Phone)
+	}
+	return ""
+}
+
+//唯一字段的索引，字段 -> 值 -> 用户
+type uniqueIndex map[string]map[string]*User
+
+func newUniqueIndex(usr_list UserList) uniqueIndex {
+	index := uniqueIndex{UPSERT_EMAIL: {}, UPSERT_PHONE: {}}
+	for i := range usr_list {
+		index.add(&usr_list[i])
+	}
+	return index
+}
+
+func (index uniqueIndex) add(usr *User) {
+	saved := *usr
+	for field, values := range index {
+		if value := uniqueValue(&saved, field); value != "" {
+			values[value] = &saved
+		}
+	}
+}
+
+func (index uniqueIndex) remove(usr *User) {
+	if usr == nil {
+		return
+	}
+	for field, values := range index {
+		if value := uniqueValue(usr, field); value != "" {
+			delete(values, value)
+		}
+	}
+}
+
+func (index uniqueIndex) get(field, value string) *User {
+	return index[field][value]
+}
+
+/*
+ *  Description:    检查 usr 的唯一字段是否已经属于 target 以外的用户
+ */
+func (index uniqueIndex) conflict(usr *User, target *User) error {
+	for _, field := range []string{UPSERT_EMAIL, UPSERT_PHONE} {
+		value := uniqueValue(usr, field)
+		if value == "" {
+			continue
+		}
+		if owner := index.get(field, value); owner != nil && (target == nil || owner.ID != target.ID) {
+			return &ConflictError{Field: field, Value: value, ExistingID: owner.ID}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,934 @@
+/*
+ 进程内用户存储，实现了 UserStore 接口
+ 语义与 gorm 的实现保持一致，用于测试和本地开发，不需要数据库
+*/
+package USER
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type MemStore struct {
+	lock    sync.RWMutex
+	users   map[int]User
+	next_id int //下一个自增ID
+
+	history []History //修改历史，按时间顺序
+
+	definitions AttributeDefinitions      //属性定义，按ID排序
+	attributes  map[int]map[string]string //用户ID -> 属性名 -> 编码后的值
+
+	groups        []Group              //用户组，按ID排序
+	next_group_id int                  //下一个用户组ID
+	members       map[int]map[int]bool //组ID -> 用户ID
+
+	credentials map[int]Credential //用户ID -> 密码哈希
+
+	generation int //每次写入加1，事务提交时用来判断事务期间是否有其他写入
+}
+
+/*
+ *  Description:    创建进程内用户存储
+ *   Returns      :   *MemStore 内存存储指针
+ */
+func NewMemStore() *MemStore {
+	return &MemStore{
+		users:         make(map[int]User),
+		next_id:       1,
+		attributes:    make(map[int]map[string]string),
+		next_group_id: 1,
+		members:       make(map[int]map[int]bool),
+		credentials:   make(map[int]Credential),
+	}
+}
+
+func (store *MemStore) AddUser(usr *User) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.users[usr.ID]; ok && usr.ID != 0 {
+		return errors.New("主键重复: " + strconv.Itoa(usr.ID))
+	}
+	if err := store.conflict(usr); err != nil {
+		return err
+	}
+
+	//检查通过后才分配ID，失败时 usr 不变
+	if usr.ID == 0 {
+		usr.ID = store.next_id
+	}
+	if usr.ID >= store.next_id {
+		store.next_id = usr.ID + 1
+	}
+	usr.Version = 1
+	//自定义属性由 AttributedStore 单独保存
+	u := *usr
+	u.Attributes = nil
+	store.users[usr.ID] = u
+	return nil
+}
+
+func (store *MemStore) UpdateUsers(usr *User, low, high int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	//数据ID范围限制
+	if low != -1 && high != -1 {
+		//ID范围有效 u_pack.Usr.ID 强制赋值成0
+		usr.ID = 0
+	}
+
+	updated := UserList{}
+	for id, old := range store.users {
+		if !old.DeletedAt.IsZero() || !matchIDRange(id, usr.ID, low, high) {
+			continue
+		}
+		updated = append(updated, applyUpdate(old, usr))
+	}
+
+	//先检查唯一字段，全部通过后再修改，与数据库中的一条语句一样要么全部成功要么全部失败
+	sort.Sort(updated)
+	for i := range updated {
+		if err := store.conflict(&updated[i]); err != nil {
+			return err
+		}
+		if err := findConflict(&updated[i], updated); err != nil {
+			return err
+		}
+	}
+	for _, u := range updated {
+		store.users[u.ID] = u
+	}
+	return nil
+}
+
+func (store *MemStore) UpdateUser(usr *User, version int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	old, err := store.checkVersion(usr.ID, version, false)
+	if err != nil {
+		return err
+	}
+	updated := applyUpdate(old, usr)
+	if err := store.conflict(&updated); err != nil {
+		return err
+	}
+	*usr = updated
+	store.users[usr.ID] = *usr
+	return nil
+}
+
+func (store *MemStore) ReplaceUser(usr *User, version int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	old, err := store.checkVersion(usr.ID, version, false)
+	if err != nil {
+		return err
+	}
+	old.Name, old.Gender, old.Birthday = usr.Name, usr.Gender, usr.Birthday
+	old.Email, old.Phone = usr.Email, usr.Phone
+	if err := store.conflict(&old); err != nil {
+		return err
+	}
+	old.Version++
+	*usr = old
+	store.users[usr.ID] = old
+	return nil
+}
+
+/*
+ *  Description:    用 usr 的非空字段更新 old，版本号加1
+ */
+func applyUpdate(old User, usr *User) User {
+	if usr.Name != "" {
+		old.Name = usr.Name
+	}
+	if usr.Gender != "" {
+		old.Gender = usr.Gender
+	}
+	if usr.Birthday != "" {
+		old.Birthday = usr.Birthday
+	}
+	if usr.Email != "" {
+		old.Email = usr.Email
+	}
+	if usr.Phone != "" {
+		old.Phone = usr.Phone
+	}
+	old.Version++
+	return old
+}
+
+/*
+ *  Description:    检查唯一字段是否与其他用户(包括软删除的用户)重复，调用方需要持有锁
+ */
+func (store *MemStore) conflict(usr *User) error {
+	others := make(UserList, 0, len(store.users))
+	for _, u := range store.users {
+		others = append(others, u)
+	}
+	sort.Sort(others)
+	return findConflict(usr, others)
+}
+
+/*
+ *  Description:    检查单个用户是否存在以及版本是否一致，调用方需要持有锁
+ *  Params       :   id 用户ID, version 不为0时检查版本, unscoped 是否包括软删除的用户
+ */
+func (store *MemStore) checkVersion(id, version int, unscoped bool) (User, error) {
+	u, ok := store.users[id]
+	if !ok || (!unscoped && !u.DeletedAt.IsZero()) {
+		return u, ErrUserNotFound
+	}
+	if version != 0 && u.Version != version {
+		return u, ErrVersionMismatch
+	}
+	return u, nil
+}
+
+func (store *MemStore) DeleteUsers(usr *User, low, high int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	//数据ID范围限制
+	if low != -1 && high != -1 {
+		//ID范围有效 u_pack.Usr.ID 强制赋值成0
+		usr.ID = 0
+	}
+
+	now := time.Now()
+	for id, u := range store.users {
+		if u.DeletedAt.IsZero() && matchIDRange(id, usr.ID, low, high) && matchFields(&u, usr) {
+			u.DeletedAt = DeletedTime{now}
+			store.users[id] = u
+		}
+	}
+	return nil
+}
+
+func (store *MemStore) DeleteUser(id, version int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	u, err := store.checkVersion(id, version, false)
+	if err != nil {
+		return err
+	}
+	u.DeletedAt = DeletedTime{time.Now()}
+	store.users[id] = u
+	return nil
+}
+
+func (store *MemStore) RestoreUser(id int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	u, ok := store.users[id]
+	if !ok || u.DeletedAt.IsZero() {
+		return ErrUserNotFound
+	}
+	u.DeletedAt = DeletedTime{}
+	store.users[id] = u
+	return nil
+}
+
+func (store *MemStore) PurgeUser(id, version int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	if _, err := store.checkVersion(id, version, true); err != nil {
+		return err
+	}
+	delete(store.users, id)
+	delete(store.credentials, id)
+	for _, users := range store.members {
+		delete(users, id)
+	}
+	return nil
+}
+
+func (store *MemStore) FetchUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	if u_pack == nil {
+		return errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	store.lock.RLock()
+	result := store.filter(u_pack, false)
+	store.lock.RUnlock()
+
+	pageUsers(result, usr_list, u_pack)
+	return nil
+}
+
+func (store *MemStore) FetchDeletedUsers(usr_list *UserList, u_pack *UserQueryPack) error {
+	if u_pack == nil {
+		return errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	store.lock.RLock()
+	result := store.filter(u_pack, true)
+	store.lock.RUnlock()
+
+	pageUsers(result, usr_list, u_pack)
+	return nil
+}
+
+func (store *MemStore) ExportUsers(u_pack *UserQueryPack, each func(usr *User) error) error {
+	if u_pack == nil {
+		return errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	store.lock.RLock()
+	result := store.filter(u_pack, false)
+	store.lock.RUnlock()
+
+	//不持有锁调用 each, each 中可以读取存储
+	pack := *u_pack
+	pack.Cursor = nil
+	usr_list := UserList{}
+	pageUsers(result, &usr_list, &pack)
+	for i := range usr_list {
+		if err := each(&usr_list[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ *  Description:    对过滤后的用户排序，再按偏移(或游标)和数量截取
+ */
+func pageUsers(result UserList, usr_list *UserList, u_pack *UserQueryPack) {
+	//内存中没有自然顺序，没有指定排序时按ID升序，有游标时按游标的方向排序
+	cursor := u_pack.Cursor
+	order := u_pack.Sorting()
+	if cursor != nil {
+		order = cursor.query()
+	}
+	if len(order) == 0 {
+		order = OrderSort(1)
+	}
+	sort.Sort(&userSorter{list: result, order: order})
+
+	//游标：只保留边界之后(按游标的方向)的用户
+	if cursor != nil {
+		page := UserList{}
+		for i := range result {
+			if cursor.accept(&result[i]) {
+				page = append(page, result[i])
+			}
+		}
+		result = page
+	} else if u_pack.Offset > 0 {
+		//数据偏移
+		if u_pack.Offset >= len(result) {
+			result = result[:0]
+		} else {
+			result = result[u_pack.Offset:]
+		}
+	}
+
+	//数量限制
+	if u_pack.Limit != -1 && u_pack.Limit < len(result) {
+		result = result[:u_pack.Limit]
+	}
+
+	//取边界之前的一页时是反向排序的，恢复成原来的顺序
+	if cursor != nil && cursor.Before {
+		result.reverse()
+	}
+
+	*usr_list = result
+}
+
+func (store *MemStore) CountUsers(u_pack *UserQueryPack) (int, error) {
+	if u_pack == nil {
+		return 0, errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return len(store.filter(u_pack, false)), nil
+}
+
+/*
+ *  Description:    内存中统计很快，总是精确统计
+ */
+func (store *MemStore) TotalUsers(u_pack *UserQueryPack, deleted bool, threshold int) (int, bool, error) {
+	if u_pack == nil {
+		return 0, false, errors.New("用户查询包为空 u_pack == nil")
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return len(store.filter(u_pack, deleted)), true, nil
+}
+
+/*
+ *  Description:    根据查询包中的ID范围和非空字段过滤用户，调用方需要持有读锁
+ *  Params       :   deleted true 只返回已经软删除的用户，false 只返回没有删除的用户
+ */
+func (store *MemStore) filter(u_pack *UserQueryPack, deleted bool) UserList {
+	usr := u_pack.Usr
+	low, high := u_pack.IDRange.Low, u_pack.IDRange.High
+	if low != -1 && high != -1 {
+		usr.ID = 0
+	}
+
+	result := UserList{}
+	for id, u := range store.users {
+		if !u.DeletedAt.IsZero() == deleted && matchIDRange(id, usr.ID, low, high) && matchFields(&u, &usr) &&
+			u_pack.Birthday.Contains(u.Birthday) && store.matchAttributes(id, usr.Attributes) &&
+			(u_pack.Filter == nil || u_pack.Filter.Match(&u, store.attributes[id])) &&
+			(u_pack.Group == 0 || store.members[u_pack.Group][id]) {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+func (store *MemStore) AddHistory(entries []History) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	for i := range entries {
+		entries[i].ID = len(store.history) + 1
+		store.history = append(store.history, entries[i])
+	}
+	return nil
+}
+
+func (store *MemStore) FetchHistory(user_id, offset, limit int) ([]History, int, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	//按时间倒序
+	entries := []History{}
+	for i := len(store.history) - 1; i >= 0; i-- {
+		if store.history[i].UserID == user_id {
+			entries = append(entries, store.history[i])
+		}
+	}
+
+	total := len(entries)
+	if offset > 0 {
+		if offset >= len(entries) {
+			offset = len(entries)
+		}
+		entries = entries[offset:]
+	}
+	if limit != -1 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries, total, nil
+}
+
+func (store *MemStore) AddDefinition(def *AttributeDefinition) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	if store.definitions.Find(def.Name) != nil {
+		return ErrAttributeExists
+	}
+	def.ID = 1
+	if n := len(store.definitions); n > 0 {
+		def.ID = store.definitions[n-1].ID + 1
+	}
+	store.definitions = append(store.definitions, *def)
+	return nil
+}
+
+func (store *MemStore) UpdateDefinition(def *AttributeDefinition) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	old := store.definitions.Find(def.Name)
+	if old == nil {
+		return ErrAttributeNotFound
+	}
+	if old.Type != def.Type {
+		return errors.New("属性的类型不能修改")
+	}
+	def.ID = old.ID
+	*old = *def
+	return nil
+}
+
+func (store *MemStore) DeleteDefinition(name string) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	defs := AttributeDefinitions{}
+	for _, def := range store.definitions {
+		if def.Name != name {
+			defs = append(defs, def)
+		}
+	}
+	if len(defs) == len(store.definitions) {
+		return ErrAttributeNotFound
+	}
+	store.definitions = defs
+	for _, values := range store.attributes {
+		delete(values, name)
+	}
+	return nil
+}
+
+func (store *MemStore) FetchDefinitions() (AttributeDefinitions, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	defs := make(AttributeDefinitions, len(store.definitions))
+	copy(defs, store.definitions)
+	return defs, nil
+}
+
+func (store *MemStore) SetAttributes(user_id int, attrs Attributes) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	for name := range attrs {
+		if store.definitions.Find(name) == nil {
+			return &AttributeError{Name: name, Message: "没有定义"}
+		}
+	}
+
+	values := store.attributes[user_id]
+	if values == nil {
+		values = make(map[string]string)
+		store.attributes[user_id] = values
+	}
+	for name, value := range attrs {
+		if value == nil {
+			delete(values, name)
+		} else {
+			values[name] = EncodeAttribute(value)
+		}
+	}
+	if len(values) == 0 {
+		delete(store.attributes, user_id)
+	}
+	return nil
+}
+
+func (store *MemStore) FetchAttributes(user_ids []int) (map[int]map[string]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	result := make(map[int]map[string]string)
+	for _, id := range user_ids {
+		if values, ok := store.attributes[id]; ok {
+			copied := make(map[string]string, len(values))
+			for name, value := range values {
+				copied[name] = value
+			}
+			result[id] = copied
+		}
+	}
+	return result, nil
+}
+
+/*
+ *  Description:    判断用户的自定义属性是否满足查询条件，调用方需要持有读锁
+ */
+func (store *MemStore) matchAttributes(id int, cond Attributes) bool {
+	for name, value := range cond {
+		if value == nil {
+			continue
+		}
+		if actual, ok := store.attributes[id][name]; !ok || actual != EncodeAttribute(value) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ *  Description:    按ID查找用户组的下标，不存在时返回 -1, 调用方需要持有锁
+ */
+func (store *MemStore) findGroup(id int) int {
+	i := sort.Search(len(store.groups), func(i int) bool { return store.groups[i].ID >= id })
+	if i < len(store.groups) && store.groups[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+/*
+ *  Description:    组名是否被其他组使用，调用方需要持有锁
+ */
+func (store *MemStore) groupNameUsed(name string, except_id int) bool {
+	for _, group := range store.groups {
+		if group.Name == name && group.ID != except_id {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *MemStore) AddGroup(group *Group) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	if store.groupNameUsed(group.Name, 0) {
+		return ErrGroupExists
+	}
+	group.ID = store.next_group_id
+	store.next_group_id++
+	store.groups = append(store.groups, Group{ID: group.ID, Name: group.Name, Description: group.Description})
+	return nil
+}
+
+func (store *MemStore) UpdateGroup(group *Group) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	i := store.findGroup(group.ID)
+	if i == -1 {
+		return ErrGroupNotFound
+	}
+	if store.groupNameUsed(group.Name, group.ID) {
+		return ErrGroupExists
+	}
+	store.groups[i].Name, store.groups[i].Description = group.Name, group.Description
+	return nil
+}
+
+func (store *MemStore) DeleteGroup(id int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	i := store.findGroup(id)
+	if i == -1 {
+		return ErrGroupNotFound
+	}
+	store.groups = append(store.groups[:i:i], store.groups[i+1:]...)
+	delete(store.members, id)
+	return nil
+}
+
+func (store *MemStore) FetchGroup(id int) (*Group, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	i := store.findGroup(id)
+	if i == -1 {
+		return nil, ErrGroupNotFound
+	}
+	group := store.groups[i]
+	return &group, nil
+}
+
+func (store *MemStore) FetchGroups() ([]Group, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return append([]Group{}, store.groups...), nil
+}
+
+func (store *MemStore) AddMember(group_id, user_id int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	if store.findGroup(group_id) == -1 {
+		return ErrGroupNotFound
+	}
+	//软删除的用户不能加入组
+	if u, ok := store.users[user_id]; !ok || !u.DeletedAt.IsZero() {
+		return ErrUserNotFound
+	}
+	if store.members[group_id] == nil {
+		store.members[group_id] = make(map[int]bool)
+	}
+	store.members[group_id][user_id] = true
+	return nil
+}
+
+func (store *MemStore) RemoveMember(group_id, user_id int) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	if store.findGroup(group_id) == -1 {
+		return ErrGroupNotFound
+	}
+	if !store.members[group_id][user_id] {
+		return ErrNotMember
+	}
+	delete(store.members[group_id], user_id)
+	return nil
+}
+
+func (store *MemStore) FetchUserGroups(user_id int) ([]Group, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	//软删除的用户保留组关系，但和不存在的用户一样返回 ErrUserNotFound
+	if u, ok := store.users[user_id]; !ok || !u.DeletedAt.IsZero() {
+		return nil, ErrUserNotFound
+	}
+	groups := []Group{}
+	for _, group := range store.groups {
+		if store.members[group.ID][user_id] {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+func (store *MemStore) SetCredential(cred *Credential, current string) error {
+	store.writeLock()
+	defer store.lock.Unlock()
+
+	//软删除的用户不能设置密码
+	if u, ok := store.users[cred.UserID]; !ok || !u.DeletedAt.IsZero() {
+		return ErrUserNotFound
+	}
+	if store.credentials[cred.UserID].Hash != current {
+		return ErrCredentialChanged
+	}
+	store.credentials[cred.UserID] = *cred
+	return nil
+}
+
+func (store *MemStore) FetchCredential(user_id int) (*Credential, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	cred, ok := store.credentials[user_id]
+	if !ok {
+		return nil, ErrNoCredential
+	}
+	return &cred, nil
+}
+
+func (store *MemStore) BeginTx() (UserTx, error) {
+	return store.beginTx(), nil
+}
+
+func (store *MemStore) beginTx() *memTx {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	return &memTx{MemStore: store.clone(), origin: store, generation: store.generation}
+}
+
+/*
+ *  Description:    获取写锁，并记录一次写入
+ */
+func (store *MemStore) writeLock() {
+	store.lock.Lock()
+	store.generation++
+}
+
+/*
+ *  Description:    复制存储的全部数据，调用方需要持有锁
+ */
+func (store *MemStore) clone() *MemStore {
+	copied := &MemStore{
+		users:       make(map[int]User, len(store.users)),
+		next_id:     store.next_id,
+		history:     append([]History(nil), store.history...),
+		definitions: append(AttributeDefinitions(nil), store.definitions...),
+		attributes:  make(map[int]map[string]string, len(store.attributes)),
+
+		groups:        append([]Group(nil), store.groups...),
+		next_group_id: store.next_group_id,
+		members:       make(map[int]map[int]bool, len(store.members)),
+
+		credentials: make(map[int]Credential, len(store.credentials)),
+	}
+	for id, u := range store.users {
+		copied.users[id] = u
+	}
+	for id, values := range store.attributes {
+		copied.attributes[id] = make(map[string]string, len(values))
+		for name, value := range values {
+			copied.attributes[id][name] = value
+		}
+	}
+	for group_id, users := range store.members {
+		copied.members[group_id] = make(map[int]bool, len(users))
+		for user_id := range users {
+			copied.members[group_id][user_id] = true
+		}
+	}
+	for user_id, cred := range store.credentials {
+		copied.credentials[user_id] = cred
+	}
+	return copied
+}
+
+//内存存储的事务，在开始时的副本上操作，提交时把副本写回
+//事务期间不持有原存储的锁，其他访问不会等待，事务期间原存储有其他写入时提交返回 ErrTxConflict
+type memTx struct {
+	*MemStore
+	origin     *MemStore
+	generation int //开始事务时原存储的写入次数
+	done       bool
+}
+
+func (tx *memTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	origin := tx.origin
+	origin.lock.Lock()
+	defer origin.lock.Unlock()
+	if origin.generation != tx.generation {
+		return ErrTxConflict
+	}
+	origin.generation++
+	origin.users, origin.next_id, origin.history = tx.users, tx.next_id, tx.history
+	origin.definitions, origin.attributes = tx.definitions, tx.attributes
+	origin.groups, origin.next_group_id, origin.members = tx.groups, tx.next_group_id, tx.members
+	origin.credentials = tx.credentials
+	return nil
+}
+
+func (tx *memTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return nil
+}
+
+func (store *MemStore) BeginImport(upsert string, atomic bool) (UserImporter, error) {
+	imp := &memImporter{store: store, upsert: upsert}
+	if atomic {
+		imp.tx = store.beginTx()
+	}
+	return imp, nil
+}
+
+//内存存储的一次导入，与 memTx 相同在副本上写入，提交时把副本写回
+//atomic 时整个导入是一个事务，否则每批是一个事务，其他请求看不到没有提交的批次
+type memImporter struct {
+	store  *MemStore
+	upsert string
+	tx     *memTx //atomic 时整个导入的事务
+	importHooks
+}
+
+func (imp *memImporter) Write(usr_list UserList) ([]ImportedUser, error) {
+	if imp.tx != nil {
+		return imp.write(imp.tx, usr_list)
+	}
+
+	//每批单独提交，与其他写入冲突时重新写入这一批
+	for retry := 0; ; retry++ {
+		tx := imp.store.beginTx()
+		results, err := imp.write(tx, usr_list)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		err = tx.Commit()
+		if err != ErrTxConflict || retry == TX_CONFLICT_RETRIES {
+			return results, err
+		}
+	}
+}
+
+/*
+ *  Description:    在事务的副本上写入一批用户，再执行注册的 ImportHook
+ */
+func (imp *memImporter) write(tx *memTx, usr_list UserList) ([]ImportedUser, error) {
+	tx.lock.Lock()
+	results, err := importBatch(&memImportWriter{store: tx.MemStore}, usr_list, imp.upsert)
+	tx.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := imp.run(tx, usr_list, results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (imp *memImporter) Commit() error {
+	if imp.tx == nil {
+		return nil
+	}
+	return imp.tx.Commit()
+}
+
+func (imp *memImporter) Rollback() error {
+	if imp.tx == nil {
+		return nil
+	}
+	return imp.tx.Rollback()
+}
+
+//在事务的副本上写入导入的用户，调用方需要持有副本的锁
+type memImportWriter struct {
+	store *MemStore
+}
+
+func (w *memImportWriter) findByKeys(emails, phones []string) (UserList, error) {
+	keys := make(map[string]bool, len(emails)+len(phones))
+	for _, email := range emails {
+		keys["email:"+email] = true
+	}
+	for _, phone := range phones {
+		keys["phone:"+phone] = true
+	}
+
+	usr_list := UserList{}
+	for _, u := range w.store.users {
+		if keys["email:"+string(u.Email)] || keys["phone:"+string(u.Phone)] {
+			usr_list = append(usr_list, u)
+		}
+	}
+	sort.Sort(usr_list)
+	return usr_list, nil
+}
+
+func (w *memImportWriter) insert(usr *User) error {
+	usr.ID = w.store.next_id
+	usr.Version = 1
+	w.store.next_id++
+	w.store.users[usr.ID] = *usr
+	return nil
+}
+
+func (w *memImportWriter) update(id int, usr *User) error {
+	*usr = applyUpdate(w.store.users[id], usr)
+	w.store.users[id] = *usr
+	return nil
+}
+
+func (store *MemStore) Close() error {
+	return nil
+}
+
+/*
+ *  Description:    判断ID是否满足条件，范围有效时按范围判断，否则按ID判断，ID为0表示不限制
+ */
+func matchIDRange(id, want_id, low, high int) bool {
+	if low != -1 && high != -1 {
+		return id >= low && id <= high
+	}
+	return want_id == 0 || id == want_id
+}
+
+/*
+ *  Description:    判断用户是否满足查询条件中的非空字段
+ */
+func matchFields(usr, cond *User) bool {
+	return (cond.Name == "" || usr.Name == cond.Name) &&
+		(cond.Gender == "" || usr.Gender == cond.Gender) &&
+		(cond.Birthday == "" || usr.Birthday == cond.Birthday) &&
+		(cond.Email == "" || usr.Email == cond.Email) &&
+		(cond.Phone == "" || usr.Phone == cond.Phone)
+}
+
+func (usr_list UserList) Len() int           { return len(usr_list) }
+func (usr_list UserList) Less(i, j int) bool { return usr_list[i].ID < usr_list[j].ID }
+func (usr_list UserList) Swap(i, j int)      { usr_list[i], usr_list[j] = usr_list[j], usr_list[i] }
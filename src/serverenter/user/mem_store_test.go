@@ -0,0 +1,114 @@
+package USER
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+ *  Description:    事务期间通过原存储读写不会等待事务结束，有其他写入时提交返回 ErrTxConflict
+ */
+func TestMemTxReentrant(t *testing.T) {
+	store := NewMemStore()
+	addUsers(t, store, "a")
+
+	tx, err := store.BeginTx()
+	if err != nil {
+		t.Fatalf("BeginTx: %v", err)
+	}
+	if err := tx.AddUser(&User{Name: "b"}); err != nil {
+		t.Fatalf("tx.AddUser: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		//没有提交的修改对原存储不可见
+		if _, err := store.FetchDefinitions(); err != nil {
+			t.Errorf("FetchDefinitions: %v", err)
+		}
+		if count, _ := store.CountUsers(&UserQueryPack{Offset: -1, Limit: -1, IDRange: Range{Low: -1, High: -1}}); count != 1 {
+			t.Errorf("事务期间原存储有 %d 个用户, want 1", count)
+		}
+		addUsers(t, store, "c")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("事务期间访问原存储没有返回")
+	}
+
+	if err := tx.Commit(); err != ErrTxConflict {
+		t.Fatalf("Commit: %v, want ErrTxConflict", err)
+	}
+	if err := tx.Rollback(); err != ErrTxDone {
+		t.Fatalf("Rollback: %v, want ErrTxDone", err)
+	}
+	if name := fetchOne(t, store, 2).Name; name != "c" {
+		t.Fatalf("用户 2 为 %s, want c", name)
+	}
+
+	//没有其他写入时提交成功
+	tx, _ = store.BeginTx()
+	addUsers(t, tx, "d")
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if name := fetchOne(t, store, 3).Name; name != "d" {
+		t.Fatalf("用户 3 为 %s, want d", name)
+	}
+}
+
+/*
+ *  Description:    添加用户失败时不分配ID，usr 不变
+ */
+func TestMemAddUserConflict(t *testing.T) {
+	store := NewMemStore()
+	if err := store.AddUser(&User{Name: "a", Email: "a@x.com"}); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+
+	usr := &User{Name: "b", Email: "a@x.com"}
+	if _, ok := store.AddUser(usr).(*ConflictError); !ok {
+		t.Fatalf("重复的邮箱没有返回 *ConflictError")
+	}
+	if usr.ID != 0 || usr.Version != 0 {
+		t.Fatalf("失败后 usr = %+v, want ID 和 Version 为0", usr)
+	}
+
+	usr.Email = "b@x.com"
+	if err := store.AddUser(usr); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if usr.ID != 2 {
+		t.Fatalf("用户ID = %d, want 2", usr.ID)
+	}
+}
+
+/*
+ *  Description:    获取用户所在的组时，用户不存在或已经软删除返回 ErrUserNotFound
+ */
+func TestMemUserGroupsNotFound(t *testing.T) {
+	store := NewMemStore()
+	addUsers(t, store, "a")
+	group := &Group{Name: "g"}
+	if err := store.AddGroup(group); err != nil {
+		t.Fatalf("AddGroup: %v", err)
+	}
+	if err := store.AddMember(group.ID, 1); err != nil {
+		t.Fatalf("AddMember: %v", err)
+	}
+	if groups, err := store.FetchUserGroups(1); err != nil || len(groups) != 1 {
+		t.Fatalf("FetchUserGroups(1) = %v, %v, want 1 个组", groups, err)
+	}
+
+	if _, err := store.FetchUserGroups(2); err != ErrUserNotFound {
+		t.Fatalf("不存在的用户: %v, want ErrUserNotFound", err)
+	}
+	if err := store.DeleteUser(1, 0); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := store.FetchUserGroups(1); err != ErrUserNotFound {
+		t.Fatalf("软删除的用户: %v, want ErrUserNotFound", err)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ 数据库结构迁移
+ 1. 迁移按版本号从小到大执行，每个迁移都有 up 和 down
+ 2. 已经执行的迁移记录在 schema_migrations 表中
+ 3. 执行迁移前获取 mysql 的命名锁，保证同一时间只有一个实例在迁移
+ 4. 锁，schema_migrations 的读写和迁移都在同一个连接上执行，连接池只有1个连接时也不会等待
+*/
+package USER
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"third/gorm"
+	"time"
+)
+
+const (
+	MIGRATION_TABLE   = "schema_migrations"
+	MIGRATION_LOCK    = "user_manager_schema_migrations"
+	MIGRATION_TIMEOUT = 30 //等待迁移锁的最长时间(秒)
+)
+
+var ErrMigrationLocked = errors.New("其他实例正在迁移数据库结构")
+
+//一个数据库结构迁移
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(db *gorm.DB) error
+	Down    func(db *gorm.DB) error
+}
+
+//迁移的执行状态
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"` //nil 表示还没有执行
+}
+
+//schema_migrations 表中的一行
+type schemaMigration struct {
+	Version   int `gorm:"primary_key"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (m schemaMigration) TableName() string {
+	return MIGRATION_TABLE
+}
+
+type Migrator struct {
+	db         *DB
+	migrations []Migration
+}
+
+/*
+ *  Description:    创建迁移执行器，使用 migrations.go 中注册的全部迁移
+ */
+func NewMigrator(db *DB) *Migrator {
+	migrations := make([]Migration, len(userMigrations))
+	copy(migrations, userMigrations)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return &Migrator{db: db, migrations: migrations}
+}
+
+/*
+ *  Description:    执行还没有执行的迁移
+ *  Params       :   steps 最多执行的个数，<=0 表示全部
+ *   Returns      :   执行成功的迁移， error 执行失败的原因
+ */
+func (m *Migrator) Up(steps int) ([]Migration, error) {
+	done := []Migration{}
+	err := m.withLock(func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			if steps > 0 && len(done) >= steps {
+				break
+			}
+			if err := migration.Up(db); err != nil {
+				return fmt.Errorf("迁移 %d_%s up 失败: %v", migration.Version, migration.Name, err)
+			}
+			record := schemaMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+			if err := db.Create(&record).Error; err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+/*
+ *  Description:    按版本号从大到小回滚已经执行的迁移
+ *  Params       :   steps 最多回滚的个数，<=0 时回滚1个
+ *   Returns      :   回滚成功的迁移， error 回滚失败的原因
+ */
+func (m *Migrator) Down(steps int) ([]Migration, error) {
+	if steps <= 0 {
+		steps = 1
+	}
+	done := []Migration{}
+	err := m.withLock(func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if err := migration.Down(db); err != nil {
+				return fmt.Errorf("迁移 %d_%s down 失败: %v", migration.Version, migration.Name, err)
+			}
+			if err := db.Where("version = ?", migration.Version).Delete(&schemaMigration{}).Error; err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+/*
+ *  Description:    获取全部迁移的执行状态
+ */
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied(m.db.DB)
+	if err != nil {
+		return nil, err
+	}
+	status := []MigrationStatus{}
+	for _, migration := range m.migrations {
+		item := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			applied_at := record.AppliedAt
+			item.AppliedAt = &applied_at
+		}
+		status = append(status, item)
+	}
+	return status, nil
+}
+
+/*
+ *  Description:    获取还没有执行的迁移数量，服务启动时用来判断数据库结构是否落后
+ */
+func (m *Migrator) Pending() (int, error) {
+	applied, err := m.applied(m.db.DB)
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+/*
+ *  Description:    获取已经执行的迁移，schema_migrations 表不存在时视为没有执行任何迁移
+ */
+func (m *Migrator) applied(db *gorm.DB) (map[int]schemaMigration, error) {
+	applied := make(map[int]schemaMigration)
+	exists, err := hasTable(db, MIGRATION_TABLE)
+	if err != nil || !exists {
+		return applied, err
+	}
+	records := []schemaMigration{}
+	if err := db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+/*
+ *  Description:    持有迁移锁执行 fn, 锁为 mysql 的 GET_LOCK, 必须在同一个连接上获取和释放
+ *                   fn 的参数是该连接上的 gorm 句柄，fn 中的全部操作都使用这个连接，不再从连接池获取连接
+ */
+func (m *Migrator) withLock(fn func(db *gorm.DB) error) error {
+	ctx := context.Background()
+	conn, err := m.db.DB.DB().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", MIGRATION_LOCK, MIGRATION_TIMEOUT).Scan(&locked); err != nil {
+		return err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return ErrMigrationLocked
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", MIGRATION_LOCK)
+
+	pinned, err := gorm.Open("mysql", &pinnedConn{conn: conn})
+	if err != nil {
+		return err
+	}
+	err = pinned.Exec("CREATE TABLE IF NOT EXISTS `" + MIGRATION_TABLE + "` (" +
+		"`version` int NOT NULL, `name` varchar(255), `applied_at` timestamp NULL, PRIMARY KEY (`version`))").Error
+	if err != nil {
+		return err
+	}
+	return fn(&pinned)
+}
+
+//固定在一个连接上的 gorm 底层接口，不支持事务
+type pinnedConn struct {
+	conn *sql.Conn
+}
+
+func (p *pinnedConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return p.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (p *pinnedConn) Prepare(query string) (*sql.Stmt, error) {
+	return p.conn.PrepareContext(context.Background(), query)
+}
+
+func (p *pinnedConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return p.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (p *pinnedConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return p.conn.QueryRowContext(context.Background(), query, args...)
+}
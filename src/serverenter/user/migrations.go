@@ -0,0 +1,312 @@
+/*
+ 数据库结构迁移列表，新的迁移追加在最后，版本号递增，已经发布的迁移不能修改
+ 早期版本使用 AutoMigrate 同步表结构，所以迁移需要兼容表和列已经存在的情况
+*/
+package USER
+
+import (
+	"log"
+	"third/gorm"
+)
+
+var userMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create_user",
+		Up: func(db *gorm.DB) error {
+			return db.Exec("CREATE TABLE IF NOT EXISTS `user` (" +
+				"`id` int AUTO_INCREMENT, `name` varchar(255), `gender` varchar(255), `birthday` varchar(255), " +
+				"PRIMARY KEY (`id`))").Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Exec("DROP TABLE IF EXISTS `user`").Error
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add_user_deleted_at",
+		Up: func(db *gorm.DB) error {
+			return addColumn(db, "user", "deleted_at", "timestamp NULL")
+		},
+		Down: func(db *gorm.DB) error {
+			return dropColumn(db, "user", "deleted_at")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add_user_version",
+		Up: func(db *gorm.DB) error {
+			return addColumn(db, "user", "version", "int NOT NULL DEFAULT 1")
+		},
+		Down: func(db *gorm.DB) error {
+			return dropColumn(db, "user", "version")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "create_user_history",
+		Up: func(db *gorm.DB) error {
+			err := db.Exec("CREATE TABLE IF NOT EXISTS `user_history` (" +
+				"`id` int AUTO_INCREMENT, `user_id` int, `version` int, `action` varchar(255), " +
+				"`operator` varchar(255), `client_ip` varchar(255), `created_at` timestamp NULL, " +
+				"`changes` text, `snapshot` text, PRIMARY KEY (`id`))").Error
+			if err != nil {
+				return err
+			}
+			return addIndex(db, "user_history", "idx_user_history_user_id", "user_id")
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Exec("DROP TABLE IF EXISTS `user_history`").Error
+		},
+	},
+	{
+		//生日从字符串改为 DATE, 原来的字符串保留在 birthday_legacy 中，无法解析的行生日为 NULL
+		Version: 5,
+		Name:    "normalize_user_birthday",
+		Up: func(db *gorm.DB) error {
+			legacy, err := hasColumn(db, "user", "birthday_legacy")
+			if err != nil || legacy {
+				return err
+			}
+			if err := addColumn(db, "user", "birthday_date", "date NULL"); err != nil {
+				return err
+			}
+			if err := normalizeBirthday(db); err != nil {
+				return err
+			}
+			return db.Exec("ALTER TABLE `user` CHANGE `birthday` `birthday_legacy` varchar(255), " +
+				"CHANGE `birthday_date` `birthday` date NULL").Error
+		},
+		Down: func(db *gorm.DB) error {
+			legacy, err := hasColumn(db, "user", "birthday_legacy")
+			if err != nil || !legacy {
+				return err
+			}
+			err = db.Exec("ALTER TABLE `user` CHANGE `birthday` `birthday_date` date NULL, " +
+				"CHANGE `birthday_legacy` `birthday` varchar(255)").Error
+			if err != nil {
+				return err
+			}
+			//迁移之后修改过的生日以 DATE 为准
+			err = db.Exec("UPDATE `user` SET `birthday` = DATE_FORMAT(`birthday_date`, '%Y-%m-%d') WHERE `birthday_date` IS NOT NULL").Error
+			if err != nil {
+				return err
+			}
+			return dropColumn(db, "user", "birthday_date")
+		},
+	},
+	{
+		//空的邮箱和手机号存为 NULL, 唯一索引允许多个 NULL
+		Version: 6,
+		Name:    "add_user_email_phone",
+		Up: func(db *gorm.DB) error {
+			if err := addColumn(db, "user", "email", "varchar(255) NULL"); err != nil {
+				return err
+			}
+			if err := addColumn(db, "user", "phone", "varchar(32) NULL"); err != nil {
+				return err
+			}
+			if err := addUniqueIndex(db, "user", "uix_user_email", "email"); err != nil {
+				return err
+			}
+			return addUniqueIndex(db, "user", "uix_user_phone", "phone")
+		},
+		Down: func(db *gorm.DB) error {
+			//删除列时同时删除列上的索引
+			if err := dropColumn(db, "user", "phone"); err != nil {
+				return err
+			}
+			return dropColumn(db, "user", "email")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "create_user_attribute",
+		Up: func(db *gorm.DB) error {
+			err := db.Exec("CREATE TABLE IF NOT EXISTS `attribute_definition` (" +
+				"`id` int AUTO_INCREMENT, `name` varchar(64) NOT NULL, `type` varchar(16) NOT NULL, `rules` text, " +
+				"PRIMARY KEY (`id`), UNIQUE KEY `uix_attribute_definition_name` (`name`))").Error
+			if err != nil {
+				return err
+			}
+			//按属性值查询用户时使用 (attribute_id, value) 索引
+			return db.Exec("CREATE TABLE IF NOT EXISTS `user_attribute` (" +
+				"`user_id` int NOT NULL, `attribute_id` int NOT NULL, `value` varchar(1024) NOT NULL, " +
+				"PRIMARY KEY (`user_id`, `attribute_id`), KEY `idx_user_attribute_value` (`attribute_id`, `value`(191)))").Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Exec("DROP TABLE IF EXISTS `user_attribute`").Error; err != nil {
+				return err
+			}
+			return db.Exec("DROP TABLE IF EXISTS `attribute_definition`").Error
+		},
+	},
+	{
+		//sort 参数可以使用的字段都要有索引，email 和 phone 已经有唯一索引
+		Version: 8,
+		Name:    "add_user_sort_indexes",
+		Up: func(db *gorm.DB) error {
+			if err := addIndex(db, "user", "idx_user_name", "name"); err != nil {
+				return err
+			}
+			return addIndex(db, "user", "idx_user_birthday", "birthday")
+		},
+		Down: func(db *gorm.DB) error {
+			if err := dropIndex(db, "user", "idx_user_birthday"); err != nil {
+				return err
+			}
+			return dropIndex(db, "user", "idx_user_name")
+		},
+	},
+	{
+		//按用户查询所在的组时使用 user_id 索引
+		Version: 9,
+		Name:    "create_user_group",
+		Up: func(db *gorm.DB) error {
+			err := db.Exec("CREATE TABLE IF NOT EXISTS `user_group` (" +
+				"`id` int AUTO_INCREMENT, `name` varchar(64) NOT NULL, `description` varchar(1024) NOT NULL DEFAULT '', " +
+				"PRIMARY KEY (`id`), UNIQUE KEY `uix_user_group_name` (`name`))").Error
+			if err != nil {
+				return err
+			}
+			return db.Exec("CREATE TABLE IF NOT EXISTS `user_group_member` (" +
+				"`group_id` int NOT NULL, `user_id` int NOT NULL, " +
+				"PRIMARY KEY (`group_id`, `user_id`), KEY `idx_user_group_member_user_id` (`user_id`))").Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Exec("DROP TABLE IF EXISTS `user_group_member`").Error; err != nil {
+				return err
+			}
+			return db.Exec("DROP TABLE IF EXISTS `user_group`").Error
+		},
+	},
+	{
+		//密码哈希单独保存，不在 user 表中，避免随用户数据一起读出
+		Version: 10,
+		Name:    "create_user_credential",
+		Up: func(db *gorm.DB) error {
+			return db.Exec("CREATE TABLE IF NOT EXISTS `user_credential` (" +
+				"`user_id` int NOT NULL, `algorithm` varchar(32) NOT NULL, `hash` varchar(255) NOT NULL, " +
+				"`updated_at` timestamp NULL, PRIMARY KEY (`user_id`))").Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Exec("DROP TABLE IF EXISTS `user_credential`").Error
+		},
+	},
+}
+
+/*
+ *  Description:    把字符串生日解析后写入 birthday_date 列，无法解析的行打印出来，不中断迁移
+ */
+func normalizeBirthday(db *gorm.DB) error {
+	rows, err := db.Raw("SELECT `id`, `birthday` FROM `user` WHERE `birthday` IS NOT NULL AND `birthday` <> ''").Rows()
+	if err != nil {
+		return err
+	}
+	//先读出全部数据再更新，避免读取时占用连接
+	birthdays := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var birthday string
+		if err := rows.Scan(&id, &birthday); err != nil {
+			rows.Close()
+			return err
+		}
+		birthdays[id] = birthday
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	bad := 0
+	for id, birthday := range birthdays {
+		date, err := ParseDate(birthday)
+		if err != nil {
+			log.Printf("用户 %d 的生日 %q 无法解析，原值保留在 birthday_legacy 中\n", id, birthday)
+			bad++
+			continue
+		}
+		if err := db.Exec("UPDATE `user` SET `birthday_date` = ? WHERE `id` = ?", string(date), id).Error; err != nil {
+			return err
+		}
+	}
+	log.Printf("规范化生日 %d 个，无法解析 %d 个\n", len(birthdays)-bad, bad)
+	return nil
+}
+
+/*
+ *  Description:    增加列，列已经存在时不做处理
+ */
+func addColumn(db *gorm.DB, table, column, typ string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	return db.Exec("ALTER TABLE `" + table + "` ADD `" + column + "` " + typ).Error
+}
+
+/*
+ *  Description:    删除列，列不存在时不做处理
+ */
+func dropColumn(db *gorm.DB, table, column string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || !exists {
+		return err
+	}
+	return db.Exec("ALTER TABLE `" + table + "` DROP COLUMN `" + column + "`").Error
+}
+
+/*
+ *  Description:    增加索引，索引已经存在时不做处理
+ */
+func addIndex(db *gorm.DB, table, index string, columns ...string) error {
+	exists, err := hasIndex(db, table, index)
+	if err != nil || exists {
+		return err
+	}
+	return db.Table(table).AddIndex(index, columns...).Error
+}
+
+/*
+ *  Description:    删除索引，索引不存在时不做处理
+ */
+func dropIndex(db *gorm.DB, table, index string) error {
+	exists, err := hasIndex(db, table, index)
+	if err != nil || !exists {
+		return err
+	}
+	return db.Exec("ALTER TABLE `" + table + "` DROP INDEX `" + index + "`").Error
+}
+
+/*
+ *  Description:    增加唯一索引，索引已经存在时不做处理
+ */
+func addUniqueIndex(db *gorm.DB, table, index string, columns ...string) error {
+	exists, err := hasIndex(db, table, index)
+	if err != nil || exists {
+		return err
+	}
+	return db.Table(table).AddUniqueIndex(index, columns...).Error
+}
+
+func hasIndex(db *gorm.DB, table, index string) (bool, error) {
+	count := 0
+	err := db.Raw("SELECT count(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+		table, index).Row().Scan(&count)
+	return count > 0, err
+}
+
+func hasColumn(db *gorm.DB, table, column string) (bool, error) {
+	count := 0
+	err := db.Raw("SELECT count(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?",
+		table, column).Row().Scan(&count)
+	return count > 0, err
+}
+
+func hasTable(db *gorm.DB, table string) (bool, error) {
+	count := 0
+	err := db.Raw("SELECT count(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?",
+		table).Row().Scan(&count)
+	return count > 0, err
+}
@@ -0,0 +1,200 @@
+/*
+ 用户的密码，密码的哈希单独保存在 user_credential 表中，不属于 User, 不会出现在查询，导出，修改历史和缓存中
+ 1. 哈希使用带盐的自适应 KDF, 和算法标识一起保存，算法或参数变化后，登录成功时按当前的算法重新计算
+ 2. 当前算法为 pbkdf2-sha256(600000 次迭代)，新的算法实现 PasswordHasher 后加入 password_hashers
+ 3. 哈希编码为 <参数>$<盐>$<哈希值>，盐和哈希值为不带填充的 base64
+ 4. 比较哈希值的时间与内容无关，用户不存在或没有密码时也计算一次哈希，见 VerifyNothing
+*/
+package USER
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrNoCredential      = errors.New("用户没有设置密码")
+	ErrCredentialChanged = errors.New("密码已经被其他请求修改")
+)
+
+const (
+	MIN_PASSWORD_LENGTH = 8    //密码的最小长度(字符数)
+	MAX_PASSWORD_BYTES  = 1024 //密码的最大长度(字节数)，避免计算过长的密码
+)
+
+//当前使用的哈希算法
+const DEFAULT_PASSWORD_ALGORITHM = "pbkdf2-sha256"
+
+//支持的哈希算法，保存的算法标识 -> 实现
+var password_hashers = map[string]PasswordHasher{
+	DEFAULT_PASSWORD_ALGORITHM: pbkdf2Hasher{iterations: 600000, salt_len: 16, key_len: 32},
+}
+
+//密码哈希算法
+type PasswordHasher interface {
+	//生成随机的盐并计算密码的哈希，返回编码后的哈希
+	Hash(password string) (string, error)
+	//检查密码与编码后的哈希是否一致，哈希格式错误时返回错误
+	Verify(password, hash string) (bool, error)
+	//编码后的哈希使用的参数是否落后于当前的参数
+	Outdated(hash string) bool
+}
+
+//用户的密码哈希，存入数据库中的结构
+type Credential struct {
+	UserID    int       `gorm:"primary_key" json:"user_id"`
+	Algorithm string    `json:"algorithm"` //哈希算法标识，见 password_hashers
+	Hash      string    `json:"-" xml:"-"` //编码后的哈希，包括参数和盐，不能输出
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+/*
+ *  Description:    初始化数据库中的表名
+ *   Returns      :   返回数据库中的表名字符串
+ */
+func (cred Credential) TableName() string {
+	return "user_credential"
+}
+
+/*
+ *  Description:    打印时不包括哈希
+ */
+func (cred Credential) String() string {
+	return fmt.Sprintf("Credential{UserID: %d, Algorithm: %s}", cred.UserID, cred.Algorithm)
+}
+
+func (cred Credential) GoString() string {
+	return cred.String()
+}
+
+/*
+ *  Description:    检查密码是否满足长度要求，密码不去掉空白
+ */
+func CheckPassword(password string) error {
+	if utf8.RuneCountInString(password) < MIN_PASSWORD_LENGTH {
+		return errors.New("密码不能少于 8 个字符")
+	}
+	if len(password) > MAX_PASSWORD_BYTES {
+		return errors.New("密码不能超过 1024 个字节")
+	}
+	return nil
+}
+
+/*
+ *  Description:    使用当前的算法计算用户的密码哈希
+ *  Params       :   user_id 用户ID, password 已经通过 CheckPassword 检查的密码
+ */
+func NewCredential(user_id int, password string) (*Credential, error) {
+	hash, err := password_hashers[DEFAULT_PASSWORD_ALGORITHM].Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{UserID: user_id, Algorithm: DEFAULT_PASSWORD_ALGORITHM, Hash: hash, UpdatedAt: time.Now()}, nil
+}
+
+/*
+ *  Description:    检查密码是否正确
+ *   Returns      :   bool 是否正确，error 算法未知或哈希格式错误
+ */
+func (cred *Credential) Verify(password string) (bool, error) {
+	hasher, ok := password_hashers[cred.Algorithm]
+	if !ok {
+		return false, fmt.Errorf("用户 %d 的密码使用了未知的算法 %s", cred.UserID, cred.Algorithm)
+	}
+	return hasher.Verify(password, cred.Hash)
+}
+
+/*
+ *  Description:    是否需要按当前的算法和参数重新计算哈希
+ */
+func (cred *Credential) Outdated() bool {
+	if cred.Algorithm != DEFAULT_PASSWORD_ALGORITHM {
+		return true
+	}
+	return password_hashers[cred.Algorithm].Outdated(cred.Hash)
+}
+
+/*
+ *  Description:    用户不存在或没有密码时按当前的算法计算一次哈希并丢弃，使响应时间与密码错误时相同
+ */
+func VerifyNothing(password string) {
+	password_hashers[DEFAULT_PASSWORD_ALGORITHM].Hash(password)
+}
+
+//用户的密码哈希的存储
+type CredentialStore interface {
+	//保存用户的密码哈希，只有当前的哈希等于 current 时才保存，current 为空表示当前没有密码
+	//用户不存在(或已经软删除)返回 ErrUserNotFound，当前的哈希不一致返回 ErrCredentialChanged
+	SetCredential(cred *Credential, current string) error
+	//获取用户的密码哈希，没有设置密码时返回 ErrNoCredential
+	FetchCredential(user_id int) (*Credential, error)
+}
+
+//PBKDF2-HMAC-SHA256, 编码为 i=<迭代次数>$<盐>$<哈希值>
+type pbkdf2Hasher struct {
+	iterations int
+	salt_len   int
+	key_len    int
+}
+
+//读取哈希时允许的最大迭代次数，避免错误的数据占用过多的时间
+const MAX_PBKDF2_ITERATIONS = 10000000
+
+func (hasher pbkdf2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, hasher.salt_len)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, hasher.iterations, hasher.key_len)
+	if err != nil {
+		return "", err
+	}
+	return "i=" + strconv.Itoa(hasher.iterations) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key), nil
+}
+
+func (hasher pbkdf2Hasher) Verify(password, hash string) (bool, error) {
+	iterations, salt, key, err := hasher.decode(hash)
+	if err != nil {
+		return false, err
+	}
+	computed, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+func (hasher pbkdf2Hasher) Outdated(hash string) bool {
+	iterations, salt, key, err := hasher.decode(hash)
+	return err != nil || iterations < hasher.iterations || len(salt) < hasher.salt_len || len(key) < hasher.key_len
+}
+
+/*
+ *  Description:    解析编码后的哈希，错误信息中不包括哈希的内容
+ */
+func (hasher pbkdf2Hasher) decode(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "i=") {
+		return 0, nil, nil, errors.New("pbkdf2 哈希格式错误")
+	}
+	iterations, err := strconv.Atoi(strings.TrimPrefix(parts[0], "i="))
+	if err != nil || iterations <= 0 || iterations > MAX_PBKDF2_ITERATIONS {
+		return 0, nil, nil, errors.New("pbkdf2 迭代次数错误")
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[1])
+	key, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(salt) == 0 || len(key) == 0 {
+		return 0, nil, nil, errors.New("pbkdf2 盐或哈希值格式错误")
+	}
+	return iterations, salt, key, nil
+}
@@ -0,0 +1,282 @@
+/*
+ 查询用户列表时的排序，例如 sort=-birthday,name,id
+ 1. 字段前加 - 表示降序，只能按有索引的字段排序: id, name, birthday, email, phone
+ 2. 没有 id 时自动在最后按 id 升序排序，保证顺序确定，分页时不会重复或遗漏
+ 3. 没有值(NULL)的 name, birthday, email, phone 升序时排在最前，降序时排在最后，与 mysql 一致
+    name 为空字符串和 NULL 都算没有值，按 NULLIF(name, '') 排序
+ 4. mysql 中字符串按列的排序规则比较，内存存储中按字节比较
+*/
+package USER
+
+import (
+	"fmt"
+	"strings"
+)
+
+//排序字段
+type SortField struct {
+	Name string
+	Desc bool
+}
+
+//多个字段的排序，按先后顺序比较
+type Sort []SortField
+
+//排序字段无效
+type SortError struct {
+	Field   string   `json:"field"`
+	Message string   `json:"message"`
+	Allowed []string `json:"allowed"`
+}
+
+func (err *SortError) Error() string {
+	return fmt.Sprintf("排序字段 %q %s，允许的字段: %s", err.Field, err.Message, strings.Join(err.Allowed, ", "))
+}
+
+//可以排序的列
+type sortColumn struct {
+	nullable bool                        //空值存为 NULL
+	expr     string                      //sql 中排序的表达式，为空时为列名
+	value    func(usr *User) interface{} //排序的值，int 或 string
+}
+
+/*
+ *  Description:    排序字段在 sql 中的表达式
+ */
+func (field SortField) column() string {
+	if expr := sort_columns[field.Name].expr; expr != "" {
+		return expr
+	}
+	return "`" + field.Name + "`"
+}
+
+var sort_columns = map[string]sortColumn{
+	"id":       {value: func(usr *User) interface{} { return usr.ID }},
+	"name":     {nullable: true, expr: "NULLIF(`name`, '')", value: func(usr *User) interface{} { return usr.Name }},
+	"birthday": {nullable: true, value: func(usr *User) interface{} { return string(usr.Birthday) }},
+	"email":    {nullable: true, value: func(usr *User) interface{} { return string(usr.Email) }},
+	"phone":    {nullable: true, value: func(usr *User) interface{} { return string(usr.Phone) }},
+}
+
+var sort_allowed = []string{"id", "name", "birthday", "email", "phone"}
+
+/*
+ *  Description:    解析排序，字段用逗号分隔，前面加 - 表示降序，+ 或者不加表示升序
+ *   Returns      :   Sort 排序(最后一定是 id)， error 字段无效或重复时返回 *SortError
+ */
+func ParseSort(source string) (Sort, error) {
+	order := Sort{}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(source, ",") {
+		field := SortField{Name: strings.ToLower(strings.TrimSpace(part))}
+		if strings.HasPrefix(field.Name, "-") {
+			field.Name, field.Desc = field.Name[1:], true
+		} else {
+			field.Name = strings.TrimPrefix(field.Name, "+")
+		}
+
+		if _, ok := sort_columns[field.Name]; !ok {
+			message := "不能排序"
+			if field.Name == "" {
+				message = "为空"
+			}
+			return nil, &SortError{Field: strings.TrimSpace(part), Message: message, Allowed: sort_allowed}
+		}
+		if seen[field.Name] {
+			return nil, &SortError{Field: strings.TrimSpace(part), Message: "重复", Allowed: sort_allowed}
+		}
+		seen[field.Name] = true
+		order = append(order, field)
+
+		//id 唯一，后面的字段不会影响顺序
+		if field.Name == "id" {
+			break
+		}
+	}
+	if !seen["id"] {
+		order = append(order, SortField{Name: "id"})
+	}
+	return order, nil
+}
+
+/*
+ *  Description:    兼容 order 参数，1 按ID升序，-1 按ID降序，其他值不排序
+ */
+func OrderSort(order int) Sort {
+	switch order {
+	case 1:
+		return Sort{{Name: "id"}}
+	case -1:
+		return Sort{{Name: "id", Desc: true}}
+	}
+	return nil
+}
+
+/*
+ *  Description:    排序的规范写法，与 ParseSort 的输入格式相同
+ */
+func (order Sort) String() string {
+	parts := make([]string, len(order))
+	for i, field := range order {
+		parts[i] = field.Name
+		if field.Desc {
+			parts[i] = "-" + field.Name
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+/*
+ *  Description:    方向相反的排序，NULL 的位置也相反
+ */
+func (order Sort) reverse() Sort {
+	reversed := make(Sort, len(order))
+	for i, field := range order {
+		reversed[i] = SortField{Name: field.Name, Desc: !field.Desc}
+	}
+	return reversed
+}
+
+/*
+ *  Description:    用户在每个排序字段上的值，没有值的可空字段为 nil
+ */
+func (order Sort) values(usr *User) []interface{} {
+	values := make([]interface{}, len(order))
+	for i, field := range order {
+		column := sort_columns[field.Name]
+		values[i] = column.value(usr)
+		if column.nullable && values[i] == "" {
+			values[i] = nil
+		}
+	}
+	return values
+}
+
+/*
+ *  Description:    按排序比较用户和另一个用户在排序字段上的值
+ *   Returns      :   int 用户在前返回负数，在后返回正数，相同返回0
+ */
+func (order Sort) compare(usr *User, values []interface{}) int {
+	for i, value := range order.values(usr) {
+		result := compareSortValue(value, values[i])
+		if order[i].Desc {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+/*
+ *  Description:    比较两个排序的值，nil 最小
+ */
+func compareSortValue(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	if x, ok := a.(int); ok {
+		y, _ := b.(int)
+		return x - y
+	}
+	x, _ := a.(string)
+	y, _ := b.(string)
+	return strings.Compare(x, y)
+}
+
+/*
+ *  Description:    sql 的 ORDER BY 子句
+ */
+func (order Sort) orderBy() string {
+	parts := make([]string, len(order))
+	for i, field := range order {
+		parts[i] = field.column()
+		if field.Desc {
+			parts[i] += " DESC"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+/*
+ *  Description:    生成排在 values 之后的用户的查询条件(keyset)
+ *                  (f1 > v1) OR (f1 = v1 AND f2 > v2) OR ...，NULL 按 mysql 的顺序处理
+ *   Returns      :   string 参数化的查询条件, []interface{} 参数
+ */
+func (order Sort) seek(values []interface{}) (string, []interface{}) {
+	terms := []string{}
+	args := []interface{}{}
+	for i, field := range order {
+		column := field.column()
+
+		//前面的字段都相等
+		conds := []string{}
+		term_args := []interface{}{}
+		for j := 0; j < i; j++ {
+			prev := order[j].column()
+			if values[j] == nil {
+				conds = append(conds, prev+" IS NULL")
+			} else {
+				conds = append(conds, prev+" = ?")
+				term_args = append(term_args, values[j])
+			}
+		}
+
+		//当前字段在后面
+		value := values[i]
+		switch {
+		case !field.Desc && value == nil:
+			conds = append(conds, column+" IS NOT NULL")
+		case !field.Desc:
+			conds = append(conds, column+" > ?")
+			term_args = append(term_args, value)
+		case value == nil:
+			//降序时 NULL 在最后，后面没有用户
+			continue
+		case sort_columns[field.Name].nullable:
+			conds = append(conds, "("+column+" < ? OR "+column+" IS NULL)")
+			term_args = append(term_args, value)
+		default:
+			conds = append(conds, column+" < ?")
+			term_args = append(term_args, value)
+		}
+
+		terms = append(terms, "("+strings.Join(conds, " AND ")+")")
+		args = append(args, term_args...)
+	}
+	if len(terms) == 0 {
+		return "1 = 0", nil
+	}
+	return "(" + strings.Join(terms, " OR ") + ")", args
+}
+
+//按排序比较用户，用于内存存储
+type userSorter struct {
+	list  UserList
+	order Sort
+}
+
+func (sorter *userSorter) Len() int { return len(sorter.list) }
+
+func (sorter *userSorter) Swap(i, j int) {
+	sorter.list[i], sorter.list[j] = sorter.list[j], sorter.list[i]
+}
+
+func (sorter *userSorter) Less(i, j int) bool {
+	return sorter.order.compare(&sorter.list[i], sorter.order.values(&sorter.list[j])) < 0
+}
+
+/*
+ *  Description:    把用户列表倒序
+ */
+func (usr_list UserList) reverse() {
+	for i, j := 0, len(usr_list)-1; i < j; i, j = i+1, j-1 {
+		usr_list[i], usr_list[j] = usr_list[j], usr_list[i]
+	}
+}
@@ -0,0 +1,113 @@
+package USER
+
+import (
+	"reflect"
+	"testing"
+)
+
+/*
+ *  Description:    按 name 翻页时，没有名字的用户(空字符串)与 NULL 一样排在一起，每个用户只出现一次
+ */
+func TestSortPageNullName(t *testing.T) {
+	store := NewMemStore()
+	addUsers(t, store, "b", "", "a", "", "b", "c", "")
+
+	cases := []struct {
+		sort string
+		want []int
+	}{
+		{"name", []int{2, 4, 7, 3, 1, 5, 6}},
+		{"-name", []int{6, 1, 5, 3, 2, 4, 7}},
+		{"name,-id", []int{7, 4, 2, 3, 5, 1, 6}},
+	}
+	for _, c := range cases {
+		order, err := ParseSort(c.sort)
+		if err != nil {
+			t.Fatalf("ParseSort(%s): %v", c.sort, err)
+		}
+
+		//向后翻页
+		ids := []int{}
+		var cursor *Cursor
+		for page := 0; page < len(c.want); page++ {
+			usr_list := UserList{}
+			u_pack := &UserQueryPack{Offset: -1, Limit: 2, IDRange: Range{Low: -1, High: -1}, Sort: order, Cursor: cursor}
+			if err := store.FetchUsers(&usr_list, u_pack); err != nil {
+				t.Fatalf("sort=%s FetchUsers: %v", c.sort, err)
+			}
+			if len(usr_list) == 0 {
+				break
+			}
+			for _, usr := range usr_list {
+				ids = append(ids, usr.ID)
+			}
+			if cursor, err = ParseCursor(EncodeCursor(order, &usr_list[len(usr_list)-1]), false); err != nil {
+				t.Fatalf("sort=%s ParseCursor: %v", c.sort, err)
+			}
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("sort=%s 向后翻页得到 %v, want %v", c.sort, ids, c.want)
+		}
+
+		//从最后一个用户向前翻页
+		last := fetchOne(t, store, c.want[len(c.want)-1])
+		cursor, _ = ParseCursor(EncodeCursor(order, last), true)
+		ids = []int{}
+		for page := 0; page < len(c.want); page++ {
+			usr_list := UserList{}
+			u_pack := &UserQueryPack{Offset: -1, Limit: 2, IDRange: Range{Low: -1, High: -1}, Sort: order, Cursor: cursor}
+			if err := store.FetchUsers(&usr_list, u_pack); err != nil {
+				t.Fatalf("sort=%s FetchUsers: %v", c.sort, err)
+			}
+			if len(usr_list) == 0 {
+				break
+			}
+			page_ids := []int{}
+			for _, usr := range usr_list {
+				page_ids = append(page_ids, usr.ID)
+			}
+			ids = append(page_ids, ids...)
+			cursor, _ = ParseCursor(EncodeCursor(order, &usr_list[0]), true)
+		}
+		if want := c.want[:len(c.want)-1]; !reflect.DeepEqual(ids, want) {
+			t.Errorf("sort=%s 向前翻页得到 %v, want %v", c.sort, ids, want)
+		}
+	}
+}
+
+/*
+ *  Description:    mysql 中 name 为 NULL 或空字符串时的排序和 keyset 条件
+ */
+func TestSortNullNameSql(t *testing.T) {
+	order, _ := ParseSort("name")
+	if got, want := order.orderBy(), "NULLIF(`name`, ''), `id`"; got != want {
+		t.Errorf("orderBy = %s, want %s", got, want)
+	}
+
+	cases := []struct {
+		order  Sort
+		values []interface{}
+		cond   string
+		args   []interface{}
+	}{
+		{order, []interface{}{nil, 4},
+			"((NULLIF(`name`, '') IS NOT NULL) OR (NULLIF(`name`, '') IS NULL AND `id` > ?))", []interface{}{4}},
+		{order, []interface{}{"a", 3},
+			"((NULLIF(`name`, '') > ?) OR (NULLIF(`name`, '') = ? AND `id` > ?))", []interface{}{"a", "a", 3}},
+		{order.reverse(), []interface{}{"a", 3},
+			"(((NULLIF(`name`, '') < ? OR NULLIF(`name`, '') IS NULL)) OR (NULLIF(`name`, '') = ? AND `id` < ?))", []interface{}{"a", "a", 3}},
+		{order.reverse(), []interface{}{nil, 4},
+			"((NULLIF(`name`, '') IS NULL AND `id` < ?))", []interface{}{4}},
+	}
+	for _, c := range cases {
+		cond, args := c.order.seek(c.values)
+		if cond != c.cond || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%s seek(%v) = %s %v, want %s %v", c.order, c.values, cond, args, c.cond, c.args)
+		}
+	}
+
+	//用户的空名字作为 NULL 放入游标
+	if values := order.values(&User{ID: 2}); values[0] != nil {
+		t.Errorf("空名字的排序值 = %v, want nil", values[0])
+	}
+}
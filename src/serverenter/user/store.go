@@ -0,0 +1,115 @@
+/*
+ 用户存储接口，屏蔽具体的存储后端
+*/
+package USER
+
+import (
+	"errors"
+)
+
+const (
+	STORE_TYPE_MYSQL  = "mysql"  //gorm + mysql 存储
+	STORE_TYPE_MEMORY = "memory" //进程内存储，用于测试和本地开发
+)
+
+//用户存储接口，实现了增加，删除，修改，查询等操作
+type UserStore interface {
+	//增加用户
+	AddUser(usr *User) error
+	//更新用户，low/high 为 -1 时表示不限制ID范围
+	UpdateUsers(usr *User, low, high int) error
+	//按ID更新单个用户，version 不为0时原子地检查当前版本，成功后 usr 为更新后的完整数据
+	UpdateUser(usr *User, version int) error
+	//与 UpdateUser 相同，但空字段也会写入，用于恢复到历史版本
+	ReplaceUser(usr *User, version int) error
+	//软删除用户，low/high 为 -1 时表示不限制ID范围，usr 的非空字段作为删除条件
+	DeleteUsers(usr *User, low, high int) error
+	//按ID软删除单个用户，version 不为0时原子地检查当前版本
+	DeleteUser(id, version int) error
+	//恢复软删除的用户
+	RestoreUser(id int) error
+	//彻底删除用户，version 不为0时原子地检查当前版本
+	PurgeUser(id, version int) error
+	//按查询包获取用户列表，不包括已经软删除的用户
+	FetchUsers(usr_list *UserList, u_pack *UserQueryPack) error
+	//按查询包获取已经软删除的用户列表
+	FetchDeletedUsers(usr_list *UserList, u_pack *UserQueryPack) error
+	//统计满足查询包条件的用户数量，忽略偏移，数量和排序，不包括已经软删除的用户
+	CountUsers(u_pack *UserQueryPack) (int, error)
+	//统计列表的总数，deleted 为 true 时统计已经软删除的用户
+	//threshold 大于0时最多精确统计到 threshold 行，超过时返回估计值，exact 为 false
+	TotalUsers(u_pack *UserQueryPack, deleted bool, threshold int) (total int, exact bool, err error)
+	//按查询包逐个读取用户交给 each, 不把全部结果加载到内存，each 返回错误时停止读取并返回该错误
+	//忽略游标，没有指定排序时按ID升序
+	ExportUsers(u_pack *UserQueryPack, each func(usr *User) error) error
+	//开始一个事务，返回的存储上的操作在提交前对其他请求不可见
+	BeginTx() (UserTx, error)
+	//开始一次批量导入，upsert 为 email 或 phone 时按该字段更新已有用户，atomic 时全部成功或全部回滚
+	BeginImport(upsert string, atomic bool) (UserImporter, error)
+	//关闭存储，释放资源
+	Close() error
+
+	HistoryStore
+	AttributeStore
+	GroupStore
+	CredentialStore
+}
+
+var (
+	ErrTxDone     = errors.New("事务已经提交或回滚")
+	ErrTxConflict = errors.New("事务期间数据已经被其他请求修改")
+)
+
+//内存存储的导入批次提交冲突(ErrTxConflict)时重新写入的最多次数
+const TX_CONFLICT_RETRIES = 3
+
+//事务中的用户存储，Commit 或 Rollback 之后不能再使用
+type UserTx interface {
+	UserStore
+	//提交事务，内存存储在事务期间有其他写入时返回 ErrTxConflict, 事务中的修改全部丢弃
+	Commit() error
+	//回滚事务，已经提交或回滚时返回 ErrTxDone
+	Rollback() error
+}
+
+/*
+ *  Description:    在 store 的事务中执行 fn, fn 返回错误时回滚，已经在事务中时直接使用该事务
+ */
+func inTransaction(store UserStore, fn func(tx UserStore) error) error {
+	if _, ok := store.(UserTx); ok {
+		return fn(store)
+	}
+	tx, err := store.BeginTx()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+ *  Description:    根据存储类型创建用户存储
+ *  Params       :   store_type 存储类型, mysql_conn mysql连接串, pool_size 连接池大小
+ *   Returns      :   UserStore 用户存储，　error nil表示成功　非nil表示失败
+ */
+func CreateUserStore(store_type, mysql_conn string, pool_size int) (UserStore, error) {
+	switch store_type {
+	case "", STORE_TYPE_MYSQL:
+		db, err := OpenDB(mysql_conn, pool_size)
+		if err != nil {
+			return nil, err
+		}
+		//数据库结构落后时拒绝启动
+		if err := db.CheckSchema(); err != nil {
+			db.Close()
+			return nil, err
+		}
+		return WithAttributes(db), nil
+	case STORE_TYPE_MEMORY:
+		return WithAttributes(NewMemStore()), nil
+	}
+	return nil, errors.New("未知的存储类型: " + store_type)
+}
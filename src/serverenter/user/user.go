@@ -4,15 +4,84 @@
 package USER
 
 import (
+	"database/sql/driver"
 	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUserNotFound    = errors.New("用户不存在")
+	ErrVersionMismatch = errors.New("用户版本不一致，已经被其他请求修改")
 )
 
 //用户结构体，存入数据库中的结构
 type User struct {
-	ID       int `gorm:"primary_key"`
-	Name     string
-	Gender   string
-	Birthday string
+	ID       int    `gorm:"primary_key" form:"id" xml:"id"`
+	Name     string `form:"name" xml:"name"`
+	Gender   string `form:"gender" xml:"gender"`                     //性别规范值，见 GenderVocabulary
+	Birthday Date   `sql:"type:date" form:"birthday" xml:"birthday"` //生日 YYYY-MM-DD, 空表示没有填写
+
+	Email NullString `form:"email" xml:"email"` //邮箱，小写，唯一
+	Phone NullString `form:"phone" xml:"phone"` //手机号，E.164 格式，唯一
+
+	Version   int         `sql:"not null;default:1" xml:"-"` //版本号，每次修改加1，用于乐观并发控制
+	DeletedAt DeletedTime `xml:"-"`                          //软删除时间，零值表示没有删除
+
+	GenderLabel string     `sql:"-" xml:"gender_label,omitempty" json:",omitempty"` //性别的本地化名称，只用于输出
+	Attributes  Attributes `sql:"-" xml:"-" json:",omitempty"`                      //自定义属性，见 AttributedStore
+}
+
+//软删除时间，零值对应数据库中的 NULL
+//不用 *time.Time 是因为 gorm 判断字段是否为空时会对 nil 指针调用 IsZero
+type DeletedTime struct {
+	time.Time
+}
+
+/*
+ *  Description:    实现 sql.Scanner，NULL 读成零值
+ */
+func (t *DeletedTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	default:
+		return fmt.Errorf("无法把 %T 转换成删除时间", value)
+	}
+	return nil
+}
+
+/*
+ *  Description:    实现 driver.Valuer，零值写成 NULL
+ */
+func (t DeletedTime) Value() (driver.Value, error) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	return t.Time, nil
+}
+
+/*
+ *  Description:    零值输出成 null，和没有删除时的含义一致
+ */
+func (t DeletedTime) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return t.Time.MarshalJSON()
+}
+
+/*
+ *  Description:    null 解析成零值
+ */
+func (t *DeletedTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		t.Time = time.Time{}
+		return nil
+	}
+	return t.Time.UnmarshalJSON(data)
 }
 
 /*
@@ -23,38 +92,99 @@ func (u User) TableName() string {
 	return "user"
 }
 
-func (usr *User) Update(db DB, low, high int) error {
+/*
+ *  Description:    更新用户，low/high 为 -1 时表示不限制ID范围
+ */
+func (usr *User) Update(store UserStore, low, high int) error {
+	return store.UpdateUsers(usr, low, high)
+}
 
-	update := db.Model(&User{})
+/*
+ *  Description:    删除用户，low/high 为 -1 时表示不限制ID范围
+ */
+func (usr *User) Delete(store UserStore, low, high int) error {
+	return store.DeleteUsers(usr, low, high)
+}
 
-	//数据ID范围限制
-	if low != -1 && high != -1 {
-		//ID范围有效 u_pack.Usr.ID 强制赋值成0
-		usr.ID = 0
-		update = update.Where("id >= ? and id <= ?", low, high)
+/*
+ *  Description:    按ID更新单个用户，成功后 usr 为更新后的完整数据
+ *  Params       :   store 用户存储, version 不为0时只有当前版本等于 version 才更新
+ *   Returns      :   用户不存在返回 ErrUserNotFound，版本不一致返回 ErrVersionMismatch
+ */
+func (usr *User) UpdateOne(store UserStore, version int) error {
+	return store.UpdateUser(usr, version)
+}
+
+/*
+ *  Description:    把单个用户恢复到历史版本的数据，修改历史中记录为 revert
+ *  Params       :   store 用户存储, to_version 要恢复到的版本, version 不为0时只有当前版本等于 version 才恢复
+ *                   genders 性别词表，历史版本中的性别映射成当前的规范值
+ *   Returns      :   用户或历史版本不存在返回 ErrUserNotFound，版本不一致返回 ErrVersionMismatch
+ */
+func (usr *User) Revert(store UserStore, to_version, version int, genders *GenderVocabulary) error {
+	old, err := UserAtVersion(store, usr.ID, to_version)
+	if err != nil {
+		return err
+	}
+	//规范化之前的历史版本中可能是其他格式
+	if old.Birthday != "" {
+		if old.Birthday, err = ParseDate(string(old.Birthday)); err != nil {
+			return err
+		}
+	}
+	if old.Gender, err = genders.Normalize(old.Gender); err != nil {
+		return err
 	}
+	usr.Name, usr.Gender, usr.Birthday = old.Name, old.Gender, old.Birthday
+	usr.Email, usr.Phone = old.Email, old.Phone
 
-	err := update.Updates(usr).Error
-	return err
+	//属性定义可能已经删除或修改，只恢复仍然有效的属性值
+	defs, err := store.FetchDefinitions()
+	if err != nil {
+		return err
+	}
+	usr.Attributes = Attributes{}
+	for name, value := range old.Attributes {
+		if def := defs.Find(name); def != nil {
+			if valid, err := def.Validate(value); err == nil {
+				usr.Attributes[name] = valid
+			}
+		}
+	}
+	return store.ReplaceUser(usr, version)
 }
 
-func (usr *User) Delete(db DB, low, high int) error {
-
-	del := db.Model(&User{})
+/*
+ *  Description:    按ID软删除单个用户
+ *  Params       :   store 用户存储, version 不为0时只有当前版本等于 version 才删除
+ *   Returns      :   用户不存在返回 ErrUserNotFound，版本不一致返回 ErrVersionMismatch
+ */
+func (usr *User) DeleteOne(store UserStore, version int) error {
+	return store.DeleteUser(usr.ID, version)
+}
 
-	//数据ID范围限制
-	if low != -1 && high != -1 {
-		//ID范围有效 u_pack.Usr.ID 强制赋值成0
-		usr.ID = 0
-		del = del.Where("id >= ? and id <= ?", low, high)
-	}
+/*
+ *  Description:    恢复已经软删除的用户
+ *   Returns      :   用户不存在或没有被删除时返回 ErrUserNotFound
+ */
+func (usr *User) Restore(store UserStore) error {
+	return store.RestoreUser(usr.ID)
+}
 
-	return del.Delete(usr).Error
+/*
+ *  Description:    彻底删除用户，不论是否已经软删除
+ *  Params       :   store 用户存储, version 不为0时只有当前版本等于 version 才删除
+ *   Returns      :   用户不存在返回 ErrUserNotFound，版本不一致返回 ErrVersionMismatch
+ */
+func (usr *User) Purge(store UserStore, version int) error {
+	return store.PurgeUser(usr.ID, version)
 }
 
-func (usr *User) Add(db DB) error {
-	add := db.Model(&User{})
-	return add.Create(usr).Error
+/*
+ *  Description:    增加用户
+ */
+func (usr *User) Add(store UserStore) error {
+	return store.AddUser(usr)
 }
 
 //范围 [low, high]
@@ -70,40 +200,37 @@ type UserQueryPack struct {
 	Limit   int   //限制返回多少条记录
 	Order   int   // -1 降序 1 升序
 	IDRange Range //查询ID的范围
-}
 
-type UserList []User
-
-func (usr_list *UserList) Fetch(db DB, u_pack *UserQueryPack) error {
-	if u_pack == nil {
-		return errors.New("用户查询包为空 u_pack == nil")
-	}
-
-	usr := u_pack.Usr
-
-	query := db.Model(&User{})
-
-	//数据ID范围限制
-	if u_pack.IDRange.Low != -1 && u_pack.IDRange.High != -1 {
-		//ID范围有效 u_pack.Usr.ID 强制赋值成0
-		usr.ID = 0
-		query = query.Where("id >= ? and id <= ?", u_pack.IDRange.Low, u_pack.IDRange.High)
-	}
+	Birthday DateRange //生日范围，出生日期和年龄的条件都转换成生日范围
+	Filter   *Filter   //filter 表达式，nil 表示没有
+	Cursor   *Cursor   //游标，nil 表示按偏移分页，不为 nil 时忽略 Offset 和排序
+	Sort     Sort      //排序，为空时按 Order 排序
+	Fields   *FieldSet //只查询部分字段，nil 表示全部字段
+	Group    int       //只查询该组的成员，0 表示不限制
+}
 
-	//数据偏移
-	if u_pack.Offset != -1 {
-		query = query.Offset(u_pack.Offset)
+/*
+ *  Description:    查询使用的排序，没有 Sort 时按 Order 转换成按ID排序
+ */
+func (u_pack *UserQueryPack) Sorting() Sort {
+	if len(u_pack.Sort) != 0 {
+		return u_pack.Sort
 	}
+	return OrderSort(u_pack.Order)
+}
 
-	//数量限制
-	if u_pack.Limit != -1 {
-		query = query.Limit(u_pack.Limit)
-	}
+type UserList []User
 
-	//数据排序
-	if u_pack.Order != 0 {
-		query = query.Order("id")
-	}
+/*
+ *  Description:    按查询包获取用户列表
+ */
+func (usr_list *UserList) Fetch(store UserStore, u_pack *UserQueryPack) error {
+	return store.FetchUsers(usr_list, u_pack)
+}
 
-	return query.Where(&usr).Find(usr_list).Error
+/*
+ *  Description:    按查询包获取已经软删除的用户列表(回收站)
+ */
+func (usr_list *UserList) FetchDeleted(store UserStore, u_pack *UserQueryPack) error {
+	return store.FetchDeletedUsers(usr_list, u_pack)
 }